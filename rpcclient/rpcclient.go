@@ -23,6 +23,9 @@ var errNotFound = func(v interface{}) error {
 }
 var cli *Client
 
+// campaign is returned too, with Inactive set
+var ErrCampaignInactive = service.ErrCampaignInactive
+
 type Client struct {
 	connection *rpc.Client
 	conf       ClientConfig
@@ -62,6 +65,8 @@ func Init(clientConf ClientConfig) error {
 		conf: clientConf,
 		m:    initMetrics(),
 	}
+	// campaigns served by the client share the autoclick counters of mid
+	service.RemoteAutoClick = campaignNextAutoClick
 	if err = cli.dial(); err != nil {
 		err = fmt.Errorf("cli.dial: %s", err.Error())
 		log.WithField("error", err.Error()).Error("mid rpc client unavialable")
@@ -142,6 +147,9 @@ func GetCampaignByHash(hash string) (service.Campaign, error) {
 	if campaign.Id == "" {
 		return campaign, errNotFound(hash)
 	}
+	if err == nil && campaign.Inactive {
+		return campaign, ErrCampaignInactive
+	}
 	return campaign, err
 }
 func GetCampaignByLink(link string) (service.Campaign, error) {
@@ -154,6 +162,9 @@ func GetCampaignByLink(link string) (service.Campaign, error) {
 	if campaign.Id == "" {
 		return campaign, errNotFound(link)
 	}
+	if err == nil && campaign.Inactive {
+		return campaign, ErrCampaignInactive
+	}
 	return campaign, err
 }
 func GetCampaignByKeyWord(keyWord string) (service.Campaign, error) {
@@ -180,6 +191,21 @@ func GetCampaignByUUID(uuid string) (service.Campaign, error) {
 	}
 	return campaign, err
 }
+
+// campaign as it was at the moment
+func GetCampaignByUUIDAt(uuid string, at time.Time) (service.Campaign, error) {
+	var campaign service.Campaign
+	err := call(
+		"Campaign.ByUUIDAt",
+		handlers.GetByUUIDAtParams{UUID: uuid, At: at},
+		&campaign,
+	)
+	if campaign.Id == "" {
+		return campaign, errNotFound(uuid)
+	}
+	return campaign, err
+}
+
 func GetCampaignByServiceCode(serviceCode string) (service.Campaign, error) {
 	var campaign service.Campaign
 	err := call(
@@ -192,6 +218,62 @@ func GetCampaignByServiceCode(serviceCode string) (service.Campaign, error) {
 	}
 	return campaign, err
 }
+
+// whether the hit of the campaign must be autoclicked
+func CampaignNextAutoClick(campaignId string) (bool, error) {
+	autoClick, _, err := campaignNextAutoClick(campaignId)
+	return autoClick, err
+}
+
+func campaignNextAutoClick(campaignId string) (bool, int64, error) {
+	var res handlers.AutoClickResponse
+	err := call(
+		"Campaign.NextAutoClick",
+		handlers.GetByUUIDParams{UUID: campaignId},
+		&res,
+	)
+	return res.AutoClick, res.Count, err
+}
+
+// switches the landing to the previous version, returns the version
+func RollbackLanding(id string) (string, error) {
+	var res handlers.LandingVersionResponse
+	err := call(
+		"Campaign.RollbackLanding",
+		handlers.GetByUUIDParams{UUID: id},
+		&res,
+	)
+	return res.Version, err
+}
+
+// false with the reached cap if the campaign must not take the hit
+func CampaignAllow(campaignId string, operatorCode int64) (bool, string, error) {
+	var res handlers.AllowResponse
+	err := call(
+		"Campaign.Allow",
+		handlers.AllowParams{CampaignId: campaignId, OperatorCode: operatorCode},
+		&res,
+	)
+	return res.Allowed, res.Reason, err
+}
+
+// campaign of the service by routing rules for the operator, publisher and country
+func CampaignRoute(req service.RouteRequest) (service.Campaign, int64, error) {
+	var res handlers.RouteResponse
+	err := call(
+		"Campaign.Route",
+		req,
+		&res,
+	)
+	if res.Campaign.Id == "" {
+		return res.Campaign, 0, errNotFound(req.ServiceCode)
+	}
+	if err == nil && res.Campaign.Inactive {
+		return res.Campaign, res.RouteId, ErrCampaignInactive
+	}
+	return res.Campaign, res.RouteId, err
+}
+
 func GetAllCampaigns() (map[string]service.Campaign, error) {
 	var res handlers.GetAllCampaignsResponse
 	err := call(
@@ -255,6 +337,48 @@ func GetServiceByCode(serviceCode string) (xmp_api_structs.Service, error) {
 	return svc, err
 }
 
+// service as it was at the moment
+func GetServiceByIdAt(serviceId string, at time.Time) (xmp_api_structs.Service, error) {
+	var svc xmp_api_structs.Service
+	err := call(
+		"Service.ByIdAt",
+		handlers.GetByUUIDAtParams{UUID: serviceId, At: at},
+		&svc,
+	)
+	if svc.Id == "" {
+		return svc, errNotFound(serviceId)
+	}
+	return svc, err
+}
+
+// price of the service for the operator at the moment, zero time - now
+func GetServicePriceFor(serviceCode string, operatorCode int64, at time.Time) (service.EffectivePrice, error) {
+	var res service.EffectivePrice
+	err := call(
+		"Service.PriceFor",
+		handlers.PriceForParams{ServiceCode: serviceCode, OperatorCode: operatorCode, At: at},
+		&res,
+	)
+	if res.PriceCents == 0 {
+		return res, errNotFound(serviceCode)
+	}
+	return res, err
+}
+
+// whether the service may be charged at the moment, zero time - now
+func ServiceCanCharge(serviceCode string, state service.ChargeState, at time.Time) (service.ChargeDecision, error) {
+	var res service.ChargeDecision
+	err := call(
+		"Service.CanCharge",
+		handlers.CanChargeParams{ServiceCode: serviceCode, State: state, At: at},
+		&res,
+	)
+	if !res.Allowed && res.Reason == "" {
+		return res, errNotFound(serviceCode)
+	}
+	return res, err
+}
+
 func GetContentById(uuid string) (xmp_api_structs.Content, error) {
 	var content xmp_api_structs.Content
 	err := call(
@@ -294,6 +418,20 @@ func GetPixelSettingByKeyWithRatio(key string) (service.PixelSetting, error) {
 	return pixelSetting, err
 }
 
+// the next content for the msisdn, it is recorded as sent
+func GetNextContent(msisdn, serviceCode string) (service.NextContent, error) {
+	var res service.NextContent
+	err := call(
+		"Content.Next",
+		handlers.GetByParams{Msisdn: msisdn, ServiceCode: serviceCode},
+		&res,
+	)
+	if res.Content.Id == "" {
+		return res, errNotFound(serviceCode)
+	}
+	return res, err
+}
+
 func SentContentClear(msisdn, serviceCode string) error {
 	var res handlers.Response
 	err := call(
@@ -448,6 +586,31 @@ func GetAllPublishers() (map[string]service.Publisher, error) {
 	return res.Publishers, err
 }
 
+// error of the regex or how it matches the samples
+func ValidatePublisher(regex string, samples []string) (service.PublisherValidation, error) {
+	var res service.PublisherValidation
+	err := call(
+		"Publisher.Validate",
+		handlers.ValidatePublisherParams{Regex: regex, Samples: samples},
+		&res,
+	)
+	return res, err
+}
+
+// publisher and click id by url, query string or referer of the hit
+func DetectPublisher(source string) (service.PublisherDetected, error) {
+	var res service.PublisherDetected
+	err := call(
+		"Publisher.Detect",
+		handlers.DetectParams{Source: source},
+		&res,
+	)
+	if err == nil && res.Publisher == "" {
+		return res, errNotFound(source)
+	}
+	return res, err
+}
+
 func GetAllDestinations() ([]service.Destination, error) {
 	var res handlers.GetAllDestinationsResponse
 	err := call(
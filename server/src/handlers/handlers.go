@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -39,6 +40,20 @@ type GetByIdParams struct {
 type GetByUUIDParams struct {
 	UUID string `json:"uuid,omitempty"`
 }
+type GetByUUIDAtParams struct {
+	UUID string    `json:"uuid,omitempty"`
+	At   time.Time `json:"at,omitempty"`
+}
+type PriceForParams struct {
+	ServiceCode  string    `json:"service_code,omitempty"`
+	OperatorCode int64     `json:"operator_code,omitempty"`
+	At           time.Time `json:"at,omitempty"` // zero - now
+}
+type CanChargeParams struct {
+	ServiceCode string              `json:"service_code,omitempty"`
+	At          time.Time           `json:"at,omitempty"` // zero - now
+	State       service.ChargeState `json:"state,omitempty"`
+}
 type GetByCodeParams struct {
 	Code string `json:"code,omitempty"`
 }
@@ -70,6 +85,17 @@ type RejectedParams struct {
 	CampaignCode string `json:"campaign_code,omitempty"`
 	ServiceCode  string `json:"service_code,omitempty"`
 }
+type DetectParams struct {
+	Source string `json:"source,omitempty"` // url, query string or referer
+}
+type ValidatePublisherParams struct {
+	Regex   string   `json:"regex,omitempty"`
+	Samples []string `json:"samples,omitempty"` // urls which the regex is checked on
+}
+type AllowParams struct {
+	CampaignId   string `json:"id_campaign,omitempty"`
+	OperatorCode int64  `json:"operator_code,omitempty"`
+}
 type Response struct{}
 
 type GetContentSentResponse struct {
@@ -78,6 +104,21 @@ type GetContentSentResponse struct {
 type BoolResponse struct {
 	Result bool `json:"result,omitempty"`
 }
+type AutoClickResponse struct {
+	AutoClick bool  `json:"autoclick,omitempty"`
+	Count     int64 `json:"count,omitempty"`
+}
+type LandingVersionResponse struct {
+	Version string `json:"version,omitempty"`
+}
+type AllowResponse struct {
+	Allowed bool   `json:"allowed,omitempty"`
+	Reason  string `json:"reason,omitempty"` // the cap which is reached
+}
+type RouteResponse struct {
+	Campaign service.Campaign `json:"campaign,omitempty"`
+	RouteId  int64            `json:"id_route,omitempty"` // 0 - no rule, first active campaign of the service
+}
 
 // Campaign
 type Campaign struct{}
@@ -86,6 +127,11 @@ func (rpc *Campaign) ByHash(
 	req GetByHashParams, res *service.Campaign) error {
 
 	campaign, err := service.Svc.Campaigns.GetByHash(req.Hash)
+	if err == service.ErrCampaignInactive {
+		campaignInactive.Inc()
+		*res = campaign
+		return nil
+	}
 	if err != nil {
 		notFound.Inc()
 		errors.Inc()
@@ -99,6 +145,11 @@ func (rpc *Campaign) ByLink(
 	req GetByLinkParams, res *service.Campaign) error {
 
 	campaign, err := service.Svc.Campaigns.GetByLink(req.Link)
+	if err == service.ErrCampaignInactive {
+		campaignInactive.Inc()
+		*res = campaign
+		return nil
+	}
 	if err != nil {
 		notFound.Inc()
 		errors.Inc()
@@ -123,6 +174,21 @@ func (rpc *Campaign) ByUUID(
 	return nil
 }
 
+// campaign as it was at the moment
+func (rpc *Campaign) ByUUIDAt(
+	req GetByUUIDAtParams, res *service.Campaign) error {
+
+	campaign, err := service.Svc.Campaigns.ByUUIDAt(req.UUID, req.At)
+	if err != nil {
+		notFound.Inc()
+		errors.Inc()
+		return nil
+	}
+	*res = campaign
+	success.Inc()
+	return nil
+}
+
 func (rpc *Campaign) ByServiceCode(
 	req GetByCodeParams, res *service.Campaign) error {
 
@@ -169,6 +235,72 @@ func (rpc *Campaign) All(
 	return nil
 }
 
+func (rpc *Campaign) NextAutoClick(
+	req GetByUUIDParams, res *AutoClickResponse) error {
+
+	campaign, err := service.Svc.Campaigns.GetByUUID(req.UUID)
+	if err != nil {
+		notFound.Inc()
+		errors.Inc()
+		return nil
+	}
+	autoClick := campaign.NextAutoClick()
+	*res = AutoClickResponse{AutoClick: autoClick, Count: campaign.AutoClickCount}
+
+	success.Inc()
+	return nil
+}
+
+// id of the campaign or campaign-variant
+func (rpc *Campaign) RollbackLanding(
+	req GetByUUIDParams, res *LandingVersionResponse) error {
+
+	version, err := service.Svc.Campaigns.RollbackLanding(req.UUID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":    req.UUID,
+			"error": err.Error(),
+		}).Error("cannot rollback landing")
+		errors.Inc()
+		return err
+	}
+	*res = LandingVersionResponse{Version: version}
+	success.Inc()
+	return nil
+}
+
+// checks caps of the campaign, allowed hit is counted
+func (rpc *Campaign) Allow(
+	req AllowParams, res *AllowResponse) error {
+
+	allowed, reason := service.Svc.CampaignCaps.Allow(req.CampaignId, req.OperatorCode, time.Now())
+	*res = AllowResponse{Allowed: allowed, Reason: reason}
+
+	success.Inc()
+	return nil
+}
+
+// campaign of the service by routing rules
+func (rpc *Campaign) Route(
+	req service.RouteRequest, res *RouteResponse) error {
+
+	campaign, route, err := service.Svc.CampaignRoutes.Route(req)
+	if err == service.ErrCampaignInactive {
+		campaignInactive.Inc()
+		*res = RouteResponse{Campaign: campaign, RouteId: route.Id}
+		return nil
+	}
+	if err != nil {
+		notFound.Inc()
+		errors.Inc()
+		return nil
+	}
+	*res = RouteResponse{Campaign: campaign, RouteId: route.Id}
+
+	success.Inc()
+	return nil
+}
+
 // BlackList
 type BlackList struct{}
 
@@ -279,6 +411,55 @@ func (rpc *Service) ByCode(
 	return nil
 }
 
+// service as it was at the moment, prices of old transactions
+func (rpc *Service) ByIdAt(
+	req GetByUUIDAtParams, res *xmp_api_structs.Service) error {
+
+	svc, err := service.Svc.Services.ByIdAt(req.UUID, req.At)
+	if err != nil {
+		notFound.Inc()
+		errors.Inc()
+		return nil
+	}
+	*res = svc
+	success.Inc()
+	return nil
+}
+
+// effective price of the service for the operator at the moment
+func (rpc *Service) PriceFor(
+	req PriceForParams, res *service.EffectivePrice) error {
+
+	at := req.At
+	if at.IsZero() {
+		at = time.Now()
+	}
+	price, err := service.Svc.ServicePrices.PriceFor(req.ServiceCode, req.OperatorCode, at)
+	if err != nil {
+		notFound.Inc()
+		errors.Inc()
+		return nil
+	}
+	*res = price
+	success.Inc()
+	return nil
+}
+
+// whether the service may be charged at the moment and the next allowed time
+func (rpc *Service) CanCharge(
+	req CanChargeParams, res *service.ChargeDecision) error {
+
+	decision, err := service.Svc.Services.CanCharge(req.ServiceCode, req.State, req.At)
+	if err != nil {
+		notFound.Inc()
+		errors.Inc()
+		return nil
+	}
+	*res = decision
+	success.Inc()
+	return nil
+}
+
 // Pixel Setting
 type PixelSetting struct{}
 
@@ -340,6 +521,21 @@ func (rpc *Content) ById(
 	return nil
 }
 
+// picks the next content for the msisdn and records it as sent
+func (rpc *Content) Next(
+	req GetByParams, res *service.NextContent) error {
+
+	next, err := service.Svc.SentContents.Next(req.Msisdn, req.ServiceCode)
+	if err != nil {
+		notFound.Inc()
+		errors.Inc()
+		return nil
+	}
+	*res = next
+	success.Inc()
+	return nil
+}
+
 type Operator struct{}
 
 func (rpc *Operator) ByCode(
@@ -422,6 +618,31 @@ func (rpc *Publisher) All(
 	return nil
 }
 
+// checks the regex before it is inserted into publishers
+func (rpc *Publisher) Validate(
+	req ValidatePublisherParams, res *service.PublisherValidation) error {
+
+	*res = service.ValidatePublisher(req.Regex, req.Samples)
+	if res.Error != "" {
+		errors.Inc()
+		return nil
+	}
+	success.Inc()
+	return nil
+}
+
+// publisher and click id of the hit, empty publisher if none matched
+func (rpc *Publisher) Detect(
+	req DetectParams, res *service.PublisherDetected) error {
+
+	*res = service.Svc.Publishers.Detect(req.Source)
+	if res.Publisher == "" {
+		notFound.Inc()
+	}
+	success.Inc()
+	return nil
+}
+
 type Destinations struct{}
 
 func (rpc *Destinations) All(
@@ -13,6 +13,7 @@ var (
 	urlCacheNotFound m.Gauge
 	unknownPrefix    m.Gauge
 	keyWordNotFound  m.Gauge
+	campaignInactive m.Gauge
 )
 
 func midMetric(appname, name string) m.Gauge {
@@ -26,6 +27,7 @@ func InitMetrics(appName string) {
 	urlCacheNotFound = midMetric(appName, "uniqueurl_not_found")
 	unknownPrefix = midMetric(appName, "prefix_unknown")
 	keyWordNotFound = midMetric(appName, "keyword_not_found")
+	campaignInactive = midMetric(appName, "campaign_inactive")
 
 	go func() {
 		for range time.Tick(time.Minute) {
@@ -35,6 +37,7 @@ func InitMetrics(appName string) {
 			urlCacheNotFound.Update()
 			unknownPrefix.Update()
 			keyWordNotFound.Update()
+			campaignInactive.Update()
 		}
 	}()
 }
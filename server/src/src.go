@@ -44,6 +44,13 @@ func runGin(appConfig config.AppConfig) {
 	service.AddCQRHandlers(r)
 	service.AddTablesHandler(r)
 	service.AddAPIGetAgregateHandler(r)
+	service.AddAPIGetRevenueHandler(r)
+	service.AddBackfillHandlers(r)
+	service.AddLandingHandlers(r)
+	service.AddPublisherHandlers(r)
+	service.AddHistoryHandlers(r)
+	service.AddSentContentsHandlers(r)
+	service.AddDeadLetterHandlers(r)
 	service.AddStatusHandler(r)
 	m.AddHandler(r)
 
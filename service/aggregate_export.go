@@ -0,0 +1,150 @@
+package service
+
+// csv and xlsx output of /api/aggregate/get
+
+import (
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tealeg/xlsx"
+)
+
+var aggregateHeader = []string{
+	"report_at",
+	"campaign_id",
+	"campaign_code",
+	"operator_code",
+	"lp_hits",
+	"lp_msisdn_hits",
+	"mo",
+	"mo_charge_success",
+	"mo_charge_sum",
+	"mo_charge_failed",
+	"mo_rejected",
+	"outflow",
+	"renewal",
+	"renewal_charge_success",
+	"renewal_charge_sum",
+	"renewal_failed",
+	"injection",
+	"injection_charge_success",
+	"injection_charge_sum",
+	"injection_failed",
+	"expired",
+	"expired_charge_success",
+	"expired_charge_sum",
+	"expired_failed",
+	"pixels",
+	"unsubscribes",
+	"content_delivered",
+	"sms_sent",
+	"redirects",
+	"lp_hits_inactive",
+	"landing_variant",
+}
+
+// the rest are numbers
+var aggregateStringColumns = map[string]bool{
+	"report_at":       true,
+	"campaign_id":     true,
+	"campaign_code":   true,
+	"landing_variant": true,
+}
+
+func aggregateRecord(a Aggregate, loc *time.Location) []string {
+	i := func(v int64) string {
+		return strconv.FormatInt(v, 10)
+	}
+	return []string{
+		time.Unix(a.ReportAt, 0).In(loc).Format("2006-01-02"),
+		a.CampaignId,
+		a.CampaignCode,
+		i(a.OperatorCode),
+		i(a.LpHits),
+		i(a.LpMsisdnHits),
+		i(a.MoTotal),
+		i(a.MoChargeSuccess),
+		i(a.MoChargeSum),
+		i(a.MoChargeFailed),
+		i(a.MoRejected),
+		i(a.Outflow),
+		i(a.RenewalTotal),
+		i(a.RenewalChargeSuccess),
+		i(a.RenewalChargeSum),
+		i(a.RenewalFailed),
+		i(a.InjectionTotal),
+		i(a.InjectionChargeSuccess),
+		i(a.InjectionChargeSum),
+		i(a.InjectionFailed),
+		i(a.ExpiredTotal),
+		i(a.ExpiredChargeSuccess),
+		i(a.ExpiredChargeSum),
+		i(a.ExpiredFailed),
+		i(a.Pixels),
+		i(a.Unsubscribes),
+		i(a.ContentDelivered),
+		i(a.SMSSent),
+		i(a.Redirects),
+		i(a.LpHitsInactive),
+		a.LandingVariant,
+	}
+}
+
+func aggregateFileName(f AggregateFilter, ext string) string {
+	return fmt.Sprintf("aggregate_%s_%s.%s", f.From.Format("2006-01-02"), f.To.Format("2006-01-02"), ext)
+}
+
+func writeAggregateCSV(c *gin.Context, f AggregateFilter, res []Aggregate) error {
+	c.Writer.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	c.Writer.Header().Set("Content-Disposition", "attachment; filename="+aggregateFileName(f, "csv"))
+	c.Status(200)
+
+	w := csv.NewWriter(c.Writer)
+	if err := w.Write(aggregateHeader); err != nil {
+		return fmt.Errorf("csv.Write: %s", err.Error())
+	}
+	for _, a := range res {
+		if err := w.Write(aggregateRecord(a, f.Location)); err != nil {
+			return fmt.Errorf("csv.Write: %s", err.Error())
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("csv.Flush: %s", err.Error())
+	}
+	return nil
+}
+
+func writeAggregateXLSX(c *gin.Context, f AggregateFilter, res []Aggregate) error {
+	file := xlsx.NewFile()
+	sheet, err := file.AddSheet("aggregate")
+	if err != nil {
+		return fmt.Errorf("xlsx.AddSheet: %s", err.Error())
+	}
+	row := sheet.AddRow()
+	for _, name := range aggregateHeader {
+		row.AddCell().SetString(name)
+	}
+	for _, a := range res {
+		row = sheet.AddRow()
+		for n, v := range aggregateRecord(a, f.Location) {
+			if aggregateStringColumns[aggregateHeader[n]] {
+				row.AddCell().SetString(v)
+				continue
+			}
+			number, _ := strconv.ParseInt(v, 10, 64)
+			row.AddCell().SetInt64(number)
+		}
+	}
+
+	c.Writer.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	c.Writer.Header().Set("Content-Disposition", "attachment; filename="+aggregateFileName(f, "xlsx"))
+	c.Status(200)
+	if err = file.Write(c.Writer); err != nil {
+		return fmt.Errorf("xlsx.Write: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package service
+
+// filters, grouping and pagination for /api/aggregate/get
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	GroupByDay      = "day"
+	GroupByWeek     = "week"
+	GroupByMonth    = "month"
+	GroupByCampaign = "campaign"
+	GroupByOperator = "operator"
+)
+
+type AggregateFilter struct {
+	From          time.Time
+	To            time.Time
+	CampaignUUIDs []string // empty - all campaigns
+	OperatorCode  int64    // 0 - all operators
+	GroupBy       string
+	Location      *time.Location
+}
+
+// parse query string of the aggregate api
+// campaign: campaign code or uuid, service: service code,
+// operator: operator code, group_by: day, week, month, campaign or operator,
+// tz: IANA time zone name, the dates from and to are in this time zone too
+func parseAggregateFilter(c *gin.Context) (f AggregateFilter, err error) {
+	f.Location = time.UTC
+	if tz, ok := c.GetQuery("tz"); ok && tz != "" {
+		if f.Location, err = time.LoadLocation(tz); err != nil {
+			err = fmt.Errorf("Unknown time zone: %s", err.Error())
+			return
+		}
+	}
+
+	fromTimeString, ok := c.GetQuery("from")
+	if !ok {
+		err = fmt.Errorf("From bound required (time from to)%s", "")
+		return
+	}
+	if f.From, err = time.ParseInLocation("2006-01-02", fromTimeString, f.Location); err != nil {
+		err = fmt.Errorf("Error parse time: %s", err.Error())
+		return
+	}
+	toTimeString, ok := c.GetQuery("to")
+	if !ok {
+		err = fmt.Errorf("To bound required (time from to)%s", "")
+		return
+	}
+	if f.To, err = time.ParseInLocation("2006-01-02", toTimeString, f.Location); err != nil {
+		err = fmt.Errorf("Error parse time: %s", err.Error())
+		return
+	}
+
+	f.GroupBy = c.DefaultQuery("group_by", GroupByDay)
+	switch f.GroupBy {
+	case GroupByDay, GroupByWeek, GroupByMonth, GroupByCampaign, GroupByOperator:
+	default:
+		err = fmt.Errorf("Unknown group_by: %s", f.GroupBy)
+		return
+	}
+
+	if operatorCode, ok := c.GetQuery("operator"); ok && operatorCode != "" {
+		if f.OperatorCode, err = strconv.ParseInt(operatorCode, 10, 64); err != nil {
+			err = fmt.Errorf("Error parse operator code: %s", err.Error())
+			return
+		}
+	}
+
+	if campaign, ok := c.GetQuery("campaign"); ok && campaign != "" {
+		camp, err := findCampaign(campaign)
+		if err != nil {
+			return f, err
+		}
+		f.CampaignUUIDs = []string{camp.Id}
+	}
+
+	if serviceCode, ok := c.GetQuery("service"); ok && serviceCode != "" {
+		camps, err := Svc.Campaigns.GetByServiceCode(serviceCode)
+		if err != nil {
+			return f, err
+		}
+		byService := []string{}
+		for _, camp := range camps {
+			if len(f.CampaignUUIDs) == 0 || f.CampaignUUIDs[0] == camp.Id {
+				byService = append(byService, camp.Id)
+			}
+		}
+		if len(byService) == 0 {
+			return f, fmt.Errorf("Campaign %s doesn't belong to service %s", f.CampaignUUIDs[0], serviceCode)
+		}
+		f.CampaignUUIDs = byService
+	}
+	return
+}
+
+// campaign could be passed either by uuid or by code
+func findCampaign(campaign string) (Campaign, error) {
+	if camp, err := Svc.Campaigns.GetByUUID(campaign); err == nil {
+		return camp, nil
+	}
+	for _, camp := range Svc.Campaigns.GetAll() {
+		if camp.Code == campaign {
+			return camp, nil
+		}
+	}
+	return Campaign{}, fmt.Errorf("Campaign %s: not found", campaign)
+}
+
+// sent_at columns are timestamps without time zone in UTC,
+// they are converted explicitly, so the session time zone doesn't change the result
+const (
+	aggregateLocalSentAt = "timezone($3, sent_at AT TIME ZONE 'UTC')"
+	aggregateBounds      = "sent_at > ($1::timestamptz AT TIME ZONE 'UTC') AND sent_at < ($2::timestamptz AT TIME ZONE 'UTC')"
+	aggregateLocalFrom   = "date(timezone($3, $1::timestamptz))"
+)
+
+// additional conditions and arguments for the queries,
+// the first two arguments are always the bounds, the third one is a time zone
+func (f AggregateFilter) where() (string, []interface{}) {
+	args := []interface{}{f.From.UTC(), f.To.UTC(), f.Location.String()}
+	conditions := []string{}
+
+	if len(f.CampaignUUIDs) > 0 {
+		placeHolders := []string{}
+		for _, campaignUUID := range f.CampaignUUIDs {
+			args = append(args, campaignUUID)
+			placeHolders = append(placeHolders, fmt.Sprintf("$%d", len(args)))
+		}
+		conditions = append(conditions, "id_campaign IN ("+strings.Join(placeHolders, ", ")+")")
+	}
+	if f.OperatorCode != 0 {
+		args = append(args, f.OperatorCode)
+		conditions = append(conditions, fmt.Sprintf("operator_code = $%d", len(args)))
+	}
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " AND " + strings.Join(conditions, " AND "), args
+}
+
+// returns key of the group where the row of the date, campaign and operator goes
+func (f AggregateFilter) groupKey(date, campaignUUID string, operatorCode int64) (string, string, int64) {
+	switch f.GroupBy {
+	case GroupByWeek:
+		day, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			return date, campaignUUID, operatorCode
+		}
+		weekDay := (int(day.Weekday()) + 6) % 7 // monday is the first day
+		return day.AddDate(0, 0, -weekDay).Format("2006-01-02"), campaignUUID, operatorCode
+	case GroupByMonth:
+		return date[0:8] + "01", campaignUUID, operatorCode
+	case GroupByCampaign:
+		return f.From.Format("2006-01-02"), campaignUUID, 0
+	case GroupByOperator:
+		return f.From.Format("2006-01-02"), "", operatorCode
+	}
+	return date, campaignUUID, operatorCode
+}
+
+func sortAggregates(res []Aggregate) {
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].ReportAt != res[j].ReportAt {
+			return res[i].ReportAt < res[j].ReportAt
+		}
+		if res[i].CampaignCode != res[j].CampaignCode {
+			return res[i].CampaignCode < res[j].CampaignCode
+		}
+		if res[i].CampaignId != res[j].CampaignId {
+			return res[i].CampaignId < res[j].CampaignId
+		}
+		if res[i].OperatorCode != res[j].OperatorCode {
+			return res[i].OperatorCode < res[j].OperatorCode
+		}
+		return res[i].LandingVariant < res[j].LandingVariant
+	})
+}
+
+// limit and offset query parameters, limit 0 means all rows
+func paginateAggregates(c *gin.Context, res []Aggregate) ([]Aggregate, error) {
+	limit, offset := 0, 0
+	var err error
+	if limitString, ok := c.GetQuery("limit"); ok && limitString != "" {
+		if limit, err = strconv.Atoi(limitString); err != nil || limit < 0 {
+			return nil, fmt.Errorf("Wrong limit: %s", limitString)
+		}
+	}
+	if offsetString, ok := c.GetQuery("offset"); ok && offsetString != "" {
+		if offset, err = strconv.Atoi(offsetString); err != nil || offset < 0 {
+			return nil, fmt.Errorf("Wrong offset: %s", offsetString)
+		}
+	}
+	return pageAggregates(res, limit, offset), nil
+}
+
+func pageAggregates(res []Aggregate, limit, offset int) []Aggregate {
+	if offset > len(res) {
+		offset = len(res)
+	}
+	res = res[offset:]
+	if limit > 0 && limit < len(res) {
+		res = res[:limit]
+	}
+	return res
+}
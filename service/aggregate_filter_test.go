@@ -0,0 +1,60 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	xmp_api_structs "github.com/linkit360/xmp-api/src/structs"
+)
+
+func TestAggregateFilterWhere(t *testing.T) {
+	loc, _ := time.LoadLocation("Asia/Bangkok")
+	f := AggregateFilter{
+		From:     time.Date(2017, 6, 1, 0, 0, 0, 0, loc),
+		To:       time.Date(2017, 6, 2, 0, 0, 0, 0, loc),
+		Location: loc,
+	}
+	where, args := f.where()
+	assert.Equal(t, "", where)
+	assert.Equal(t, []interface{}{f.From.UTC(), f.To.UTC(), "Asia/Bangkok"}, args)
+
+	f.CampaignUUIDs = []string{"a", "b"}
+	f.OperatorCode = 52001
+	where, args = f.where()
+	assert.Equal(t, " AND id_campaign IN ($4, $5) AND operator_code = $6", where)
+	assert.Equal(t, []interface{}{f.From.UTC(), f.To.UTC(), "Asia/Bangkok", "a", "b", int64(52001)}, args)
+}
+
+func TestAggregateFilterGroupKey(t *testing.T) {
+	f := AggregateFilter{From: time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)}
+	key := func(groupBy, date string) []interface{} {
+		f.GroupBy = groupBy
+		d, c, o := f.groupKey(date, "camp", 52001)
+		return []interface{}{d, c, o}
+	}
+	assert.Equal(t, []interface{}{"2017-06-07", "camp", int64(52001)}, key(GroupByDay, "2017-06-07"))
+	assert.Equal(t, []interface{}{"2017-06-05", "camp", int64(52001)}, key(GroupByWeek, "2017-06-11"), "monday")
+	assert.Equal(t, []interface{}{"2017-06-01", "camp", int64(52001)}, key(GroupByMonth, "2017-06-11"))
+	assert.Equal(t, []interface{}{"2017-06-01", "camp", int64(0)}, key(GroupByCampaign, "2017-06-11"))
+	assert.Equal(t, []interface{}{"2017-06-01", "", int64(52001)}, key(GroupByOperator, "2017-06-11"))
+}
+
+func TestAggregateSortAndPage(t *testing.T) {
+	agg := func(reportAt int64, code string, operatorCode int64) Aggregate {
+		return Aggregate{Aggregate: xmp_api_structs.Aggregate{
+			ReportAt:     reportAt,
+			CampaignCode: code,
+			OperatorCode: operatorCode,
+		}}
+	}
+	res := []Aggregate{agg(2, "a", 1), agg(1, "b", 1), agg(1, "a", 2), agg(1, "a", 1)}
+	sortAggregates(res)
+	assert.Equal(t, []Aggregate{agg(1, "a", 1), agg(1, "a", 2), agg(1, "b", 1), agg(2, "a", 1)}, res)
+
+	assert.Equal(t, res, pageAggregates(res, 0, 0), "all rows")
+	assert.Equal(t, res[1:3], pageAggregates(res, 2, 1))
+	assert.Equal(t, res[3:], pageAggregates(res, 10, 3))
+	assert.Equal(t, 0, len(pageAggregates(res, 1, 10)), "offset after the end")
+}
@@ -0,0 +1,265 @@
+package service
+
+// caps of campaigns: hits per minute, mo and spend per day,
+// per campaign (operator code 0) and per campaign and operator
+// days are in the time zone of the country
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	m "github.com/linkit360/go-utils/metrics"
+)
+
+const (
+	CapHitsPerMinute = "hits_per_minute"
+	CapMOPerDay      = "mo_per_day"
+	CapSpendPerDay   = "spend_per_day"
+)
+
+type CampaignCaps struct {
+	sync.Mutex
+	loc    *time.Location
+	capped m.Gauge
+	ByKey  map[string]CampaignCap
+	day    string // current day in the country
+	minute int64  // current unix minute
+	hits   map[string]int64
+	mo     map[string]int64
+	spend  map[string]int64 // cents
+}
+
+// zero - no limit
+type CampaignCap struct {
+	CampaignId    string `json:"id_campaign"`
+	OperatorCode  int64  `json:"operator_code"` // 0 - all operators of the campaign
+	HitsPerMinute int64  `json:"hits_per_minute"`
+	MOPerDay      int64  `json:"mo_per_day"`
+	SpendPerDay   int64  `json:"spend_per_day"` // cents
+}
+
+func capKey(campaignId string, operatorCode int64) string {
+	return fmt.Sprintf("%s-%d", campaignId, operatorCode)
+}
+
+func initCampaignCaps(appName, timeZone string) *CampaignCaps {
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"tz":    timeZone,
+			"error": err.Error(),
+		}).Fatal("wrong time zone")
+	}
+	cc := &CampaignCaps{
+		loc:    loc,
+		capped: m.NewGauge(appName, "campaign", "capped", "campaign capped"),
+		ByKey:  make(map[string]CampaignCap),
+		hits:   make(map[string]int64),
+		mo:     make(map[string]int64),
+		spend:  make(map[string]int64),
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			cc.capped.Update()
+		}
+	}()
+	return cc
+}
+
+// must be called under the lock
+func (cc *CampaignCaps) rotate(now time.Time) {
+	if minute := now.Unix() / 60; minute != cc.minute {
+		cc.minute = minute
+		cc.hits = make(map[string]int64)
+	}
+	if day := now.In(cc.loc).Format("2006-01-02"); day != cc.day {
+		if cc.day != "" {
+			log.WithFields(log.Fields{"from": cc.day, "to": day}).Info("reset campaign caps")
+		}
+		cc.day = day
+		cc.mo = make(map[string]int64)
+		cc.spend = make(map[string]int64)
+	}
+}
+
+// checks caps of the campaign and of the campaign and operator,
+// allowed hit is counted
+func (cc *CampaignCaps) Allow(campaignId string, operatorCode int64, now time.Time) (bool, string) {
+	if cc == nil {
+		return true, ""
+	}
+	cc.Lock()
+	defer cc.Unlock()
+	cc.rotate(now)
+
+	keys := []string{capKey(campaignId, 0)}
+	if operatorCode != 0 {
+		keys = append(keys, capKey(campaignId, operatorCode))
+	}
+	for _, key := range keys {
+		c, ok := cc.ByKey[key]
+		if !ok {
+			continue
+		}
+		reason := ""
+		switch {
+		case c.HitsPerMinute > 0 && cc.hits[key] >= c.HitsPerMinute:
+			reason = CapHitsPerMinute
+		case c.MOPerDay > 0 && cc.mo[key] >= c.MOPerDay:
+			reason = CapMOPerDay
+		case c.SpendPerDay > 0 && cc.spend[key] >= c.SpendPerDay:
+			reason = CapSpendPerDay
+		}
+		if reason != "" {
+			cc.capped.Inc()
+			log.WithFields(log.Fields{
+				"id":       campaignId,
+				"operator": c.OperatorCode,
+				"reason":   reason,
+			}).Debug("capped")
+			return false, reason
+		}
+	}
+	for _, key := range keys {
+		cc.hits[key]++
+	}
+	return true, ""
+}
+
+// fed by the reporter
+func (cc *CampaignCaps) Transaction(campaignId string, operatorCode int64, mo bool, spendCents int, at time.Time) {
+	if cc == nil {
+		return
+	}
+	var moCount int64
+	if mo {
+		moCount = 1
+	}
+	cc.Lock()
+	defer cc.Unlock()
+	// late events of the previous days are not counted on the current day
+	day := at.In(cc.loc).Format("2006-01-02")
+	if day < cc.day {
+		return
+	}
+	if day > cc.day {
+		cc.rotate(at)
+	}
+	cc.add(campaignId, operatorCode, moCount, int64(spendCents))
+}
+
+// must be called under the lock
+func (cc *CampaignCaps) add(campaignId string, operatorCode int64, mo, spendCents int64) {
+	for _, key := range []string{capKey(campaignId, 0), capKey(campaignId, operatorCode)} {
+		cc.mo[key] += mo
+		cc.spend[key] += spendCents
+		if operatorCode == 0 {
+			break
+		}
+	}
+}
+
+// mo and spend of the current day are loaded from transactions on start, so a restart doesn't reset caps,
+// transactions which are still in the reporter queue are counted again: the cap is reached earlier, not later
+func (cc *CampaignCaps) loadDay(results transactionResults, now time.Time) error {
+	if cc == nil {
+		return nil
+	}
+	local := now.In(cc.loc)
+	dayStart := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, cc.loc)
+	query := fmt.Sprintf("SELECT "+
+		"id_campaign, "+
+		"operator_code, "+
+		"result, "+
+		"COALESCE(attempts_count, 0) > 0 retried, "+
+		"sum(price), "+
+		"count(*) "+
+		"FROM %stransactions "+
+		"WHERE sent_at >= ($1::timestamptz AT TIME ZONE 'UTC') "+
+		"GROUP BY id_campaign, operator_code, result, retried",
+		Svc.dbConf.TablePrefix)
+	rows, err := Svc.db.Query(query, dayStart.UTC())
+	if err != nil {
+		return fmt.Errorf("db.Query: %s, query: %s", err.Error(), query)
+	}
+	defer rows.Close()
+
+	cc.Lock()
+	defer cc.Unlock()
+	cc.rotate(now)
+	count := 0
+	for rows.Next() {
+		var campaignId, result string
+		var retried bool
+		var operatorCode, sum, transactions int64
+		if err := rows.Scan(&campaignId, &operatorCode, &result, &retried, &sum, &transactions); err != nil {
+			return fmt.Errorf("rows.Scan: %s", err.Error())
+		}
+		result = results.key(result, attemptsOf(retried))
+		var mo, spend int64
+		if results.mo(result) {
+			mo = transactions
+		}
+		if success, _ := results.charge(result); success {
+			spend = int64(toCents(int(sum), Svc.conf.PriceUnit))
+		}
+		cc.add(campaignId, operatorCode, mo, spend)
+		count++
+	}
+	if rows.Err() != nil {
+		return fmt.Errorf("rows.Err: %s", rows.Err().Error())
+	}
+	log.WithFields(log.Fields{
+		"day":  cc.day,
+		"rows": count,
+	}).Info("campaign caps counters loaded")
+	return nil
+}
+
+func (cc *CampaignCaps) Reload() error {
+	query := fmt.Sprintf("SELECT "+
+		"id_campaign, "+
+		"operator_code, "+
+		"hits_per_minute, "+
+		"mo_per_day, "+
+		"spend_per_day "+
+		"FROM %scampaign_caps",
+		Svc.dbConf.TablePrefix)
+	var err error
+	var rows *sql.Rows
+	rows, err = Svc.db.Query(query)
+	if err != nil {
+		err = fmt.Errorf("db.Query: %s, query: %s", err.Error(), query)
+		return err
+	}
+	defer rows.Close()
+
+	byKey := make(map[string]CampaignCap)
+	for rows.Next() {
+		var c CampaignCap
+		if err = rows.Scan(
+			&c.CampaignId,
+			&c.OperatorCode,
+			&c.HitsPerMinute,
+			&c.MOPerDay,
+			&c.SpendPerDay,
+		); err != nil {
+			err = fmt.Errorf("rows.Scan: %s", err.Error())
+			return err
+		}
+		byKey[capKey(c.CampaignId, c.OperatorCode)] = c
+	}
+	if rows.Err() != nil {
+		err = fmt.Errorf("rows.Err: %s", rows.Err().Error())
+		return err
+	}
+
+	cc.Lock()
+	cc.ByKey = byKey
+	cc.Unlock()
+	log.WithField("count", len(byKey)).Debug("campaign caps")
+	return nil
+}
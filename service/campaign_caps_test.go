@@ -0,0 +1,122 @@
+package service
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCampaignCaps(t *testing.T) {
+	cc := initCampaignCaps("test", "Asia/Bangkok")
+	cc.ByKey = map[string]CampaignCap{
+		capKey(testCampaignUUID, 0):                {CampaignId: testCampaignUUID, HitsPerMinute: 2, MOPerDay: 3},
+		capKey(testCampaignUUID, testOperatorCode): {CampaignId: testCampaignUUID, OperatorCode: testOperatorCode, SpendPerDay: 1000},
+	}
+	loc, _ := time.LoadLocation("Asia/Bangkok")
+	now := time.Date(2017, 6, 5, 23, 0, 10, 0, loc)
+
+	allowed, _ := cc.Allow("unknown", testOperatorCode, now)
+	assert.True(t, allowed, "no caps")
+
+	for i := 0; i < 2; i++ {
+		allowed, _ = cc.Allow(testCampaignUUID, testOperatorCode, now)
+		assert.True(t, allowed, "hits under the cap")
+	}
+	allowed, reason := cc.Allow(testCampaignUUID, 41002, now)
+	assert.False(t, allowed, "hits of all operators are counted")
+	assert.Equal(t, CapHitsPerMinute, reason)
+
+	now = now.Add(time.Minute)
+	allowed, _ = cc.Allow(testCampaignUUID, testOperatorCode, now)
+	assert.True(t, allowed, "next minute")
+
+	cc.Transaction(testCampaignUUID, testOperatorCode, true, 1000, now)
+	allowed, reason = cc.Allow(testCampaignUUID, testOperatorCode, now)
+	assert.False(t, allowed, "spend of the operator")
+	assert.Equal(t, CapSpendPerDay, reason)
+	allowed, _ = cc.Allow(testCampaignUUID, 41002, now)
+	assert.True(t, allowed, "other operator has no spend cap")
+
+	cc.Transaction(testCampaignUUID, 41002, true, 0, now)
+	cc.Transaction(testCampaignUUID, 41002, true, 0, now)
+	now = now.Add(time.Minute)
+	allowed, reason = cc.Allow(testCampaignUUID, 41002, now)
+	assert.False(t, allowed, "mo of the campaign")
+	assert.Equal(t, CapMOPerDay, reason)
+
+	// 2017-06-06 00:00 in Bangkok, still 2017-06-05 in UTC
+	now = time.Date(2017, 6, 6, 0, 0, 10, 0, loc)
+	allowed, _ = cc.Allow(testCampaignUUID, testOperatorCode, now)
+	assert.True(t, allowed, "reset on the day of the country")
+	cc.Transaction(testCampaignUUID, 41002, true, 0, now.Add(-time.Hour))
+	cc.Lock()
+	lateMO := cc.mo[capKey(testCampaignUUID, 0)]
+	cc.Unlock()
+	assert.Equal(t, int64(0), lateMO, "late transaction of the previous day")
+
+	// fed by the reporter
+	Svc.CampaignCaps = cc
+	defer func() { Svc.CampaignCaps = nil }()
+	as := newTestCollector(t)
+	as.incTransaction(testCollect("paid", 600))
+	as.incTransaction(testCollect("failed", 600))
+	as.incTransaction(testCollect("retry_paid", 600))
+
+	cc.Lock()
+	mo, spend := cc.mo[capKey(testCampaignUUID, testOperatorCode)], cc.spend[capKey(testCampaignUUID, testOperatorCode)]
+	cc.Unlock()
+	assert.Equal(t, int64(2), mo, "mo from transactions")
+	assert.Equal(t, int64(1200), spend, "spend of charged transactions")
+}
+
+// needs postgres, see TestReporterGetAggregate
+func TestCampaignCapsLoadDay(t *testing.T) {
+	dsn := os.Getenv("MID_TEST_DB")
+	if dsn == "" {
+		t.Skip("MID_TEST_DB is not set")
+	}
+	testDB, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("sql.Open: %s", err.Error())
+	}
+	defer testDB.Close()
+	testDB.SetMaxOpenConns(1)
+
+	db, tablePrefix := Svc.db, Svc.dbConf.TablePrefix
+	defer func() {
+		Svc.db, Svc.dbConf.TablePrefix = db, tablePrefix
+	}()
+	Svc.db = testDB
+	Svc.dbConf.TablePrefix = "mid_test_"
+
+	loc, _ := time.LoadLocation("Asia/Bangkok")
+	now := time.Date(2017, 6, 5, 12, 0, 0, 0, loc)
+	for _, query := range []string{
+		"CREATE TEMP TABLE mid_test_transactions (" +
+			"sent_at timestamp, id_campaign varchar, operator_code int, result varchar, price int, attempts_count int)",
+		// 2017-06-04 17:00 UTC is 00:00 of 2017-06-05 in Bangkok
+		"INSERT INTO mid_test_transactions VALUES " +
+			"('2017-06-04 16:59:00', '" + testCampaignUUID + "', 41001, 'paid', 1000, 0), " +
+			"('2017-06-04 17:00:00', '" + testCampaignUUID + "', 41001, 'paid', 1000, 0), " +
+			"('2017-06-05 01:00:00', '" + testCampaignUUID + "', 41001, 'failed', 1000, 0), " +
+			// paid after attempts is a renewal, not an mo
+			"('2017-06-05 02:00:00', '" + testCampaignUUID + "', 41002, 'paid', 500, 1)",
+	} {
+		if _, err := testDB.Exec(query); err != nil {
+			t.Fatalf("db.Exec: %s, query: %s", err.Error(), query)
+		}
+	}
+
+	results, err := newTransactionResults(TransactionResultsConfig{})
+	assert.NoError(t, err)
+	cc := initCampaignCaps("test", "Asia/Bangkok")
+	assert.NoError(t, cc.loadDay(results, now))
+
+	assert.Equal(t, int64(2), cc.mo[capKey(testCampaignUUID, 0)], "mo of the day in the country")
+	assert.Equal(t, int64(1500), cc.spend[capKey(testCampaignUUID, 0)], "charged only")
+	assert.Equal(t, int64(1000), cc.spend[capKey(testCampaignUUID, 41001)])
+	assert.Equal(t, int64(500), cc.spend[capKey(testCampaignUUID, 41002)])
+}
@@ -0,0 +1,224 @@
+package service
+
+// routing of the traffic of a service across its campaigns:
+// rules by operator, publisher and country, zero or empty matches all,
+// the most specific matching rules win, one of them is chosen by weight
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	m "github.com/linkit360/go-utils/metrics"
+)
+
+type CampaignRoutes struct {
+	sync.RWMutex
+	rand          *rand.Rand
+	unrouted      m.Gauge
+	ByServiceCode map[string][]CampaignRoute
+}
+
+type CampaignRoute struct {
+	Id           int64  `json:"id"`
+	ServiceCode  string `json:"service_code"`
+	OperatorCode int64  `json:"operator_code"` // 0 - any
+	Publisher    string `json:"publisher"`     // name of the publisher, empty - any
+	CountryCode  int64  `json:"country_code"`  // 0 - any
+	CampaignId   string `json:"id_campaign"`
+	Weight       int64  `json:"weight"` // 0 - the rule is off
+}
+
+// publisher is detected by the source if it is not known
+type RouteRequest struct {
+	ServiceCode  string `json:"service_code,omitempty"`
+	OperatorCode int64  `json:"operator_code,omitempty"`
+	CountryCode  int64  `json:"country_code,omitempty"`
+	Publisher    string `json:"publisher,omitempty"`
+	Source       string `json:"source,omitempty"` // url or parameters of the hit
+}
+
+func initCampaignRoutes(appName string) *CampaignRoutes {
+	cr := &CampaignRoutes{
+		rand:          rand.New(rand.NewSource(time.Now().UnixNano())),
+		unrouted:      m.NewGauge(appName, "campaign", "unrouted", "no routing rule, first campaign of the service"),
+		ByServiceCode: make(map[string][]CampaignRoute),
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			cr.unrouted.Update()
+		}
+	}()
+	return cr
+}
+
+// number of the set criteria, -1 if the rule does not match
+func (r CampaignRoute) specificity(req RouteRequest) int {
+	n := 0
+	for _, c := range []struct {
+		set, match bool
+	}{
+		{r.OperatorCode != 0, r.OperatorCode == req.OperatorCode},
+		{r.Publisher != "", r.Publisher == req.Publisher},
+		{r.CountryCode != 0, r.CountryCode == req.CountryCode},
+	} {
+		if !c.set {
+			continue
+		}
+		if !c.match {
+			return -1
+		}
+		n++
+	}
+	return n
+}
+
+// the most specific matching rules, available is false for rules with unknown or inactive campaigns
+func matchRoutes(routes []CampaignRoute, req RouteRequest, available func(CampaignRoute) bool) []CampaignRoute {
+	best := 0
+	var matched []CampaignRoute
+	for _, r := range routes {
+		if r.Weight <= 0 {
+			continue
+		}
+		n := r.specificity(req)
+		if n < 0 || n < best || !available(r) {
+			continue
+		}
+		if n > best {
+			best = n
+			matched = nil
+		}
+		matched = append(matched, r)
+	}
+	return matched
+}
+
+// n is in [0, sum of weights)
+func pickRoute(routes []CampaignRoute, n int64) CampaignRoute {
+	for _, r := range routes {
+		if n < r.Weight {
+			return r
+		}
+		n -= r.Weight
+	}
+	return routes[len(routes)-1]
+}
+
+// the first active campaign of the service, campaigns are sorted by id,
+// the first one is returned with ErrCampaignInactive if none is active
+func firstScheduled(camps []Campaign) (Campaign, error) {
+	for _, c := range camps {
+		if c, err := c.scheduled(); err == nil {
+			return c, nil
+		}
+	}
+	return camps[0].scheduled()
+}
+
+func (cr *CampaignRoutes) Route(req RouteRequest) (camp Campaign, route CampaignRoute, err error) {
+	if req.Publisher == "" && req.Source != "" {
+		req.Publisher = Svc.Publishers.Detect(req.Source).Publisher
+	}
+	req.Publisher = strings.ToLower(req.Publisher)
+
+	cr.RLock()
+	routes := cr.ByServiceCode[req.ServiceCode]
+	cr.RUnlock()
+
+	found := make(map[string]Campaign)
+	matched := matchRoutes(routes, req, func(r CampaignRoute) bool {
+		c, err := Svc.Campaigns.GetByUUID(r.CampaignId)
+		if err != nil {
+			return false
+		}
+		if c, err = c.scheduled(); err != nil {
+			return false
+		}
+		found[r.CampaignId] = c
+		return true
+	})
+	if len(matched) == 0 {
+		cr.unrouted.Inc()
+		camps, err := Svc.Campaigns.GetByServiceCode(req.ServiceCode)
+		if err != nil {
+			return camp, route, err
+		}
+		camp, err = firstScheduled(camps)
+		return camp, route, err
+	}
+
+	var total int64
+	for _, r := range matched {
+		total += r.Weight
+	}
+	cr.Lock()
+	n := cr.rand.Int63n(total)
+	cr.Unlock()
+	route = pickRoute(matched, n)
+
+	log.WithFields(log.Fields{
+		"service":   req.ServiceCode,
+		"operator":  req.OperatorCode,
+		"country":   req.CountryCode,
+		"publisher": req.Publisher,
+		"route":     route.Id,
+		"id":        route.CampaignId,
+	}).Debug("route")
+	return found[route.CampaignId], route, nil
+}
+
+func (cr *CampaignRoutes) Reload() error {
+	query := fmt.Sprintf("SELECT "+
+		"id, "+
+		"service_code, "+
+		"operator_code, "+
+		"publisher, "+
+		"country_code, "+
+		"id_campaign, "+
+		"weight "+
+		"FROM %scampaign_routes "+
+		"ORDER BY id",
+		Svc.dbConf.TablePrefix)
+	var err error
+	var rows *sql.Rows
+	rows, err = Svc.db.Query(query)
+	if err != nil {
+		err = fmt.Errorf("db.Query: %s, query: %s", err.Error(), query)
+		return err
+	}
+	defer rows.Close()
+
+	byServiceCode := make(map[string][]CampaignRoute)
+	for rows.Next() {
+		var r CampaignRoute
+		if err = rows.Scan(
+			&r.Id,
+			&r.ServiceCode,
+			&r.OperatorCode,
+			&r.Publisher,
+			&r.CountryCode,
+			&r.CampaignId,
+			&r.Weight,
+		); err != nil {
+			err = fmt.Errorf("rows.Scan: %s", err.Error())
+			return err
+		}
+		r.Publisher = strings.ToLower(r.Publisher)
+		byServiceCode[r.ServiceCode] = append(byServiceCode[r.ServiceCode], r)
+	}
+	if rows.Err() != nil {
+		err = fmt.Errorf("rows.Err: %s", rows.Err().Error())
+		return err
+	}
+
+	cr.Lock()
+	cr.ByServiceCode = byServiceCode
+	cr.Unlock()
+	log.WithField("count", len(byServiceCode)).Debug("campaign routes")
+	return nil
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCampaignRoutesMatch(t *testing.T) {
+	routes := []CampaignRoute{
+		{Id: 1, CampaignId: "default", Weight: 1},
+		{Id: 2, OperatorCode: 52001, CampaignId: "op", Weight: 1},
+		{Id: 3, OperatorCode: 52001, Publisher: "kimia", CampaignId: "op-kimia-a", Weight: 1},
+		{Id: 4, OperatorCode: 52001, Publisher: "kimia", CampaignId: "op-kimia-b", Weight: 3},
+		{Id: 5, CountryCode: 66, Publisher: "mobusi", CampaignId: "off", Weight: 0},
+	}
+	all := func(CampaignRoute) bool { return true }
+	ids := func(rr []CampaignRoute) (res []int64) {
+		for _, r := range rr {
+			res = append(res, r.Id)
+		}
+		return
+	}
+
+	assert.Equal(t, []int64{1}, ids(matchRoutes(routes, RouteRequest{OperatorCode: 52000}, all)), "any operator")
+	assert.Equal(t, []int64{2}, ids(matchRoutes(routes, RouteRequest{OperatorCode: 52001}, all)), "operator")
+	assert.Equal(t, []int64{3, 4}, ids(matchRoutes(routes,
+		RouteRequest{OperatorCode: 52001, Publisher: "kimia"}, all)), "operator and publisher")
+	assert.Equal(t, []int64{1}, ids(matchRoutes(routes,
+		RouteRequest{CountryCode: 66, Publisher: "mobusi"}, all)), "rule with zero weight is off")
+
+	available := func(r CampaignRoute) bool { return r.CampaignId != "op-kimia-a" && r.CampaignId != "op-kimia-b" }
+	assert.Equal(t, []int64{2}, ids(matchRoutes(routes,
+		RouteRequest{OperatorCode: 52001, Publisher: "kimia"}, available)), "campaigns are not available")
+}
+
+func TestCampaignRoutesPick(t *testing.T) {
+	routes := []CampaignRoute{
+		{Id: 3, Weight: 1},
+		{Id: 4, Weight: 3},
+	}
+	assert.Equal(t, int64(3), pickRoute(routes, 0).Id)
+	for _, n := range []int64{1, 2, 3} {
+		assert.Equal(t, int64(4), pickRoute(routes, n).Id, "by weight")
+	}
+}
+
+func TestCampaignRoutesFallback(t *testing.T) {
+	schedules := Svc.CampaignSchedules
+	defer func() { Svc.CampaignSchedules = schedules }()
+	Svc.CampaignSchedules = initCampaignSchedules("UTC")
+	ended := []CampaignSchedule{{EndAt: time.Now().Add(-time.Hour)}}
+	Svc.CampaignSchedules.ByCampaign = map[string][]CampaignSchedule{"a": ended}
+
+	byServiceCode := campaignsByServiceCode(map[string]Campaign{
+		"c": {Id: "c", ServiceCode: "777"},
+		"a": {Id: "a", ServiceCode: "777"},
+		"b": {Id: "b", ServiceCode: "777"},
+	})
+	camp, err := firstScheduled(byServiceCode["777"])
+	assert.NoError(t, err)
+	assert.Equal(t, "b", camp.Id, "first active campaign by id")
+
+	Svc.CampaignSchedules.ByCampaign["b"] = ended
+	Svc.CampaignSchedules.ByCampaign["c"] = ended
+	camp, err = firstScheduled(byServiceCode["777"])
+	assert.Equal(t, ErrCampaignInactive, err)
+	assert.Equal(t, "a", camp.Id, "first campaign if none is active")
+	assert.True(t, camp.Inactive)
+}
@@ -0,0 +1,193 @@
+package service
+
+// activation windows of campaigns: start/end datetime, days of week and hours
+// days and hours are in the time zone of the country
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrCampaignInactive = errors.New("Campaign inactive")
+
+type CampaignSchedules struct {
+	sync.RWMutex
+	loc        *time.Location
+	ByCampaign map[string][]CampaignSchedule
+}
+
+// campaign without windows is always active, with windows - if any of them matches
+type CampaignSchedule struct {
+	CampaignId string    `json:"id_campaign"`
+	StartAt    time.Time `json:"start_at,omitempty"` // zero - no start
+	EndAt      time.Time `json:"end_at,omitempty"`   // zero - no end
+	Days       []int     `json:"days,omitempty"`     // 1 - monday .. 7 - sunday, empty - every day
+	HourFrom   int       `json:"hour_from"`          // hour_from == hour_to - all day
+	HourTo     int       `json:"hour_to"`            // hour_from > hour_to - over midnight, 22-6
+}
+
+func initCampaignSchedules(timeZone string) *CampaignSchedules {
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"tz":    timeZone,
+			"error": err.Error(),
+		}).Fatal("wrong time zone")
+	}
+	return &CampaignSchedules{loc: loc}
+}
+
+func (cs CampaignSchedule) active(t time.Time) bool {
+	if !cs.StartAt.IsZero() && t.Before(cs.StartAt) {
+		return false
+	}
+	if !cs.EndAt.IsZero() && !t.Before(cs.EndAt) {
+		return false
+	}
+	if len(cs.Days) > 0 {
+		weekDay := int(t.Weekday())
+		if weekDay == 0 {
+			weekDay = 7
+		}
+		found := false
+		for _, day := range cs.Days {
+			if day == weekDay {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	hour := t.Hour()
+	switch {
+	case cs.HourFrom == cs.HourTo:
+		return true
+	case cs.HourFrom < cs.HourTo:
+		return hour >= cs.HourFrom && hour < cs.HourTo
+	default:
+		return hour >= cs.HourFrom || hour < cs.HourTo
+	}
+}
+
+func (s *CampaignSchedules) Active(campaignId string, t time.Time) bool {
+	if s == nil {
+		return true
+	}
+	s.RLock()
+	defer s.RUnlock()
+	schedules, ok := s.ByCampaign[campaignId]
+	if !ok || len(schedules) == 0 {
+		return true
+	}
+	t = t.In(s.loc)
+	for _, cs := range schedules {
+		if cs.active(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// "1,2,3,4,5" - working days
+func parseScheduleDays(days string) ([]int, error) {
+	var res []int
+	for _, day := range strings.Split(days, ",") {
+		day = strings.TrimSpace(day)
+		if day == "" {
+			continue
+		}
+		n, err := strconv.Atoi(day)
+		if err != nil || n < 1 || n > 7 {
+			return nil, fmt.Errorf("wrong day of week: %s", day)
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+func (s *CampaignSchedules) Reload() error {
+	query := fmt.Sprintf("SELECT "+
+		"id_campaign, "+
+		"start_at::text, "+
+		"end_at::text, "+
+		"days_of_week, "+
+		"hour_from, "+
+		"hour_to "+
+		"FROM %scampaign_schedules",
+		Svc.dbConf.TablePrefix)
+	var err error
+	var rows *sql.Rows
+	rows, err = Svc.db.Query(query)
+	if err != nil {
+		err = fmt.Errorf("db.Query: %s, query: %s", err.Error(), query)
+		return err
+	}
+	defer rows.Close()
+
+	var schedules []CampaignSchedule
+	for rows.Next() {
+		var cs CampaignSchedule
+		var startAt, endAt sql.NullString
+		var days string
+		if err = rows.Scan(
+			&cs.CampaignId,
+			&startAt,
+			&endAt,
+			&days,
+			&cs.HourFrom,
+			&cs.HourTo,
+		); err != nil {
+			err = fmt.Errorf("rows.Scan: %s", err.Error())
+			return err
+		}
+		// start and end are local time of the country, as in the control panel
+		if startAt.Valid {
+			if cs.StartAt, err = parseScheduleTime(startAt.String, s.loc); err != nil {
+				return fmt.Errorf("campaign %s: start_at: %s", cs.CampaignId, err.Error())
+			}
+		}
+		if endAt.Valid {
+			if cs.EndAt, err = parseScheduleTime(endAt.String, s.loc); err != nil {
+				return fmt.Errorf("campaign %s: end_at: %s", cs.CampaignId, err.Error())
+			}
+		}
+		if cs.Days, err = parseScheduleDays(days); err != nil {
+			return fmt.Errorf("campaign %s: %s", cs.CampaignId, err.Error())
+		}
+		if cs.HourFrom < 0 || cs.HourFrom > 23 || cs.HourTo < 0 || cs.HourTo > 23 {
+			return fmt.Errorf("campaign %s: wrong hours %d-%d", cs.CampaignId, cs.HourFrom, cs.HourTo)
+		}
+		schedules = append(schedules, cs)
+	}
+	if rows.Err() != nil {
+		err = fmt.Errorf("rows.Err: %s", rows.Err().Error())
+		return err
+	}
+
+	byCampaign := make(map[string][]CampaignSchedule)
+	for _, cs := range schedules {
+		byCampaign[cs.CampaignId] = append(byCampaign[cs.CampaignId], cs)
+	}
+	s.Lock()
+	s.ByCampaign = byCampaign
+	s.Unlock()
+	log.WithField("count", len(schedules)).Debug("campaign schedules")
+	return nil
+}
+
+func parseScheduleTime(value string, loc *time.Location) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse time: %s", value)
+}
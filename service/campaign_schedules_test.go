@@ -0,0 +1,71 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCampaignScheduleActive(t *testing.T) {
+	loc, _ := time.LoadLocation("Asia/Bangkok")
+	at := func(day, hour int) time.Time {
+		// 2017-06-05 is monday
+		return time.Date(2017, 6, day, hour, 30, 0, 0, loc)
+	}
+
+	allDay := CampaignSchedule{}
+	assert.True(t, allDay.active(at(5, 3)), "no restrictions")
+
+	working := CampaignSchedule{Days: []int{1, 2, 3, 4, 5}, HourFrom: 8, HourTo: 22}
+	assert.True(t, working.active(at(5, 8)), "monday morning")
+	assert.False(t, working.active(at(5, 22)), "monday night")
+	assert.False(t, working.active(at(5, 7)), "monday early morning")
+	assert.False(t, working.active(at(10, 12)), "saturday")
+	assert.False(t, working.active(at(11, 12)), "sunday")
+
+	night := CampaignSchedule{Days: []int{7}, HourFrom: 22, HourTo: 6}
+	assert.True(t, night.active(at(11, 23)), "sunday night")
+	assert.True(t, night.active(at(11, 2)), "sunday after midnight")
+	assert.False(t, night.active(at(11, 12)), "sunday noon")
+
+	period := CampaignSchedule{
+		StartAt: time.Date(2017, 6, 5, 0, 0, 0, 0, loc),
+		EndAt:   time.Date(2017, 6, 7, 0, 0, 0, 0, loc),
+	}
+	assert.False(t, period.active(at(4, 23)), "before start")
+	assert.True(t, period.active(at(5, 0)), "started")
+	assert.True(t, period.active(at(6, 23)), "before end")
+	assert.False(t, period.active(at(7, 0)), "ended")
+}
+
+func TestCampaignSchedulesActive(t *testing.T) {
+	var empty *CampaignSchedules
+	assert.True(t, empty.Active("any", time.Now()), "schedules are disabled")
+
+	s := initCampaignSchedules("Asia/Bangkok")
+	s.ByCampaign = map[string][]CampaignSchedule{
+		"night": {
+			{HourFrom: 0, HourTo: 6},
+			{HourFrom: 22, HourTo: 0},
+		},
+	}
+	assert.True(t, s.Active("no schedule", time.Now()), "campaign without schedule")
+
+	// 16:00 UTC is 23:00 in Bangkok
+	assert.True(t, s.Active("night", time.Date(2017, 6, 5, 16, 0, 0, 0, time.UTC)), "any window matches")
+	assert.False(t, s.Active("night", time.Date(2017, 6, 5, 5, 0, 0, 0, time.UTC)), "country noon")
+}
+
+func TestParseScheduleDays(t *testing.T) {
+	days, err := parseScheduleDays("1, 2,3,,7")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3, 7}, days)
+
+	days, err = parseScheduleDays("")
+	assert.NoError(t, err)
+	assert.Nil(t, days, "every day")
+
+	_, err = parseScheduleDays("0,8")
+	assert.Error(t, err, "wrong day")
+}
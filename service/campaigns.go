@@ -4,14 +4,12 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"os"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/mholt/archiver"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 
@@ -24,12 +22,18 @@ type Campaigns interface {
 	Apply(campaigns map[string]xmp_api_structs.Campaign)
 	Update(xmp_api_structs.Campaign) error
 	Download(c xmp_api_structs.Campaign) (err error)
+	DownloadVariant(LandingVariant) error
+	VariantDeployed(LandingVariant) bool
+	DownloadVariants([]LandingVariant, func(LandingVariant))
+	LandingVersions(id string) (string, []string, error)
+	RollbackLanding(id string) (string, error)
 	Reload() error
 	GetAll() map[string]Campaign
 	GetByLink(string) (Campaign, error)
 	GetByUUID(string) (Campaign, error)
 	GetByHash(string) (Campaign, error)
 	GetByServiceCode(string) ([]Campaign, error)
+	ByUUIDAt(string, time.Time) (Campaign, error)
 	GetJson() string
 	ShowLoaded()
 }
@@ -40,11 +44,17 @@ type CampaignsConfig struct {
 	LandingsPath     string `yaml:"landing_path"`
 	LandingsReload   bool   `yaml:"landing_reload"` // remove old downloaded lp-s and get new
 	Bucket           string `yaml:"bucket" default:"xmp-lp"`
+	LandingVersions  int    `yaml:"landing_versions" default:"3"`        // kept for rollback
+	LandingMaxSize   int64  `yaml:"landing_max_size" default:"52428800"` // of unzipped landing, bytes
+	VerifyInterval   int    `yaml:"verify_interval" default:"600"`       // seconds, landing files are checked with manifests, 0 - never
+	ApplyWorkers     int    `yaml:"apply_workers" default:"10"`          // campaigns prepared at once on reload
 }
 
 type Campaign struct {
-	AutoClickCount int64 `json:"-"`
-	CanAutoClick   bool  `json:"-"`
+	AutoClickCount int64            `json:"-"`
+	CanAutoClick   bool             `json:"-"`
+	Inactive       bool             `json:"inactive,omitempty"` // outside of the schedule
+	Variants       []LandingVariant `json:"variants,omitempty"`
 	xmp_api_structs.Campaign
 }
 
@@ -54,7 +64,7 @@ func (camp *Campaign) Load(ac xmp_api_structs.Campaign) {
 	return
 }
 func (camp *Campaign) SimpleServe(c *gin.Context, data interface{}) {
-	camp.incRatio()
+	camp.NextAutoClick()
 	log.WithFields(log.Fields{
 		"count":             camp.AutoClickCount,
 		"ratio":             camp.AutoClickRatio,
@@ -66,18 +76,31 @@ func (camp *Campaign) SimpleServe(c *gin.Context, data interface{}) {
 	c.Writer.Header().Set("Content-Type", "text/html; charset-utf-8")
 	c.HTML(http.StatusOK, camp.Hash+".html", data)
 }
-func (camp *Campaign) incRatio() {
+
+// set by rpcclient: campaigns which are served outside of mid use the counters of mid
+var RemoteAutoClick func(campaignId string) (bool, int64, error)
+
+// every AutoClickRatio-th call of the campaign is autoclicked,
+// the counter is shared by all copies of the campaign
+func (camp *Campaign) NextAutoClick() bool {
 	if !camp.AutoClickEnabled {
 		camp.CanAutoClick = false
-		return
+		return false
 	}
-	camp.AutoClickCount = camp.AutoClickCount + 1
-	if camp.AutoClickCount == camp.AutoClickRatio {
-		camp.AutoClickCount = 0
-		camp.CanAutoClick = true
-	} else {
-		camp.CanAutoClick = false
+	if Svc.RatioCounters == nil && RemoteAutoClick != nil {
+		var err error
+		camp.CanAutoClick, camp.AutoClickCount, err = RemoteAutoClick(camp.Id)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"id":    camp.Id,
+				"error": err.Error(),
+			}).Error("cannot get autoclick")
+			camp.CanAutoClick = false
+		}
+		return camp.CanAutoClick
 	}
+	camp.CanAutoClick, camp.AutoClickCount = Svc.RatioCounters.Next("autoclick:"+camp.Id, camp.AutoClickRatio)
+	return camp.CanAutoClick
 }
 
 type сampaigns struct {
@@ -86,6 +109,8 @@ type сampaigns struct {
 	loadError       prometheus.Gauge
 	awsSessionError prometheus.Gauge
 	notFound        m.Gauge
+	landingMismatch m.Gauge
+	landings        *landingStore
 	ByUUID          map[string]Campaign
 	ByHash          map[string]Campaign
 	ByLink          map[string]Campaign
@@ -98,12 +123,18 @@ func initCampaigns(appName string, campConfig CampaignsConfig) Campaigns {
 		loadError:       m.PrometheusGauge(appName, "campaigns_load", "error", "load campaigns error"),
 		awsSessionError: m.PrometheusGauge(appName, "campaigns_aws_session", "error", "aws session campaigns error"),
 		notFound:        m.NewGauge(appName, "campaign", "not_found", "campaign not found error"),
+		landingMismatch: m.NewGauge(appName, "campaign", "landing_mismatch", "landing files are missing or changed"),
+		landings:        newLandingStore(campConfig),
 	}
 	go func() {
 		for range time.Tick(time.Minute) {
 			campaigns.notFound.Update()
+			campaigns.landingMismatch.Update()
 		}
 	}()
+	if campConfig.VerifyInterval > 0 {
+		go campaigns.verifyLandings(time.Duration(campConfig.VerifyInterval) * time.Second)
+	}
 
 	go campaigns.catchUpdates(xmp_api_client.ChanCampaigns)
 
@@ -130,81 +161,204 @@ func (camp *сampaigns) catchUpdates(updates <-chan xmp_api_structs.Campaign) {
 // check content and download it
 // content already checked: it hasn't been downloaded yet
 func (s *сampaigns) Download(c xmp_api_structs.Campaign) (err error) {
+	return s.unpack(c.Id, c.Lp, c.Id+".html", false)
+}
+
+// landing variant is unpacked next to the campaign landing
+func (s *сampaigns) DownloadVariant(v LandingVariant) (err error) {
+	return s.unpack(v.landingId(), v.Lp, v.templateName(), false)
+}
+
+// the landing of the variant is on the disk and it is of the same object
+func (s *сampaigns) VariantDeployed(v LandingVariant) bool {
+	if s.conf.LandingsReload {
+		return false
+	}
+	mf, err := s.landings.verify(v.landingId())
+	return err == nil && mf.Key == v.Lp
+}
+
+// in the background through the download manager, done is called for every deployed variant,
+// templates are reloaded once all are downloaded
+func (s *сampaigns) DownloadVariants(variants []LandingVariant, done func(LandingVariant)) {
+	if len(variants) == 0 {
+		return
+	}
+	go func() {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		deployed := 0
+		for _, v := range variants {
+			wg.Add(1)
+			go func(v LandingVariant) {
+				defer wg.Done()
+				if err := s.DownloadVariant(v); err != nil {
+					log.WithFields(log.Fields{
+						"id":          v.Id,
+						"id_campaign": v.CampaignId,
+						"error":       err.Error(),
+					}).Error("cannot download landing variant, skip")
+					return
+				}
+				done(v)
+				mu.Lock()
+				deployed++
+				mu.Unlock()
+			}(v)
+		}
+		wg.Wait()
+		if deployed > 0 {
+			s.webHook()
+		}
+	}()
+}
 
-	unzipPath := s.conf.LandingsPath + c.Id + "/"
+// index.html of the zip is renamed to the template name
+// force - download even if the landing is ok
+func (s *сampaigns) unpack(id, lp, templateName string, force bool) (err error) {
 	log.WithFields(log.Fields{
-		"id": c.Id,
-		"lp": c.Lp,
+		"id": id,
+		"lp": lp,
 	}).Debug("campaign land check..")
 
-	should, err := Svc.downloader.ShouldDownload(unzipPath, s.conf.LandingsReload)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"id":    c.Id,
-			"error": err.Error(),
-		}).Error("campaign check failed")
-		return err
-	}
-	if !should {
-		return nil
+	// lp is the key of the object, it is changed with the landing
+	if !s.conf.LandingsReload && !force {
+		mf, err := s.landings.verify(id)
+		if err == nil && mf.Key == lp {
+			return nil
+		}
+		if err != nil && err != errLandingNotDeployed {
+			s.landingMismatch.Inc()
+			log.WithFields(log.Fields{
+				"id":    id,
+				"error": err.Error(),
+			}).Warn("landing is broken")
+		}
 	}
 
-	buff, size, err := Svc.downloader.Download(s.conf.Bucket, c.Lp)
+	etag := storeETag(Svc.downloader, s.conf.Bucket, lp)
+	buff, size, err := Svc.downloader.Download(s.conf.Bucket, lp)
 	if err != nil {
 		log.WithFields(log.Fields{
-			"id":    c.Id,
+			"id":    id,
 			"error": err.Error(),
 		}).Error("campaign download failed")
 		return err
 	}
 
-	campaignZipPath := "/tmp/" + c.Id
-	if err = ioutil.WriteFile(campaignZipPath, buff, 0644); err != nil {
+	log.WithFields(log.Fields{
+		"id":  id,
+		"len": size,
+	}).Debug("unzip...")
+
+	version, err := s.landings.deploy(id, buff, templateName, downloadedManifest(s.conf.Bucket, lp, etag, buff))
+	if err != nil {
+		err = fmt.Errorf("%s: deploy: %s", id, err.Error())
 		log.WithFields(log.Fields{
-			"id":    c.Id,
+			"id":    id,
 			"error": err.Error(),
-		}).Error("campaign save to zip failed")
+		}).Error("failed to deploy landing")
 		return err
 	}
 
 	log.WithFields(log.Fields{
-		"id":      c.Id,
-		"zippath": campaignZipPath,
-		"len":     size,
-	}).Debug("unzip...")
+		"id":      id,
+		"version": version,
+		"len":     len(buff),
+	}).Info("unpack campaign done")
+	return
+}
 
-	if err = archiver.Zip.Open(campaignZipPath, unzipPath); err != nil {
-		err = fmt.Errorf("%s: unzip: %s", c.Id, err.Error())
+// landings which are missing or changed on the disk or changed in the store are downloaded again,
+// landing which is rolled back is kept while its files and its object are the same
+func (s *сampaigns) verifyLandings(interval time.Duration) {
+	for range time.Tick(interval) {
+		var camps []xmp_api_structs.Campaign
+		s.RLock()
+		if s.conf.FromControlPanel {
+			for _, c := range s.ByUUID {
+				camps = append(camps, c.Campaign)
+			}
+		}
+		s.RUnlock()
+		downloaded := false
+		for _, c := range camps {
+			downloaded = s.verifyLanding(c.Id, c.Lp, c.Id+".html") || downloaded
+		}
 
-		log.WithFields(log.Fields{
-			"id":    c.Id,
-			"error": err.Error(),
-		}).Error("failed to unzip object")
-		return
+		var variants []LandingVariant
+		Svc.LandingVariants.RLock()
+		for _, vv := range Svc.LandingVariants.ByCampaign {
+			variants = append(variants, vv...)
+		}
+		Svc.LandingVariants.RUnlock()
+		for _, v := range variants {
+			downloaded = s.verifyLanding(v.landingId(), v.Lp, v.templateName()) || downloaded
+		}
+		if downloaded {
+			s.webHook()
+		}
 	}
+}
 
-	fromPath := unzipPath + "index.html"
-	toPath := unzipPath + c.Id + ".html"
-	if err := os.Rename(fromPath, toPath); err != nil {
-		err = fmt.Errorf("os.Rename: %s", err.Error())
+// true if the landing is downloaded again
+func (s *сampaigns) verifyLanding(id, lp, templateName string) bool {
+	mf, err := s.landings.verify(id)
+	if err == nil {
+		if !mf.changed(Svc.downloader) {
+			return false
+		}
+		// the same object of the rolled back version
+		lp = mf.Key
 		log.WithFields(log.Fields{
-			"id":       c.Id,
-			"fromPath": fromPath,
-			"toPath":   toPath,
-			"error":    err.Error(),
-		}).Error("failed to rename index")
+			"id":  id,
+			"key": mf.Key,
+		}).Info("landing is changed in the store")
 	}
-
-	log.WithFields(log.Fields{
-		"id":  c.Id,
-		"len": len(buff),
-	}).Info("unpack campaign done")
-	return
+	return s.unpack(id, lp, templateName, true) == nil
 }
+
 func (s *сampaigns) GetAll() map[string]Campaign {
 	return s.ByLink
 }
 func (s *сampaigns) Update(ac xmp_api_structs.Campaign) error {
+	campaign, deleted, err := s.prepare(ac)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	if s.ByUUID == nil {
+		s.ByUUID = make(map[string]Campaign)
+	}
+	if s.ByHash == nil {
+		s.ByHash = make(map[string]Campaign)
+	}
+	if s.ByLink == nil {
+		s.ByLink = make(map[string]Campaign)
+	}
+	if deleted {
+		delete(s.ByUUID, ac.Id)
+		delete(s.ByHash, ac.Id)
+		delete(s.ByLink, ac.Link)
+		log.WithFields(log.Fields{
+			"id": ac.Id,
+		}).Debug("campaign deleted")
+		Svc.History.RecordDeleted(HistoryCampaign, ac.Id, s.historySource())
+	} else {
+		s.ByUUID[campaign.Id] = campaign
+		s.ByHash[campaign.Hash] = campaign
+		s.ByLink[campaign.Link] = campaign
+		Svc.History.Record(HistoryCampaign, campaign.Id, s.historySource(), campaign)
+	}
+	s.ByServiceCode = campaignsByServiceCode(s.ByUUID)
+	s.Unlock()
+	s.webHook()
+	return nil
+}
+
+// checks the campaign and downloads the landing,
+// the campaign is ready to be published if there is no error
+func (s *сampaigns) prepare(ac xmp_api_structs.Campaign) (campaign Campaign, deleted bool, err error) {
 	campJson, _ := json.Marshal(ac)
 	log.WithFields(log.Fields{
 		"id":   ac.Id,
@@ -212,14 +366,16 @@ func (s *сampaigns) Update(ac xmp_api_structs.Campaign) error {
 	}).Debug("campaign")
 
 	if ac.Id == "" {
-		return fmt.Errorf("Campaign Id is empty%s", "")
+		err = fmt.Errorf("Campaign Id is empty%s", "")
+		return
 	}
 	if ac.Hash == "" {
 		ac.Hash = ac.Id
 	}
 
 	if ac.ServiceId == "" && ac.ServiceCode == "" {
-		return fmt.Errorf("Both service id and Service Code are empty%s", "")
+		err = fmt.Errorf("Both service id and Service Code are empty%s", "")
+		return
 	}
 	if ac.ServiceId == "" {
 		ac.ServiceId = ac.ServiceCode
@@ -228,70 +384,47 @@ func (s *сampaigns) Update(ac xmp_api_structs.Campaign) error {
 		ac.ServiceCode = ac.ServiceId
 	}
 	if s.conf.FromControlPanel && ac.Status == 0 {
-		s.Lock()
-		delete(s.ByUUID, ac.Id)
-		delete(s.ByHash, ac.Id)
-		delete(s.ByLink, ac.Link)
-		s.Unlock()
-		log.WithFields(log.Fields{
-			"id": ac.Id,
-		}).Debug("campaign deleted")
-		s.webHook()
-		return nil
+		deleted = true
+		return
 	}
 	if s.conf.FromControlPanel {
-		if c, ok := s.ByUUID[ac.Id]; ok {
+		s.RLock()
+		c, ok := s.ByUUID[ac.Id]
+		s.RUnlock()
+		if ok {
 			if c.Lp != ac.Lp && c.Lp != "" {
 				log.WithFields(log.Fields{
 					"id":      ac.Id,
 					"from_lp": ac.Lp,
 					"to_lp":   c.Lp,
 				}).Debug("land has changed")
-				if err := s.Download(ac); err != nil {
-					return fmt.Errorf("Download: %s", err.Error())
+				if err = s.Download(ac); err != nil {
+					err = fmt.Errorf("Download: %s", err.Error())
+					return
 				}
 			}
 		} else {
-			if err := s.Download(ac); err != nil {
-				return fmt.Errorf("Download: %s", err.Error())
+			if err = s.Download(ac); err != nil {
+				err = fmt.Errorf("Download: %s", err.Error())
+				return
 			}
 		}
 	}
 
-	s.Lock()
-	defer s.Unlock()
-	if s.ByUUID == nil {
-		s.ByUUID = make(map[string]Campaign)
-	}
-	if s.ByHash == nil {
-		s.ByHash = make(map[string]Campaign)
-	}
-	if s.ByLink == nil {
-		s.ByLink = make(map[string]Campaign)
-	}
-	if s.ByServiceCode == nil {
-		s.ByServiceCode = make(map[string][]Campaign)
-	}
-	if s.ByUUID == nil {
-		s.ByUUID = make(map[string]Campaign)
-	}
 	serv, err := Svc.Services.GetById(ac.ServiceId)
 	if err != nil {
-		return fmt.Errorf("unknown service id: %s", ac.ServiceId)
+		err = fmt.Errorf("unknown service id: %s", ac.ServiceId)
+		return
 	}
 	ac.ServiceCode = serv.Code
-	campaign := Campaign{}
 	campaign.Load(ac)
-	s.ByUUID[campaign.Id] = campaign
-	s.ByHash[campaign.Hash] = campaign
-	s.ByLink[campaign.Link] = campaign
-
-	s.ByServiceCode = make(map[string][]Campaign)
-	for _, c := range s.ByUUID {
-		s.ByServiceCode[c.ServiceCode] = append(s.ByServiceCode[c.ServiceCode], c)
+	return
+}
+func (s *сampaigns) historySource() string {
+	if s.conf.FromControlPanel {
+		return HistorySourceControlPanel
 	}
-	s.webHook()
-	return nil
+	return HistorySourceDB
 }
 func (s *сampaigns) webHook() {
 	if s.conf.WebHook != "" {
@@ -322,7 +455,7 @@ func (s *сampaigns) GetByLink(link string) (camp Campaign, err error) {
 		s.notFound.Inc()
 		return
 	}
-	return
+	return camp.scheduled()
 }
 func (s *сampaigns) GetByUUID(uuid string) (camp Campaign, err error) {
 	var ok bool
@@ -332,6 +465,7 @@ func (s *сampaigns) GetByUUID(uuid string) (camp Campaign, err error) {
 		s.notFound.Inc()
 		return
 	}
+	camp.Variants = Svc.LandingVariants.Get(camp.Id)
 	return
 }
 
@@ -343,8 +477,31 @@ func (s *сampaigns) GetByHash(hash string) (camp Campaign, err error) {
 		s.notFound.Inc()
 		return
 	}
-	return
+	return camp.scheduled()
+}
+
+// campaign is returned with ErrCampaignInactive outside of its schedule
+func (camp Campaign) scheduled() (Campaign, error) {
+	camp.Variants = Svc.LandingVariants.Get(camp.Id)
+	if !Svc.CampaignSchedules.Active(camp.Id, time.Now()) {
+		camp.Inactive = true
+		return camp, ErrCampaignInactive
+	}
+	return camp, nil
 }
+
+// campaigns of a service are sorted by id, so the first one doesn't depend on reloads
+func campaignsByServiceCode(byUUID map[string]Campaign) map[string][]Campaign {
+	byServiceCode := make(map[string][]Campaign)
+	for _, c := range byUUID {
+		byServiceCode[c.ServiceCode] = append(byServiceCode[c.ServiceCode], c)
+	}
+	for _, camps := range byServiceCode {
+		sort.Slice(camps, func(i, j int) bool { return camps[i].Id < camps[j].Id })
+	}
+	return byServiceCode
+}
+
 func (s *сampaigns) GetByServiceCode(serviceCode string) (camps []Campaign, err error) {
 	camps = s.ByServiceCode[serviceCode]
 	if len(camps) == 0 {
@@ -410,24 +567,80 @@ func (s *сampaigns) Reload() (err error) {
 	s.ShowLoaded()
 	return nil
 }
+
+// landings are downloaded by apply_workers in parallel, the download manager bounds the downloads;
+// campaigns are published at once, only those which are ready
 func (s *сampaigns) Apply(campaigns map[string]xmp_api_structs.Campaign) {
+	type prepared struct {
+		campaign Campaign
+		deleted  bool
+		err      error
+	}
+	results := make(map[string]prepared, len(campaigns))
+	workers := s.conf.ApplyWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(campaigns) {
+		workers = len(campaigns)
+	}
+	queue := make(chan string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range queue {
+				campaign, deleted, err := s.prepare(campaigns[id])
+				mu.Lock()
+				results[id] = prepared{campaign: campaign, deleted: deleted, err: err}
+				mu.Unlock()
+			}
+		}()
+	}
+	for id := range campaigns {
+		queue <- id
+	}
+	close(queue)
+	wg.Wait()
 
-	s.ByUUID = make(map[string]Campaign, len(campaigns))
-	s.ByServiceCode = make(map[string][]Campaign)
-	s.ByLink = make(map[string]Campaign, len(campaigns))
-	s.ByHash = make(map[string]Campaign, len(campaigns))
+	byUUID := make(map[string]Campaign, len(campaigns))
+	byHash := make(map[string]Campaign, len(campaigns))
+	byLink := make(map[string]Campaign, len(campaigns))
 	s.loadError.Set(0)
-	for _, ac := range campaigns {
-		if err := s.Update(ac); err == nil {
-			log.WithField("id", ac.Id).Debug("update campaign ok")
-		} else {
+	for id, res := range results {
+		if res.err != nil {
 			s.loadError.Set(1)
 			log.WithFields(log.Fields{
-				"id":    ac.Id,
-				"error": err.Error(),
+				"id":    id,
+				"error": res.err.Error(),
 			}).Debug("update campaign")
+			continue
+		}
+		if res.deleted {
+			continue
+		}
+		log.WithField("id", id).Debug("update campaign ok")
+		c := res.campaign
+		byUUID[c.Id] = c
+		byHash[c.Hash] = c
+		byLink[c.Link] = c
+		Svc.History.Record(HistoryCampaign, c.Id, s.historySource(), c)
+	}
+
+	s.Lock()
+	for id := range s.ByUUID {
+		if _, ok := byUUID[id]; !ok {
+			Svc.History.RecordDeleted(HistoryCampaign, id, s.historySource())
 		}
 	}
+	s.ByUUID = byUUID
+	s.ByHash = byHash
+	s.ByLink = byLink
+	s.ByServiceCode = campaignsByServiceCode(byUUID)
+	s.Unlock()
+	s.webHook()
 }
 func (s *сampaigns) ShowLoaded() {
 	byUUID, _ := json.Marshal(s.ByUUID)
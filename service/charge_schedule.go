@@ -0,0 +1,247 @@
+package service
+
+// periodic charging schedule of a service, the same for all charging workers:
+// days of week, allowed minutes of the day in the time zone of the country,
+// delay after subscription, paid hours, retry, grace and inactive days
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	xmp_api_structs "github.com/linkit360/xmp-api/src/structs"
+)
+
+const (
+	ChargeReasonDay      = "day"         // not a charging day
+	ChargeReasonTime     = "time"        // out of allowed minutes
+	ChargeReasonDelay    = "delay_hours" // too soon after subscription
+	ChargeReasonPaid     = "paid_hours"  // too soon after the last charge
+	ChargeReasonRetry    = "retry_days"  // retry and grace days are over
+	ChargeReasonInactive = "inactive"    // no charge for inactive days
+	ChargeReasonNever    = "never"       // no allowed time found
+	chargeSearchSteps    = 2 * 8         // two steps a day, a week and a day
+	minutesPerDay        = 24 * 60
+)
+
+var weekDays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+type chargeSchedule struct {
+	Days         Days
+	AllowedFrom  int // minute of the day, from == to - all day, from > to - over midnight
+	AllowedTo    int
+	DelayHours   int
+	PaidHours    int
+	RetryDays    int
+	GraceDays    int
+	InactiveDays int
+}
+
+// the subscription, zero times are unknown
+type ChargeState struct {
+	SubscribedAt  time.Time `json:"subscribed_at,omitempty"`
+	LastPaidAt    time.Time `json:"last_paid_at,omitempty"`
+	LastAttemptAt time.Time `json:"last_attempt_at,omitempty"`
+}
+
+type ChargeDecision struct {
+	Allowed bool      `json:"allowed"`
+	Reason  string    `json:"reason,omitempty"`  // why it is not allowed now
+	NextAt  time.Time `json:"next_at,omitempty"` // the next allowed time, zero - never
+}
+
+func newChargeSchedule(svc serviceSchedule) (chargeSchedule, error) {
+	var days Days
+	if strings.TrimSpace(svc.PeriodicDays) != "" {
+		if err := json.Unmarshal([]byte(svc.PeriodicDays), &days); err != nil {
+			return chargeSchedule{}, fmt.Errorf("json.Unmarshal: %s", err.Error())
+		}
+	}
+	if !days.ok(days) {
+		return chargeSchedule{}, fmt.Errorf("send charge days: %s, allowed: %s",
+			strings.Join(days, ","), strings.Join(allowedDays, ","))
+	}
+	cs := chargeSchedule{
+		Days:         days,
+		AllowedFrom:  svc.AllowedFrom,
+		AllowedTo:    svc.AllowedTo,
+		DelayHours:   svc.DelayHours,
+		PaidHours:    svc.PaidHours,
+		RetryDays:    svc.RetryDays,
+		GraceDays:    svc.GraceDays,
+		InactiveDays: svc.InactiveDays,
+	}
+	for _, minute := range []int{cs.AllowedFrom, cs.AllowedTo} {
+		if minute < 0 || minute > minutesPerDay {
+			return cs, fmt.Errorf("wrong allowed minute: %d, must be 0-%d", minute, minutesPerDay)
+		}
+	}
+	return cs, nil
+}
+
+// fields of the service which the schedule is made of
+func serviceScheduleOf(svc xmp_api_structs.Service) serviceSchedule {
+	return serviceSchedule{
+		PeriodicDays: svc.PeriodicDays,
+		AllowedFrom:  int(svc.PeriodicAllowedFrom),
+		AllowedTo:    int(svc.PeriodicAllowedTo),
+		DelayHours:   int(svc.DelayHours),
+		PaidHours:    int(svc.PaidHours),
+		RetryDays:    int(svc.RetryDays),
+		GraceDays:    int(svc.GraceDays),
+		InactiveDays: int(svc.InactiveDays),
+	}
+}
+
+type serviceSchedule struct {
+	PeriodicDays string
+	AllowedFrom  int
+	AllowedTo    int
+	DelayHours   int
+	PaidHours    int
+	RetryDays    int
+	GraceDays    int
+	InactiveDays int
+}
+
+func (cs chargeSchedule) weekly() bool {
+	for _, d := range cs.Days {
+		if d == "weekly" {
+			return true
+		}
+	}
+	return false
+}
+
+func (cs chargeSchedule) dayAllowed(t time.Time) bool {
+	weekDay := false
+	for _, d := range cs.Days {
+		if wd, ok := weekDays[d]; ok {
+			weekDay = true
+			if t.Weekday() == wd {
+				return true
+			}
+		}
+	}
+	return !weekDay
+}
+
+func (cs chargeSchedule) timeAllowed(t time.Time) bool {
+	from, to := cs.AllowedFrom%minutesPerDay, cs.AllowedTo%minutesPerDay
+	if from == to {
+		return true
+	}
+	minute := 60*t.Hour() + t.Minute()
+	if from < to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+// the next time the reason may change: allowed minutes or the next day start
+func (cs chargeSchedule) step(t time.Time, loc *time.Location) time.Time {
+	dayStart := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	if from := dayStart.Add(time.Duration(cs.AllowedFrom%minutesPerDay) * time.Minute); from.After(t) {
+		return from
+	}
+	return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+}
+
+// t is in the time zone of the country
+func (cs chargeSchedule) reason(t time.Time) string {
+	if !cs.dayAllowed(t) {
+		return ChargeReasonDay
+	}
+	if !cs.timeAllowed(t) {
+		return ChargeReasonTime
+	}
+	return ""
+}
+
+func maxTime(times ...time.Time) time.Time {
+	var res time.Time
+	for _, t := range times {
+		if t.After(res) {
+			res = t
+		}
+	}
+	return res
+}
+
+// not before delay and paid hours, then the first allowed minute
+func (cs chargeSchedule) decide(st ChargeState, at time.Time, loc *time.Location) ChargeDecision {
+	at = at.In(loc)
+	since := maxTime(st.LastPaidAt, st.SubscribedAt)
+
+	// subscription is not charged any more
+	if cs.InactiveDays > 0 && !since.IsZero() && !at.Before(since.AddDate(0, 0, cs.InactiveDays)) {
+		return ChargeDecision{Reason: ChargeReasonInactive}
+	}
+	var deadline time.Time
+	if cs.RetryDays > 0 && !since.IsZero() && st.LastAttemptAt.After(since) {
+		deadline = since.AddDate(0, 0, cs.RetryDays+cs.GraceDays)
+		if !at.Before(deadline) {
+			return ChargeDecision{Reason: ChargeReasonRetry}
+		}
+	}
+
+	reason := ""
+	start := at
+	if !st.SubscribedAt.IsZero() && st.LastPaidAt.IsZero() {
+		if notBefore := st.SubscribedAt.Add(time.Duration(cs.DelayHours) * time.Hour); at.Before(notBefore) {
+			start, reason = notBefore, ChargeReasonDelay
+		}
+	}
+	if !st.LastPaidAt.IsZero() {
+		paidHours := time.Duration(cs.PaidHours) * time.Hour
+		if cs.weekly() && paidHours < 7*24*time.Hour {
+			paidHours = 7 * 24 * time.Hour
+		}
+		if notBefore := st.LastPaidAt.Add(paidHours); at.Before(notBefore) {
+			start, reason = notBefore, ChargeReasonPaid
+		}
+	}
+	start = start.In(loc)
+	if reason == "" {
+		reason = cs.reason(start)
+		if reason == "" {
+			return ChargeDecision{Allowed: true, NextAt: at}
+		}
+	}
+
+	next := start
+	for i := 0; i < chargeSearchSteps && cs.reason(next) != ""; i++ {
+		next = cs.step(next, loc)
+	}
+	if cs.reason(next) != "" {
+		return ChargeDecision{Reason: ChargeReasonNever}
+	}
+	if !deadline.IsZero() && !next.Before(deadline) {
+		return ChargeDecision{Reason: ChargeReasonRetry}
+	}
+	return ChargeDecision{Reason: reason, NextAt: next}
+}
+
+// decision for the service at the moment, at is now if zero
+func (s *services) CanCharge(serviceCode string, st ChargeState, at time.Time) (ChargeDecision, error) {
+	svc, err := s.GetByCode(serviceCode)
+	if err != nil {
+		return ChargeDecision{}, err
+	}
+	cs, err := newChargeSchedule(serviceScheduleOf(svc))
+	if err != nil {
+		return ChargeDecision{}, fmt.Errorf("service %s charge schedule: %s", serviceCode, err.Error())
+	}
+	if at.IsZero() {
+		at = time.Now()
+	}
+	return cs.decide(st, at, s.loc), nil
+}
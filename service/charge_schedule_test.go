@@ -0,0 +1,87 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChargeScheduleNew(t *testing.T) {
+	cs, err := newChargeSchedule(serviceSchedule{PeriodicDays: `["mon","thu"]`, AllowedFrom: 1320, AllowedTo: 360})
+	assert.NoError(t, err)
+	assert.Equal(t, Days{"mon", "thu"}, cs.Days)
+
+	_, err = newChargeSchedule(serviceSchedule{PeriodicDays: `["monday"]`})
+	assert.Error(t, err, "wrong day")
+	_, err = newChargeSchedule(serviceSchedule{PeriodicDays: `mon`})
+	assert.Error(t, err, "wrong json")
+	_, err = newChargeSchedule(serviceSchedule{AllowedFrom: 1441})
+	assert.Error(t, err, "wrong minute")
+}
+
+func TestChargeScheduleDecide(t *testing.T) {
+	loc, _ := time.LoadLocation("Asia/Bangkok")
+	at := func(day, hour int) time.Time {
+		// 2017-06-05 is monday
+		return time.Date(2017, 6, day, hour, 30, 0, 0, loc)
+	}
+	cs := chargeSchedule{Days: Days{"mon", "wed"}, AllowedFrom: 540, AllowedTo: 1080}
+
+	d := cs.decide(ChargeState{}, at(5, 10), loc)
+	assert.True(t, d.Allowed)
+
+	d = cs.decide(ChargeState{}, at(5, 20), loc)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, ChargeReasonTime, d.Reason)
+	assert.Equal(t, time.Date(2017, 6, 7, 9, 0, 0, 0, loc), d.NextAt, "next charging day")
+
+	d = cs.decide(ChargeState{}, at(7, 1).UTC(), loc)
+	assert.Equal(t, ChargeReasonTime, d.Reason, "wednesday in the time zone of the country")
+
+	cs = chargeSchedule{AllowedFrom: 1320, AllowedTo: 360, DelayHours: 2}
+	d = cs.decide(ChargeState{SubscribedAt: at(5, 23)}, at(5, 23), loc)
+	assert.Equal(t, ChargeReasonDelay, d.Reason)
+	assert.Equal(t, at(6, 1), d.NextAt)
+
+	d = cs.decide(ChargeState{SubscribedAt: at(5, 5)}, at(5, 10), loc)
+	assert.Equal(t, ChargeReasonTime, d.Reason)
+	assert.Equal(t, time.Date(2017, 6, 5, 22, 0, 0, 0, loc), d.NextAt, "over midnight")
+
+	cs = chargeSchedule{Days: Days{"weekly"}, PaidHours: 24}
+	d = cs.decide(ChargeState{LastPaidAt: at(5, 10)}, at(7, 10), loc)
+	assert.Equal(t, ChargeReasonPaid, d.Reason)
+	assert.Equal(t, at(12, 10), d.NextAt, "weekly")
+
+	cs = chargeSchedule{RetryDays: 3, GraceDays: 1, InactiveDays: 30}
+	st := ChargeState{LastPaidAt: at(5, 10), LastAttemptAt: at(8, 10)}
+	assert.True(t, cs.decide(st, at(9, 9), loc).Allowed, "grace days")
+	assert.Equal(t, ChargeReasonRetry, cs.decide(st, at(9, 10), loc).Reason)
+
+	st = ChargeState{SubscribedAt: at(1, 10)}
+	d = cs.decide(st, at(1, 10).AddDate(0, 0, 30), loc)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, ChargeReasonInactive, d.Reason)
+	assert.True(t, d.NextAt.IsZero())
+
+	cs = chargeSchedule{Days: Days{"sun"}, AllowedFrom: 540, AllowedTo: 600, RetryDays: 1}
+	st = ChargeState{LastPaidAt: at(5, 10), LastAttemptAt: at(5, 11)}
+	assert.Equal(t, ChargeReasonRetry, cs.decide(st, at(5, 12), loc).Reason, "no allowed time before the retry deadline")
+}
+
+func TestChargeScheduleMinutes(t *testing.T) {
+	loc, _ := time.LoadLocation("Asia/Bangkok")
+	// 08:30 - 23:30 as in the services of the fixture
+	cs := chargeSchedule{AllowedFrom: 510, AllowedTo: 1410}
+
+	assert.True(t, cs.decide(ChargeState{}, time.Date(2017, 6, 5, 8, 30, 0, 0, loc), loc).Allowed)
+	assert.True(t, cs.decide(ChargeState{}, time.Date(2017, 6, 5, 23, 29, 0, 0, loc), loc).Allowed)
+
+	d := cs.decide(ChargeState{}, time.Date(2017, 6, 5, 8, 29, 0, 0, loc), loc)
+	assert.Equal(t, ChargeReasonTime, d.Reason)
+	assert.Equal(t, time.Date(2017, 6, 5, 8, 30, 0, 0, loc), d.NextAt)
+
+	d = cs.decide(ChargeState{}, time.Date(2017, 6, 5, 23, 30, 0, 0, loc), loc)
+	assert.Equal(t, ChargeReasonTime, d.Reason)
+	assert.Equal(t, time.Date(2017, 6, 6, 8, 30, 0, 0, loc), d.NextAt, "next day")
+}
@@ -0,0 +1,158 @@
+package service
+
+// the next content for the msisdn is picked and recorded as sent at once,
+// the contents of the service which are not seen yet are rotated by the strategy,
+// when all are seen the sent contents are cleared and the rotation starts again
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/linkit360/go-utils/structs"
+	xmp_api_structs "github.com/linkit360/xmp-api/src/structs"
+)
+
+const (
+	RotationRoundRobin  = "round_robin"  // in the order of the contents of the service
+	RotationRandom      = "random"       // any unseen content
+	RotationWeighted    = "weighted"     // random by the weights
+	RotationNewestFirst = "newest_first" // the latest added to the service first
+)
+
+type ContentRotationConfig struct {
+	Strategy string                           `yaml:"strategy" default:"round_robin"`
+	Services map[string]ServiceRotationConfig `yaml:"services"` // by service code
+}
+
+type ServiceRotationConfig struct {
+	Strategy string         `yaml:"strategy"`
+	Weights  map[string]int `yaml:"weights"` // by content id, 1 if not set, 0 - never sent
+}
+
+type NextContent struct {
+	Content  xmp_api_structs.Content `json:"content"`
+	Strategy string                  `json:"strategy"`
+	Reset    bool                    `json:"reset,omitempty"` // all contents were seen, sent contents are cleared
+}
+
+func rotationStrategyOk(strategy string) bool {
+	switch strategy {
+	case RotationRoundRobin, RotationRandom, RotationWeighted, RotationNewestFirst:
+		return true
+	}
+	return false
+}
+
+func (s *SentContents) rotationFor(serviceCode string) ServiceRotationConfig {
+	rc := s.rotation.Services[serviceCode]
+	if rc.Strategy == "" {
+		rc.Strategy = s.rotation.Strategy
+	}
+	if rc.Strategy == "" {
+		rc.Strategy = RotationRoundRobin
+	}
+	return rc
+}
+
+func (rc ServiceRotationConfig) weight(contentId string) int {
+	if w, ok := rc.Weights[contentId]; ok {
+		return w
+	}
+	return 1
+}
+
+// unseen contents which may be sent, in the order of the service
+func (rc ServiceRotationConfig) candidates(contentIds []string, seen map[string]struct{}) []string {
+	var res []string
+	for _, id := range contentIds {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		if rc.weight(id) <= 0 {
+			continue
+		}
+		res = append(res, id)
+	}
+	return res
+}
+
+// content id and whether the seen contents must be cleared, empty id - nothing to send
+func (rc ServiceRotationConfig) next(contentIds []string, seen map[string]struct{}, r *rand.Rand) (string, bool) {
+	reset := false
+	candidates := rc.candidates(contentIds, seen)
+	if len(candidates) == 0 {
+		candidates = rc.candidates(contentIds, nil)
+		reset = true
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+
+	switch rc.Strategy {
+	case RotationRandom:
+		return candidates[r.Intn(len(candidates))], reset
+	case RotationWeighted:
+		total := 0
+		for _, id := range candidates {
+			total += rc.weight(id)
+		}
+		n := r.Intn(total)
+		for _, id := range candidates {
+			if n -= rc.weight(id); n < 0 {
+				return id, reset
+			}
+		}
+		return candidates[len(candidates)-1], reset
+	case RotationNewestFirst:
+		return candidates[len(candidates)-1], reset
+	default:
+		return candidates[0], reset
+	}
+}
+
+// picks the content for the msisdn and records it as sent
+func (s *SentContents) Next(msisdn, serviceCode string) (NextContent, error) {
+	svc, err := Svc.Services.GetByCode(serviceCode)
+	if err != nil {
+		return NextContent{}, fmt.Errorf("service %s: %s", serviceCode, err.Error())
+	}
+	byId := make(map[string]xmp_api_structs.Content, len(svc.ContentIds))
+	var contentIds []string
+	for _, id := range svc.ContentIds {
+		c, err := Svc.Contents.GetById(id)
+		if err != nil {
+			continue
+		}
+		byId[id] = c
+		contentIds = append(contentIds, id)
+	}
+	rc := s.rotationFor(serviceCode)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.ByKey == nil {
+		s.ByKey = make(map[string]map[string]struct{})
+	}
+	t := structs.ContentSentProperties{Msisdn: msisdn, ServiceCode: serviceCode}
+	key := t.Key()
+	id, reset := rc.next(contentIds, s.ByKey[key], s.rand)
+	if id == "" {
+		return NextContent{}, fmt.Errorf("service %s: no content", serviceCode)
+	}
+	now := time.Now().UTC()
+	if reset {
+		s.journal.add(sentContentOp{Op: sentContentClear, Msisdn: msisdn, ServiceCode: serviceCode, At: now})
+	}
+	if reset || s.ByKey[key] == nil {
+		s.ByKey[key] = make(map[string]struct{})
+	}
+	s.ByKey[key][id] = struct{}{}
+	s.journal.add(sentContentOp{Op: sentContentPush, Msisdn: msisdn, ServiceCode: serviceCode, ContentId: id, At: now})
+
+	return NextContent{
+		Content:  byId[id],
+		Strategy: rc.Strategy,
+		Reset:    reset,
+	}, nil
+}
@@ -0,0 +1,52 @@
+package service
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentRotationNext(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	r := rand.New(rand.NewSource(1))
+	seen := map[string]struct{}{"a": {}}
+
+	rc := ServiceRotationConfig{Strategy: RotationRoundRobin}
+	id, reset := rc.next(ids, seen, r)
+	assert.Equal(t, "b", id)
+	assert.False(t, reset)
+
+	rc = ServiceRotationConfig{Strategy: RotationNewestFirst}
+	id, _ = rc.next(ids, seen, r)
+	assert.Equal(t, "c", id)
+
+	rc = ServiceRotationConfig{Strategy: RotationRandom}
+	for i := 0; i < 20; i++ {
+		id, _ = rc.next(ids, seen, r)
+		assert.NotEqual(t, "a", id, "seen")
+	}
+
+	rc = ServiceRotationConfig{Strategy: RotationWeighted, Weights: map[string]int{"b": 0, "c": 5}}
+	for i := 0; i < 20; i++ {
+		id, _ = rc.next(ids, seen, r)
+		assert.Equal(t, "c", id, "zero weight is never sent")
+	}
+
+	rc = ServiceRotationConfig{Strategy: RotationRoundRobin}
+	id, reset = rc.next(ids, map[string]struct{}{"a": {}, "b": {}, "c": {}}, r)
+	assert.Equal(t, "a", id)
+	assert.True(t, reset, "all are seen")
+
+	id, _ = rc.next(nil, nil, r)
+	assert.Equal(t, "", id, "no content")
+}
+
+func TestContentRotationFor(t *testing.T) {
+	s := initSentContents("test", ContentRotationConfig{
+		Strategy: RotationRandom,
+		Services: map[string]ServiceRotationConfig{"777": {Strategy: RotationWeighted}},
+	}, SentContentsConfig{})
+	assert.Equal(t, RotationWeighted, s.rotationFor("777").Strategy)
+	assert.Equal(t, RotationRandom, s.rotationFor("778").Strategy)
+}
@@ -5,7 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/prometheus/client_golang/prometheus"
@@ -31,18 +34,30 @@ type contents struct {
 	s3dl      *s3manager.Downloader
 	ByUUID    map[string]xmp_api_structs.Content
 	loadError prometheus.Gauge
+	mismatch  m.Gauge
 }
 
 type ContentConfig struct {
-	FromControlPanel bool   `yaml:"from_control_panel"`
-	ContentPath      string `yaml:"content_path"`
-	Bucket           string `yaml:"bucket" default:"xmp-content"`
+	FromControlPanel bool                  `yaml:"from_control_panel"`
+	ContentPath      string                `yaml:"content_path"`
+	Bucket           string                `yaml:"bucket" default:"xmp-content"`
+	VerifyInterval   int                   `yaml:"verify_interval" default:"600"` // seconds, content files are checked with manifests, 0 - never
+	Rotation         ContentRotationConfig `yaml:"rotation"`
 }
 
 func initContents(appName string, contentConf ContentConfig) Contents {
 	contentSvc := &contents{
 		conf:      contentConf,
 		loadError: m.PrometheusGauge(appName, "content_load", "error", "load content error"),
+		mismatch:  m.NewGauge(appName, "content", "mismatch", "content files are missing or changed"),
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			contentSvc.mismatch.Update()
+		}
+	}()
+	if contentConf.VerifyInterval > 0 {
+		go contentSvc.verifyContents(time.Duration(contentConf.VerifyInterval) * time.Second)
 	}
 
 	return contentSvc
@@ -51,7 +66,7 @@ func initContents(appName string, contentConf ContentConfig) Contents {
 // check content and download it
 // content already checked: it hasn't been downloaded yet
 func (s *contents) Download(c xmp_api_structs.Content) (err error) {
-
+	etag := storeETag(Svc.downloader, s.conf.Bucket, c.Id)
 	buff, size, err := Svc.downloader.Download(s.conf.Bucket, c.Id)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -74,6 +89,12 @@ func (s *contents) Download(c xmp_api_structs.Content) (err error) {
 		}).Error("failed to unzip object")
 		return
 	}
+	if err := s.writeManifest(c.Id, etag, buff); err != nil {
+		log.WithFields(log.Fields{
+			"id":    c.Id,
+			"error": err.Error(),
+		}).Error("cannot write content manifest")
+	}
 	log.WithFields(log.Fields{
 		"id":  c.Id,
 		"len": len(buff),
@@ -81,28 +102,108 @@ func (s *contents) Download(c xmp_api_structs.Content) (err error) {
 	return
 }
 
-func (s *contents) Update(cc []xmp_api_structs.Content) (err error) {
-	if !s.conf.FromControlPanel {
-		return fmt.Errorf("Disabled%s", "")
+// manifests are kept out of the content files
+func (s *contents) manifestPath(id string) string {
+	return filepath.Join(s.conf.ContentPath, ".manifests", id+".json")
+}
+
+func (s *contents) writeManifest(id, etag string, buff []byte) error {
+	names, err := zipFileNames(buff)
+	if err != nil {
+		return err
+	}
+	mf := downloadedManifest(s.conf.Bucket, id, etag, buff)
+	if err := mf.addFiles(s.conf.ContentPath, names); err != nil {
+		return err
+	}
+	return writeManifest(s.manifestPath(id), mf)
+}
+
+func (s *contents) verify(id string) error {
+	mf, err := readManifest(s.manifestPath(id))
+	if err != nil {
+		return fmt.Errorf("manifest: %s", err.Error())
+	}
+	if err := mf.verify(s.conf.ContentPath); err != nil {
+		return err
 	}
+	if mf.changed(Svc.downloader) {
+		return fmt.Errorf("changed in the store: %s", mf.ETag)
+	}
+	return nil
+}
 
-	for _, c := range cc {
-		if err = s.Download(c); err != nil {
-			return fmt.Errorf("Download: %s", err.Error())
+// content which is missing or changed on the disk or changed in the store is downloaded again
+func (s *contents) verifyContents(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !s.conf.FromControlPanel {
+			continue
+		}
+		var cc []xmp_api_structs.Content
+		s.RLock()
+		for _, c := range s.ByUUID {
+			cc = append(cc, c)
 		}
+		s.RUnlock()
 
-		contentPath := s.conf.ContentPath + c.Name
-		if _, err := os.Stat(contentPath); os.IsNotExist(err) {
-			return fmt.Errorf("Cannot find file: %s", err.Error())
+		for _, c := range cc {
+			err := s.verify(c.Id)
+			if err == nil {
+				continue
+			}
+			s.mismatch.Inc()
+			log.WithFields(log.Fields{
+				"id":    c.Id,
+				"error": err.Error(),
+			}).Warn("content is broken, download again")
+			s.Download(c)
 		}
+	}
+}
 
-		// only in content need this
-		if s.ByUUID == nil {
-			s.ByUUID = make(map[string]xmp_api_structs.Content)
+// contents are downloaded in parallel, only downloaded ones are published,
+// the error tells about all which are not
+func (s *contents) Update(cc []xmp_api_structs.Content) (err error) {
+	if !s.conf.FromControlPanel {
+		return fmt.Errorf("Disabled%s", "")
+	}
+
+	errs := make([]error, len(cc))
+	var wg sync.WaitGroup
+	for i, c := range cc {
+		wg.Add(1)
+		go func(i int, c xmp_api_structs.Content) {
+			defer wg.Done()
+			if err := s.Download(c); err != nil {
+				errs[i] = fmt.Errorf("Download: %s: %s", c.Id, err.Error())
+				return
+			}
+			contentPath := s.conf.ContentPath + c.Name
+			if _, err := os.Stat(contentPath); os.IsNotExist(err) {
+				errs[i] = fmt.Errorf("Cannot find file: %s", err.Error())
+				return
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	var failed []string
+	s.Lock()
+	if s.ByUUID == nil {
+		s.ByUUID = make(map[string]xmp_api_structs.Content)
+	}
+	for i, c := range cc {
+		if errs[i] != nil {
+			failed = append(failed, errs[i].Error())
+			continue
 		}
 		s.ByUUID[c.Id] = c
 	}
+	s.Unlock()
 
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d: %s", len(failed), len(cc), strings.Join(failed, "; "))
+	}
 	return nil
 }
 
@@ -0,0 +1,146 @@
+package service
+
+// downloads of all registries go through the manager:
+// not more than download_concurrency at once, the same object is downloaded once
+// for all who wait for it, failed downloads are retried with backoff unless the object is not found
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	m "github.com/linkit360/go-utils/metrics"
+)
+
+type DownloadsConfig struct {
+	Retries int `yaml:"retries" default:"3"`
+	Backoff int `yaml:"backoff" default:"1"` // seconds, doubled after each retry
+}
+
+type downloadMetrics struct {
+	Queued       prometheus.Gauge
+	InProgress   prometheus.Gauge
+	Downloaded   m.Gauge
+	Failed       m.Gauge
+	Retries      m.Gauge
+	Deduplicated m.Gauge
+	Duration     prometheus.Summary
+}
+
+func initDownloadMetrics(appName string) *downloadMetrics {
+	dm := &downloadMetrics{
+		Queued:       m.PrometheusGauge(appName, "download", "queued", "downloads waiting for a slot"),
+		InProgress:   m.PrometheusGauge(appName, "download", "in_progress", "downloads in progress"),
+		Downloaded:   m.NewGauge(appName, "download", "success", "downloaded objects"),
+		Failed:       m.NewGauge(appName, "download", "errors", "objects not downloaded after retries"),
+		Retries:      m.NewGauge(appName, "download", "retries", "download retries"),
+		Deduplicated: m.NewGauge(appName, "download", "deduplicated", "downloads joined to the same object in flight"),
+		Duration:     m.NewSummary(appName+"_download_duration_seconds", "download duration seconds"),
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			dm.Downloaded.Update()
+			dm.Failed.Update()
+			dm.Retries.Update()
+			dm.Deduplicated.Update()
+		}
+	}()
+	return dm
+}
+
+type downloadManager struct {
+	sync.Mutex
+	store    ObjectStore
+	slots    chan struct{}
+	retries  int
+	backoff  time.Duration
+	m        *downloadMetrics
+	inFlight map[string]*download
+}
+
+type download struct {
+	done chan struct{}
+	buff []byte
+	size int64
+	err  error
+}
+
+func newDownloadManager(store ObjectStore, concurrency, retries int, backoff time.Duration, dm *downloadMetrics) *downloadManager {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &downloadManager{
+		store:    store,
+		slots:    make(chan struct{}, concurrency),
+		retries:  retries,
+		backoff:  backoff,
+		m:        dm,
+		inFlight: make(map[string]*download),
+	}
+}
+
+// the buffer is shared by all who waited for the object, it must not be changed
+func (dm *downloadManager) Download(bucket, key string) ([]byte, int64, error) {
+	id := bucket + "/" + key
+	dm.Lock()
+	if d, ok := dm.inFlight[id]; ok {
+		dm.Unlock()
+		dm.m.Deduplicated.Inc()
+		<-d.done
+		return d.buff, d.size, d.err
+	}
+	d := &download{done: make(chan struct{})}
+	dm.inFlight[id] = d
+	dm.Unlock()
+
+	d.buff, d.size, d.err = dm.download(bucket, key)
+
+	dm.Lock()
+	delete(dm.inFlight, id)
+	dm.Unlock()
+	close(d.done)
+	return d.buff, d.size, d.err
+}
+
+// the slot is not kept while waiting for the retry
+func (dm *downloadManager) download(bucket, key string) (buff []byte, size int64, err error) {
+	backoff := dm.backoff
+	for attempt := 0; ; attempt++ {
+		dm.m.Queued.Inc()
+		dm.slots <- struct{}{}
+		dm.m.Queued.Dec()
+		dm.m.InProgress.Inc()
+
+		begin := time.Now()
+		buff, size, err = dm.store.Download(bucket, key)
+
+		dm.m.InProgress.Dec()
+		<-dm.slots
+
+		if err == nil {
+			dm.m.Downloaded.Inc()
+			dm.m.Duration.Observe(time.Since(begin).Seconds())
+			return
+		}
+		logCtx := log.WithFields(log.Fields{
+			"bucket":  bucket,
+			"key":     key,
+			"attempt": attempt + 1,
+			"error":   err.Error(),
+		})
+		if attempt >= dm.retries || isObjectNotFound(err) {
+			dm.m.Failed.Inc()
+			logCtx.Error("download failed")
+			return
+		}
+		dm.m.Retries.Inc()
+		logCtx.WithField("backoff", backoff.String()).Warn("download failed, retry")
+		time.Sleep(backoff)
+		backoff = backoff * 2
+	}
+}
+
+func (dm *downloadManager) ETag(bucket, key string) (string, error) {
+	return dm.store.ETag(bucket, key)
+}
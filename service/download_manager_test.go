@@ -0,0 +1,115 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testStore struct {
+	sync.Mutex
+	delay      time.Duration
+	failures   int // the first downloads fail
+	notFound   bool
+	calls      map[string]int
+	running    int
+	maxRunning int
+}
+
+func (s *testStore) Download(bucket, key string) ([]byte, int64, error) {
+	s.Lock()
+	if s.calls == nil {
+		s.calls = make(map[string]int)
+	}
+	s.calls[key]++
+	calls := s.calls[key]
+	s.running++
+	if s.running > s.maxRunning {
+		s.maxRunning = s.running
+	}
+	s.Unlock()
+
+	time.Sleep(s.delay)
+
+	s.Lock()
+	s.running--
+	s.Unlock()
+	if s.notFound {
+		return nil, 0, objectNotFoundError{bucket: bucket, key: key}
+	}
+	if calls <= s.failures {
+		return nil, 0, fmt.Errorf("failure %d", calls)
+	}
+	return []byte(key), int64(len(key)), nil
+}
+
+func (s *testStore) ETag(bucket, key string) (string, error) {
+	return "", nil
+}
+
+func TestDownloadManagerDedup(t *testing.T) {
+	store := &testStore{delay: 50 * time.Millisecond}
+	dm := newDownloadManager(store, 4, 0, 0, testDownloadMetrics)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buff, size, err := dm.Download("xmp-content", "1")
+			assert.NoError(t, err)
+			assert.Equal(t, "1", string(buff))
+			assert.Equal(t, int64(1), size)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, store.calls["1"], "downloaded once for all")
+	assert.Equal(t, 0, len(dm.inFlight), "nothing in flight")
+
+	_, _, err := dm.Download("xmp-content", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, store.calls["1"], "downloaded again when it is not in flight")
+}
+
+func TestDownloadManagerConcurrency(t *testing.T) {
+	store := &testStore{delay: 20 * time.Millisecond}
+	dm := newDownloadManager(store, 2, 0, 0, testDownloadMetrics)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _, err := dm.Download("xmp-content", fmt.Sprintf("%d", i))
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 8, len(store.calls), "all objects")
+	assert.Equal(t, 2, store.maxRunning, "not more than concurrency at once")
+}
+
+func TestDownloadManagerRetry(t *testing.T) {
+	store := &testStore{failures: 2}
+	dm := newDownloadManager(store, 1, 2, time.Millisecond, testDownloadMetrics)
+
+	buff, _, err := dm.Download("xmp-lp", "lp.zip")
+	assert.NoError(t, err, "the last retry is ok")
+	assert.Equal(t, "lp.zip", string(buff))
+	assert.Equal(t, 3, store.calls["lp.zip"])
+
+	store = &testStore{failures: 3}
+	dm = newDownloadManager(store, 1, 2, time.Millisecond, testDownloadMetrics)
+	_, _, err = dm.Download("xmp-lp", "lp.zip")
+	assert.Error(t, err, "failed after retries")
+	assert.Equal(t, 3, store.calls["lp.zip"], "first download and retries")
+
+	store = &testStore{notFound: true}
+	dm = newDownloadManager(store, 1, 2, time.Millisecond, testDownloadMetrics)
+	_, _, err = dm.Download("xmp-lp", "lp.zip")
+	assert.True(t, isObjectNotFound(err), "not found")
+	assert.Equal(t, 1, store.calls["lp.zip"], "not found is not retried")
+}
@@ -0,0 +1,431 @@
+package service
+
+// history of campaigns, services and service prices: every change is kept with the time, the source and the diff,
+// entity is looked up as it was at a moment, e.g. the price of a transaction in a dispute
+// versions are appended to the journal file and loaded on start,
+// older than days are dropped on start and every prune interval, except the ones still in effect
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	xmp_api_structs "github.com/linkit360/xmp-api/src/structs"
+)
+
+const (
+	HistoryCampaign     = "campaign"
+	HistoryService      = "service"
+	HistoryServicePrice = "service_price"
+
+	HistorySourceControlPanel = "control_panel"
+	HistorySourceDB           = "db"
+)
+
+type HistoryConfig struct {
+	Path string `yaml:"path"`              // journal file, empty - history is kept in memory only
+	Days int    `yaml:"days" default:"90"` // versions older are dropped
+	// seconds between drops of old versions, 0 - on start only
+	PruneInterval int `yaml:"prune_interval" default:"3600"`
+}
+
+type History struct {
+	sync.RWMutex
+	conf     HistoryConfig
+	journal  *os.File
+	versions map[string][]EntityVersion // by kind and id, ordered by time
+}
+
+type EntityVersion struct {
+	Kind    string                   `json:"kind"`
+	Id      string                   `json:"id"`
+	At      time.Time                `json:"at"`
+	Source  string                   `json:"source"`
+	Deleted bool                     `json:"deleted,omitempty"`
+	Entity  json.RawMessage          `json:"entity,omitempty"`
+	Diff    map[string]HistoryChange `json:"diff,omitempty"` // fields changed since the previous version
+}
+
+type HistoryChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+func historyKey(kind, id string) string {
+	return kind + ":" + id
+}
+
+func initHistory(conf HistoryConfig) *History {
+	h := &History{
+		conf:     conf,
+		versions: make(map[string][]EntityVersion),
+	}
+	if conf.Path == "" {
+		return h
+	}
+	if err := h.load(); err != nil {
+		log.WithFields(log.Fields{
+			"path":  conf.Path,
+			"error": err.Error(),
+		}).Error("cannot load history")
+	}
+	journal, err := os.OpenFile(conf.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path":  conf.Path,
+			"error": err.Error(),
+		}).Fatal("cannot open history")
+	}
+	h.journal = journal
+	if conf.Days > 0 && conf.PruneInterval > 0 {
+		go func() {
+			for range time.Tick(time.Duration(conf.PruneInterval) * time.Second) {
+				if err := h.prune(time.Now().UTC()); err != nil {
+					log.WithFields(log.Fields{
+						"path":  conf.Path,
+						"error": err.Error(),
+					}).Error("cannot prune history")
+				}
+			}
+		}()
+	}
+	return h
+}
+
+// versions older than days are dropped and the journal is written again without them
+func (h *History) load() error {
+	f, err := os.Open(h.conf.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("os.Open: %s", err.Error())
+	}
+	defer f.Close()
+
+	count, dropped := 0, 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var v EntityVersion
+		if err := json.Unmarshal(scanner.Bytes(), &v); err != nil {
+			log.WithField("error", err.Error()).Error("wrong history line")
+			dropped++
+			continue
+		}
+		key := historyKey(v.Kind, v.Id)
+		h.versions[key] = append(h.versions[key], v)
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("scanner.Err: %s", err.Error())
+	}
+	old := h.dropOld(time.Now().UTC())
+	count -= old
+	dropped += old
+	log.WithFields(log.Fields{
+		"versions": count,
+		"dropped":  dropped,
+	}).Info("history loaded")
+	if dropped > 0 {
+		return h.compact()
+	}
+	return nil
+}
+
+// versions older than days are dropped except the one which was in effect then,
+// so an entity is looked up at any moment of the days even if it is not changed,
+// deleted entities are dropped entirely, must be called under the lock
+func (h *History) dropOld(now time.Time) int {
+	if h.conf.Days <= 0 {
+		return 0
+	}
+	since := now.AddDate(0, 0, -h.conf.Days)
+	dropped := 0
+	for key, versions := range h.versions {
+		i := sort.Search(len(versions), func(i int) bool { return !versions[i].At.Before(since) })
+		if i > 0 && !versions[i-1].Deleted {
+			i--
+		}
+		if i == 0 {
+			continue
+		}
+		dropped += i
+		if i == len(versions) {
+			delete(h.versions, key)
+			continue
+		}
+		h.versions[key] = append([]EntityVersion(nil), versions[i:]...)
+	}
+	return dropped
+}
+
+// drops old versions of the running history, the journal is written again and reopened
+func (h *History) prune(now time.Time) error {
+	h.Lock()
+	defer h.Unlock()
+
+	dropped := h.dropOld(now)
+	if dropped == 0 {
+		return nil
+	}
+	log.WithField("dropped", dropped).Info("history pruned")
+	if h.journal == nil {
+		return nil
+	}
+	if err := h.compact(); err != nil {
+		return err
+	}
+	h.journal.Close()
+	journal, err := os.OpenFile(h.conf.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		h.journal = nil
+		return fmt.Errorf("os.OpenFile: %s", err.Error())
+	}
+	h.journal = journal
+	return nil
+}
+
+func (h *History) compact() error {
+	tmpPath := h.conf.Path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("os.Create: %s", err.Error())
+	}
+	w := bufio.NewWriter(f)
+	for _, versions := range h.versions {
+		for _, v := range versions {
+			line, _ := json.Marshal(v)
+			w.Write(append(line, '\n'))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("bufio.Flush: %s", err.Error())
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("f.Close: %s", err.Error())
+	}
+	if err := os.Rename(tmpPath, h.conf.Path); err != nil {
+		return fmt.Errorf("os.Rename: %s", err.Error())
+	}
+	return nil
+}
+
+// field by field, top level of the json
+func historyDiff(prev, cur json.RawMessage) map[string]HistoryChange {
+	var from, to map[string]interface{}
+	json.Unmarshal(prev, &from)
+	json.Unmarshal(cur, &to)
+	diff := make(map[string]HistoryChange)
+	for field, value := range to {
+		if !reflect.DeepEqual(from[field], value) {
+			diff[field] = HistoryChange{From: from[field], To: value}
+		}
+	}
+	for field, value := range from {
+		if _, ok := to[field]; !ok {
+			diff[field] = HistoryChange{From: value}
+		}
+	}
+	return diff
+}
+
+// the version is kept only if the entity is changed
+func (h *History) Record(kind, id, source string, entity interface{}) {
+	if h == nil || id == "" {
+		return
+	}
+	entityJson, err := json.Marshal(entity)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"kind":  kind,
+			"id":    id,
+			"error": err.Error(),
+		}).Error("cannot marshal history")
+		return
+	}
+	h.add(EntityVersion{
+		Kind:   kind,
+		Id:     id,
+		At:     time.Now().UTC(),
+		Source: source,
+		Entity: entityJson,
+	})
+}
+
+func (h *History) RecordDeleted(kind, id, source string) {
+	if h == nil || id == "" {
+		return
+	}
+	h.add(EntityVersion{
+		Kind:    kind,
+		Id:      id,
+		At:      time.Now().UTC(),
+		Source:  source,
+		Deleted: true,
+	})
+}
+
+func (h *History) add(v EntityVersion) {
+	h.Lock()
+	defer h.Unlock()
+
+	key := historyKey(v.Kind, v.Id)
+	versions := h.versions[key]
+	if len(versions) > 0 {
+		last := versions[len(versions)-1]
+		if last.Deleted == v.Deleted && string(last.Entity) == string(v.Entity) {
+			return
+		}
+		if !last.Deleted && !v.Deleted {
+			v.Diff = historyDiff(last.Entity, v.Entity)
+		}
+	} else if v.Deleted {
+		return
+	}
+	h.versions[key] = append(versions, v)
+
+	if h.journal == nil {
+		return
+	}
+	line, _ := json.Marshal(v)
+	if _, err := h.journal.Write(append(line, '\n')); err != nil {
+		log.WithFields(log.Fields{
+			"kind":  v.Kind,
+			"id":    v.Id,
+			"error": err.Error(),
+		}).Error("cannot write history")
+	}
+}
+
+// the version which was current at the moment
+func (h *History) At(kind, id string, at time.Time) (EntityVersion, error) {
+	if h == nil {
+		return EntityVersion{}, fmt.Errorf("%s %s: no history", kind, id)
+	}
+	h.RLock()
+	versions := h.versions[historyKey(kind, id)]
+	h.RUnlock()
+
+	i := sort.Search(len(versions), func(i int) bool { return versions[i].At.After(at) })
+	if i == 0 {
+		return EntityVersion{}, fmt.Errorf("%s %s: no version at %s", kind, id, at.Format(time.RFC3339))
+	}
+	v := versions[i-1]
+	if v.Deleted {
+		return v, fmt.Errorf("%s %s: deleted at %s", kind, id, v.At.Format(time.RFC3339))
+	}
+	return v, nil
+}
+
+// versions changed in [from, to), zero bound - no bound
+func (h *History) Versions(kind, id string, from, to time.Time) []EntityVersion {
+	h.RLock()
+	defer h.RUnlock()
+
+	var res []EntityVersion
+	for _, v := range h.versions[historyKey(kind, id)] {
+		if !from.IsZero() && v.At.Before(from) {
+			continue
+		}
+		if !to.IsZero() && !v.At.Before(to) {
+			continue
+		}
+		res = append(res, v)
+	}
+	return res
+}
+
+func (h *History) Close() {
+	if h == nil || h.journal == nil {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	h.journal.Close()
+	h.journal = nil
+}
+
+func (s *сampaigns) ByUUIDAt(uuid string, at time.Time) (camp Campaign, err error) {
+	v, err := Svc.History.At(HistoryCampaign, uuid, at)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(v.Entity, &camp)
+	return
+}
+
+func (s *services) ByIdAt(serviceId string, at time.Time) (svc xmp_api_structs.Service, err error) {
+	v, err := Svc.History.At(HistoryService, serviceId, at)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(v.Entity, &svc)
+	return
+}
+
+func AddHistoryHandlers(e *gin.Engine) {
+	g := e.Group("api")
+	g.GET("/history", getHistoryHandler)
+}
+
+// /api/history?kind=campaign&id=<uuid>&from=2017-01-01T00:00:00Z&to=2017-02-01T00:00:00Z
+// /api/history?kind=service&id=<uuid>&at=1485907200
+// /api/history?kind=service_price&id=<id>
+func getHistoryHandler(c *gin.Context) {
+	kind, id := c.Query("kind"), c.Query("id")
+	if kind != HistoryCampaign && kind != HistoryService && kind != HistoryServicePrice {
+		c.JSON(400, gin.H{"error": "kind must be campaign, service or service_price"})
+		return
+	}
+	if atString, ok := c.GetQuery("at"); ok {
+		at, err := parseHistoryTime(atString)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		v, err := Svc.History.At(kind, id, at)
+		if err != nil {
+			c.JSON(404, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, v)
+		return
+	}
+	var from, to time.Time
+	var err error
+	if fromString, ok := c.GetQuery("from"); ok {
+		if from, err = parseHistoryTime(fromString); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if toString, ok := c.GetQuery("to"); ok {
+		if to, err = parseHistoryTime(toString); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	c.JSON(200, gin.H{"kind": kind, "id": id, "versions": Svc.History.Versions(kind, id, from, to)})
+}
+
+// RFC3339 or unix seconds
+func parseHistoryTime(s string) (time.Time, error) {
+	if unix, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(unix, 0).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("wrong time: %s", err.Error())
+	}
+	return t, nil
+}
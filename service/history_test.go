@@ -0,0 +1,129 @@
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testHistoryEntity struct {
+	Id    string `json:"id"`
+	Price int    `json:"price"`
+	Lp    string `json:"lp"`
+}
+
+func TestHistoryAt(t *testing.T) {
+	h := initHistory(HistoryConfig{})
+	before := time.Now().UTC()
+
+	h.Record(HistoryService, "s1", HistorySourceControlPanel, testHistoryEntity{Id: "s1", Price: 10, Lp: "a"})
+	h.Record(HistoryService, "s1", HistorySourceControlPanel, testHistoryEntity{Id: "s1", Price: 10, Lp: "a"})
+	time.Sleep(time.Millisecond)
+	atFirst := time.Now().UTC()
+	time.Sleep(time.Millisecond)
+	h.Record(HistoryService, "s1", HistorySourceDB, testHistoryEntity{Id: "s1", Price: 20, Lp: "a"})
+
+	versions := h.Versions(HistoryService, "s1", time.Time{}, time.Time{})
+	assert.Equal(t, 2, len(versions), "not changed entity is not kept")
+	assert.Equal(t, map[string]HistoryChange{"price": {From: 10., To: 20.}}, versions[1].Diff)
+	assert.Equal(t, HistorySourceDB, versions[1].Source)
+
+	_, err := h.At(HistoryService, "s1", before.Add(-time.Second))
+	assert.Error(t, err, "no version yet")
+
+	var e testHistoryEntity
+	v, err := h.At(HistoryService, "s1", atFirst)
+	assert.NoError(t, err)
+	json.Unmarshal(v.Entity, &e)
+	assert.Equal(t, 10, e.Price, "price at the moment")
+
+	v, err = h.At(HistoryService, "s1", time.Now().UTC())
+	assert.NoError(t, err)
+	json.Unmarshal(v.Entity, &e)
+	assert.Equal(t, 20, e.Price, "current price")
+
+	h.RecordDeleted(HistoryService, "s1", HistorySourceControlPanel)
+	_, err = h.At(HistoryService, "s1", time.Now().UTC())
+	assert.Error(t, err, "deleted")
+	h.RecordDeleted(HistoryService, "s2", HistorySourceControlPanel)
+	assert.Equal(t, 0, len(h.Versions(HistoryService, "s2", time.Time{}, time.Time{})), "unknown entity is not deleted")
+}
+
+func TestHistoryJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mid_history")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	conf := HistoryConfig{Path: filepath.Join(dir, "history.jsonl"), Days: 1}
+
+	var journal []byte
+	for _, days := range []int{-3, -2} {
+		old, _ := json.Marshal(EntityVersion{
+			Kind:   HistoryCampaign,
+			Id:     "c0",
+			At:     time.Now().UTC().AddDate(0, 0, days),
+			Entity: json.RawMessage(`{"id":"c0"}`),
+		})
+		journal = append(journal, append(old, '\n')...)
+	}
+	assert.NoError(t, ioutil.WriteFile(conf.Path, journal, 0644))
+
+	h := initHistory(conf)
+	versions := h.Versions(HistoryCampaign, "c0", time.Time{}, time.Time{})
+	if assert.Equal(t, 1, len(versions), "old versions are dropped") {
+		assert.True(t, versions[0].At.After(time.Now().UTC().AddDate(0, 0, -3)), "the version in effect at the cutoff is kept")
+	}
+	_, err = h.At(HistoryCampaign, "c0", time.Now().UTC().Add(-time.Hour))
+	assert.NoError(t, err, "not changed entity is looked up in the days")
+	h.Record(HistoryCampaign, "c1", HistorySourceControlPanel, testHistoryEntity{Id: "c1", Lp: "a"})
+	h.Record(HistoryCampaign, "c1", HistorySourceControlPanel, testHistoryEntity{Id: "c1", Lp: "b"})
+	h.Close()
+
+	h = initHistory(conf)
+	defer h.Close()
+	versions = h.Versions(HistoryCampaign, "c1", time.Time{}, time.Time{})
+	assert.Equal(t, 2, len(versions), "versions are loaded from the journal")
+	assert.Equal(t, map[string]HistoryChange{"lp": {From: "a", To: "b"}}, versions[1].Diff)
+}
+
+func TestHistoryPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mid_history")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	conf := HistoryConfig{Path: filepath.Join(dir, "history.jsonl"), Days: 1}
+
+	h := initHistory(conf)
+	h.Record(HistoryServicePrice, "1", HistorySourceDB, ServicePrice{Id: 1, PriceCents: 100})
+	h.Record(HistoryServicePrice, "1", HistorySourceDB, ServicePrice{Id: 1, PriceCents: 150})
+	h.Record(HistoryServicePrice, "2", HistorySourceDB, ServicePrice{Id: 2, PriceCents: 200})
+	h.RecordDeleted(HistoryServicePrice, "2", HistorySourceDB)
+	assert.NoError(t, h.prune(time.Now().UTC()), "nothing to drop")
+	assert.Equal(t, 2, len(h.Versions(HistoryServicePrice, "1", time.Time{}, time.Time{})))
+
+	later := time.Now().UTC().AddDate(0, 0, 2)
+	assert.NoError(t, h.prune(later))
+	assert.Equal(t, 1, len(h.Versions(HistoryServicePrice, "1", time.Time{}, time.Time{})), "old versions are dropped")
+	v, err := h.At(HistoryServicePrice, "1", later)
+	if assert.NoError(t, err, "the version in effect is kept") {
+		var sp ServicePrice
+		json.Unmarshal(v.Entity, &sp)
+		assert.Equal(t, 150, sp.PriceCents)
+	}
+	assert.Equal(t, 0, len(h.Versions(HistoryServicePrice, "2", time.Time{}, time.Time{})), "deleted entity is dropped")
+	h.Record(HistoryServicePrice, "3", HistorySourceDB, ServicePrice{Id: 3, PriceCents: 300})
+	h.Close()
+
+	h = initHistory(conf)
+	defer h.Close()
+	assert.Equal(t, 1, len(h.Versions(HistoryServicePrice, "1", time.Time{}, time.Time{})), "journal is written again")
+	assert.Equal(t, 0, len(h.Versions(HistoryServicePrice, "2", time.Time{}, time.Time{})))
+	assert.Equal(t, 1, len(h.Versions(HistoryServicePrice, "3", time.Time{}, time.Time{})), "reopened journal is written")
+}
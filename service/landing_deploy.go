@@ -0,0 +1,389 @@
+package service
+
+// landings are unpacked into versions: landing_path/.versions/<id>/<version>/
+// and landing_path/<id> is a symlink to the current version,
+// so the landing is switched at once and could be rolled back
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const landingVersionsDir = ".versions"
+
+// in the directory of the version
+const landingManifest = ".manifest.json"
+
+var errLandingNotDeployed = errors.New("landing is not deployed")
+
+// versions are sorted by name
+const landingVersionLayout = "20060102T150405.000000000"
+
+type landingStore struct {
+	sync.Mutex
+	locks   map[string]*sync.Mutex // by landing id, landings are deployed in parallel
+	path    string
+	keep    int   // versions kept, the current one is never removed
+	maxSize int64 // of unzipped files, 0 - no limit
+}
+
+func newLandingStore(conf CampaignsConfig) *landingStore {
+	return &landingStore{
+		path:    conf.LandingsPath,
+		keep:    conf.LandingVersions,
+		maxSize: conf.LandingMaxSize,
+	}
+}
+
+// versions of the landing are changed by one at once, returns unlock
+func (ls *landingStore) lock(id string) func() {
+	ls.Lock()
+	if ls.locks == nil {
+		ls.locks = make(map[string]*sync.Mutex)
+	}
+	l, ok := ls.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		ls.locks[id] = l
+	}
+	ls.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+func (ls *landingStore) linkPath(id string) string {
+	return filepath.Join(ls.path, id)
+}
+
+func (ls *landingStore) versionsPath(id string) string {
+	return filepath.Join(ls.path, landingVersionsDir, id)
+}
+
+// zip is checked before anything is written
+func validateLanding(zr *zip.Reader, maxSize int64) error {
+	var total uint64
+	index := false
+	for _, f := range zr.File {
+		name := path.Clean(f.Name)
+		if path.IsAbs(f.Name) || name == ".." || strings.HasPrefix(name, "../") || strings.Contains(f.Name, "\\") ||
+			name == landingManifest {
+			return fmt.Errorf("wrong file name: %s", f.Name)
+		}
+		if f.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("symlink is not allowed: %s", f.Name)
+		}
+		total = total + f.UncompressedSize64
+		if maxSize > 0 && total > uint64(maxSize) {
+			return fmt.Errorf("unzipped size is over %d bytes", maxSize)
+		}
+		if name == "index.html" {
+			index = true
+		}
+	}
+	if !index {
+		return fmt.Errorf("no index.html%s", "")
+	}
+	return nil
+}
+
+// sizes in the zip headers could be wrong, so written bytes are limited too
+func (ls *landingStore) extract(zr *zip.Reader, dir string) error {
+	left := int64(-1)
+	if ls.maxSize > 0 {
+		left = ls.maxSize
+	}
+	for _, f := range zr.File {
+		target := filepath.Join(dir, filepath.FromSlash(path.Clean(f.Name)))
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return fmt.Errorf("os.MkdirAll: %s", err.Error())
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return fmt.Errorf("os.MkdirAll: %s", err.Error())
+		}
+		n, err := extractFile(f, target, left)
+		if err != nil {
+			return fmt.Errorf("%s: %s", f.Name, err.Error())
+		}
+		if ls.maxSize > 0 {
+			left = left - n
+			if left < 0 {
+				return fmt.Errorf("unzipped size is over %d bytes", ls.maxSize)
+			}
+		}
+	}
+	return nil
+}
+
+// limit < 0 - no limit
+func extractFile(f *zip.File, target string, limit int64) (int64, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return 0, fmt.Errorf("zip.Open: %s", err.Error())
+	}
+	defer rc.Close()
+
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("os.OpenFile: %s", err.Error())
+	}
+	defer out.Close()
+
+	var r io.Reader = rc
+	if limit >= 0 {
+		r = io.LimitReader(rc, limit+1)
+	}
+	n, err := io.Copy(out, r)
+	if err != nil {
+		return n, fmt.Errorf("io.Copy: %s", err.Error())
+	}
+	return n, nil
+}
+
+// unpacks the zip into a new version, index.html is renamed to the template name,
+// checksums of the files are added to the manifest,
+// the landing is switched only if everything is ok
+func (ls *landingStore) deploy(id string, buff []byte, templateName string, mf Manifest) (version string, err error) {
+	zr, err := zip.NewReader(bytes.NewReader(buff), int64(len(buff)))
+	if err != nil {
+		return "", fmt.Errorf("zip.NewReader: %s", err.Error())
+	}
+	if err = validateLanding(zr, ls.maxSize); err != nil {
+		return "", fmt.Errorf("validate: %s", err.Error())
+	}
+
+	defer ls.lock(id)()
+
+	version = time.Now().UTC().Format(landingVersionLayout)
+	dir := filepath.Join(ls.versionsPath(id), version)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("os.MkdirAll: %s", err.Error())
+	}
+	// half written version is never left
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	if err = ls.extract(zr, dir); err != nil {
+		return "", fmt.Errorf("unzip: %s", err.Error())
+	}
+	if err = os.Rename(filepath.Join(dir, "index.html"), filepath.Join(dir, templateName)); err != nil {
+		return "", fmt.Errorf("os.Rename: %s", err.Error())
+	}
+	if err = ls.writeManifest(zr, dir, templateName, mf); err != nil {
+		return "", err
+	}
+	if err = ls.keepLegacy(id); err != nil {
+		return "", err
+	}
+	if err = ls.link(id, version); err != nil {
+		return "", err
+	}
+	ls.prune(id, version)
+	return version, nil
+}
+
+func (ls *landingStore) writeManifest(zr *zip.Reader, dir, templateName string, mf Manifest) error {
+	var names []string
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		name := path.Clean(f.Name)
+		if name == "index.html" {
+			name = templateName
+		}
+		names = append(names, name)
+	}
+	if err := mf.addFiles(dir, names); err != nil {
+		return err
+	}
+	return writeManifest(filepath.Join(dir, landingManifest), mf)
+}
+
+// current version is there and its files are the same as after unpack,
+// returns the manifest of the current version
+func (ls *landingStore) verify(id string) (Manifest, error) {
+	if _, err := os.Stat(ls.linkPath(id)); os.IsNotExist(err) {
+		return Manifest{}, errLandingNotDeployed
+	}
+	mf, err := readManifest(filepath.Join(ls.linkPath(id), landingManifest))
+	if err != nil {
+		return mf, fmt.Errorf("manifest: %s", err.Error())
+	}
+	return mf, mf.verify(ls.linkPath(id))
+}
+
+// landing unpacked before versions is kept as the first version
+func (ls *landingStore) keepLegacy(id string) error {
+	fi, err := os.Lstat(ls.linkPath(id))
+	if err != nil || fi.Mode()&os.ModeSymlink != 0 || !fi.IsDir() {
+		return nil
+	}
+	legacy := filepath.Join(ls.versionsPath(id), fi.ModTime().UTC().Format(landingVersionLayout))
+	if err := os.Rename(ls.linkPath(id), legacy); err != nil {
+		return fmt.Errorf("os.Rename: %s", err.Error())
+	}
+	log.WithFields(log.Fields{
+		"id":      id,
+		"version": filepath.Base(legacy),
+	}).Info("landing moved to versions")
+	return nil
+}
+
+// new symlink replaces the old one with rename
+func (ls *landingStore) link(id, version string) error {
+	target := filepath.Join(landingVersionsDir, id, version)
+	tmpLink := filepath.Join(ls.path, "."+id+".link")
+	os.Remove(tmpLink)
+	if err := os.Symlink(target, tmpLink); err != nil {
+		return fmt.Errorf("os.Symlink: %s", err.Error())
+	}
+	if err := os.Rename(tmpLink, ls.linkPath(id)); err != nil {
+		os.Remove(tmpLink)
+		return fmt.Errorf("os.Rename: %s", err.Error())
+	}
+	return nil
+}
+
+// must be called under the lock of the landing
+func (ls *landingStore) list(id string) (current string, versions []string, err error) {
+	files, err := ioutil.ReadDir(ls.versionsPath(id))
+	if err != nil {
+		return "", nil, fmt.Errorf("ioutil.ReadDir: %s", err.Error())
+	}
+	for _, fi := range files {
+		if fi.IsDir() {
+			versions = append(versions, fi.Name())
+		}
+	}
+	sort.Strings(versions)
+	if target, err := os.Readlink(ls.linkPath(id)); err == nil {
+		current = filepath.Base(target)
+	}
+	return current, versions, nil
+}
+
+// must be called under the lock of the landing
+func (ls *landingStore) prune(id, current string) {
+	if ls.keep < 1 {
+		return
+	}
+	_, versions, err := ls.list(id)
+	if err != nil {
+		return
+	}
+	for i := 0; i < len(versions)-ls.keep; i++ {
+		if versions[i] == current {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(ls.versionsPath(id), versions[i])); err != nil {
+			log.WithFields(log.Fields{
+				"id":      id,
+				"version": versions[i],
+				"error":   err.Error(),
+			}).Error("cannot remove landing version")
+		}
+	}
+}
+
+func (ls *landingStore) versions(id string) (current string, versions []string, err error) {
+	defer ls.lock(id)()
+	return ls.list(id)
+}
+
+// switches to the version before the current one
+func (ls *landingStore) rollback(id string) (string, error) {
+	defer ls.lock(id)()
+
+	current, versions, err := ls.list(id)
+	if err != nil {
+		return "", err
+	}
+	i := sort.SearchStrings(versions, current)
+	if i >= len(versions) || versions[i] != current {
+		return "", fmt.Errorf("current version of %s is unknown", id)
+	}
+	if i == 0 {
+		return "", fmt.Errorf("no version of %s before %s", id, current)
+	}
+	if err := ls.link(id, versions[i-1]); err != nil {
+		return "", err
+	}
+	return versions[i-1], nil
+}
+
+// id comes from the api, it must be the name of a landing
+func checkLandingId(id string) error {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, "/\\") {
+		return fmt.Errorf("wrong landing id: %s", id)
+	}
+	return nil
+}
+
+func (s *сampaigns) LandingVersions(id string) (string, []string, error) {
+	if err := checkLandingId(id); err != nil {
+		return "", nil, err
+	}
+	return s.landings.versions(id)
+}
+
+// id of the campaign or campaign-variant, templates are updated after the switch
+func (s *сampaigns) RollbackLanding(id string) (string, error) {
+	if err := checkLandingId(id); err != nil {
+		return "", err
+	}
+	version, err := s.landings.rollback(id)
+	if err != nil {
+		return "", err
+	}
+	log.WithFields(log.Fields{
+		"id":      id,
+		"version": version,
+	}).Info("landing rolled back")
+	s.webHook()
+	return version, nil
+}
+
+func AddLandingHandlers(e *gin.Engine) {
+	g := e.Group("api")
+	g.GET("/campaign/landing/versions", getLandingVersionsHandler)
+	g.POST("/campaign/landing/rollback", rollbackLandingHandler)
+}
+
+// /api/campaign/landing/versions?id=<campaign id>
+func getLandingVersionsHandler(c *gin.Context) {
+	id := c.Query("id")
+	current, versions, err := Svc.Campaigns.LandingVersions(id)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"id": id, "current": current, "versions": versions})
+}
+
+func rollbackLandingHandler(c *gin.Context) {
+	id := c.Query("id")
+	version, err := Svc.Campaigns.RollbackLanding(id)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"id": id, "current": version})
+}
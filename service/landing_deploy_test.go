@@ -0,0 +1,170 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testLandingZip(t *testing.T, files map[string]string) []byte {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		w.Write([]byte(content))
+	}
+	assert.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func testLandingStore(t *testing.T) (*landingStore, func()) {
+	dir, err := ioutil.TempDir("", "mid_landings")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	ls := newLandingStore(CampaignsConfig{LandingsPath: dir, LandingVersions: 2, LandingMaxSize: 1024})
+	return ls, func() { os.RemoveAll(dir) }
+}
+
+func testLandingContent(ls *landingStore, id, file string) string {
+	content, _ := ioutil.ReadFile(filepath.Join(ls.linkPath(id), file))
+	return string(content)
+}
+
+func TestLandingDeployRollback(t *testing.T) {
+	ls, cleanup := testLandingStore(t)
+	defer cleanup()
+
+	var deployed []string
+	for i, content := range []string{"v1", "v2", "v3"} {
+		buff := testLandingZip(t, map[string]string{
+			"index.html":   content,
+			"img/logo.png": "png",
+		})
+		version, err := ls.deploy("camp", buff, "camp.html", newManifest("xmp-lp", fmt.Sprintf("lp%d", i+1), buff))
+		assert.NoError(t, err, "deploy "+content)
+		assert.Equal(t, content, testLandingContent(ls, "camp", "camp.html"), "switched to "+content)
+		assert.Equal(t, "png", testLandingContent(ls, "camp", "img/logo.png"), "assets of "+content)
+		deployed = append(deployed, version)
+		time.Sleep(time.Millisecond)
+	}
+	mf, err := ls.verify("camp")
+	assert.NoError(t, err, "files of the current version")
+	assert.Equal(t, "lp3", mf.Key, "manifest of the current version")
+
+	current, versions, err := ls.versions("camp")
+	assert.NoError(t, err)
+	assert.Equal(t, deployed[2], current, "current version")
+	assert.Equal(t, deployed[1:], versions, "the last versions are kept")
+
+	version, err := ls.rollback("camp")
+	assert.NoError(t, err)
+	assert.Equal(t, deployed[1], version, "previous version")
+	assert.Equal(t, "v2", testLandingContent(ls, "camp", "camp.html"), "rolled back")
+
+	_, err = ls.rollback("camp")
+	assert.Error(t, err, "no more versions")
+}
+
+func TestLandingDeployValidate(t *testing.T) {
+	ls, cleanup := testLandingStore(t)
+	defer cleanup()
+
+	_, err := ls.deploy("camp", testLandingZip(t, map[string]string{"index.html": "ok"}), "camp.html", newManifest("", "", nil))
+	assert.NoError(t, err)
+
+	for name, files := range map[string]map[string]string{
+		"no index":       {"main.html": "x"},
+		"path traversal": {"index.html": "x", "../../evil.html": "x"},
+		"absolute path":  {"index.html": "x", "/etc/evil": "x"},
+		"too big":        {"index.html": string(make([]byte, 2048))},
+	} {
+		_, err := ls.deploy("camp", testLandingZip(t, files), "camp.html", newManifest("", "", nil))
+		assert.Error(t, err, name)
+	}
+	_, err = ls.deploy("camp", []byte("not a zip"), "camp.html", newManifest("", "", nil))
+	assert.Error(t, err, "not a zip")
+
+	assert.Equal(t, "ok", testLandingContent(ls, "camp", "camp.html"), "current landing is kept")
+	_, versions, _ := ls.versions("camp")
+	assert.Equal(t, 1, len(versions), "failed versions are removed")
+	_, err = os.Stat(filepath.Join(ls.path, "evil.html"))
+	assert.True(t, os.IsNotExist(err), "nothing is written outside")
+}
+
+func TestLandingDeployLegacy(t *testing.T) {
+	ls, cleanup := testLandingStore(t)
+	defer cleanup()
+
+	assert.NoError(t, os.MkdirAll(ls.linkPath("camp"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(ls.linkPath("camp"), "camp.html"), []byte("old"), 0644))
+
+	_, err := ls.deploy("camp", testLandingZip(t, map[string]string{"index.html": "new"}), "camp.html", newManifest("", "", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "new", testLandingContent(ls, "camp", "camp.html"))
+
+	_, err = ls.rollback("camp")
+	assert.NoError(t, err, "landing unpacked before versions")
+	assert.Equal(t, "old", testLandingContent(ls, "camp", "camp.html"))
+}
+
+func TestLandingDeployLockById(t *testing.T) {
+	ls, cleanup := testLandingStore(t)
+	defer cleanup()
+
+	unlock := ls.lock("camp-1")
+	done := make(chan error, 1)
+	go func() {
+		_, err := ls.deploy("camp-2", testLandingZip(t, map[string]string{"index.html": "2"}), "camp-2.html", newManifest("", "", nil))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err, "other landing is deployed")
+	case <-time.After(5 * time.Second):
+		t.Fatal("other landing waits for the lock")
+	}
+	unlock()
+	assert.Equal(t, "2", testLandingContent(ls, "camp-2", "camp-2.html"))
+}
+
+func TestCheckLandingId(t *testing.T) {
+	assert.NoError(t, checkLandingId("camp-1"))
+	for _, id := range []string{"", ".", "..", "../camp", "a/b"} {
+		assert.Error(t, checkLandingId(id), id)
+	}
+}
+
+func TestLandingVerify(t *testing.T) {
+	ls, cleanup := testLandingStore(t)
+	defer cleanup()
+
+	_, err := ls.verify("camp")
+	assert.Equal(t, errLandingNotDeployed, err, "not deployed")
+
+	buff := testLandingZip(t, map[string]string{"index.html": "ok", "img/logo.png": "png"})
+	_, err = ls.deploy("camp", buff, "camp.html", newManifest("xmp-lp", "lp", buff))
+	assert.NoError(t, err)
+	mf, err := ls.verify("camp")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(mf.Files), "files of the landing")
+	assert.Equal(t, 32, len(mf.ETag), "md5 of the object")
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(ls.linkPath("camp"), "camp.html"), []byte("changed"), 0644))
+	_, err = ls.verify("camp")
+	assert.Error(t, err, "changed file")
+
+	assert.NoError(t, os.RemoveAll(filepath.Join(ls.linkPath("camp"), "img")))
+	_, err = ls.verify("camp")
+	assert.Error(t, err, "missing file")
+}
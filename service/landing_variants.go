@@ -0,0 +1,195 @@
+package service
+
+// a/b testing of landing pages: a campaign could have several landings with weights,
+// every variant is downloaded separately, the variant is chosen by msisdn or cookie
+import (
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+type LandingVariants struct {
+	sync.RWMutex
+	ByCampaign map[string][]LandingVariant // downloaded ones
+	loaded     map[string]LandingVariant   // by landing id, of the last reload
+}
+
+type LandingVariant struct {
+	Id         string `json:"id"`
+	CampaignId string `json:"id_campaign"`
+	Lp         string `json:"lp"`
+	Weight     int    `json:"weight"`
+}
+
+// directory of the landing, next to the campaign landing
+func (v LandingVariant) landingId() string {
+	return v.CampaignId + "-" + v.Id
+}
+
+func (v LandingVariant) templateName() string {
+	return v.landingId() + ".html"
+}
+
+// variants which are downloaded, nil if the campaign has only its own landing
+func (lv *LandingVariants) Get(campaignId string) []LandingVariant {
+	if lv == nil {
+		return nil
+	}
+	lv.RLock()
+	defer lv.RUnlock()
+	return lv.ByCampaign[campaignId]
+}
+
+func (lv *LandingVariants) Reload() error {
+	query := fmt.Sprintf("SELECT "+
+		"id, "+
+		"id_campaign, "+
+		"lp, "+
+		"weight "+
+		"FROM %scampaign_landings "+
+		"WHERE weight > 0 "+
+		"ORDER BY id",
+		Svc.dbConf.TablePrefix)
+	var err error
+	var rows *sql.Rows
+	rows, err = Svc.db.Query(query)
+	if err != nil {
+		err = fmt.Errorf("db.Query: %s, query: %s", err.Error(), query)
+		return err
+	}
+	defer rows.Close()
+
+	var variants []LandingVariant
+	for rows.Next() {
+		var v LandingVariant
+		if err = rows.Scan(
+			&v.Id,
+			&v.CampaignId,
+			&v.Lp,
+			&v.Weight,
+		); err != nil {
+			err = fmt.Errorf("rows.Scan: %s", err.Error())
+			return err
+		}
+		variants = append(variants, v)
+	}
+	if rows.Err() != nil {
+		err = fmt.Errorf("rows.Err: %s", rows.Err().Error())
+		return err
+	}
+
+	// variant which isn't downloaded is never chosen,
+	// the reload does not wait for downloads, variants are added when they are deployed
+	byCampaign := make(map[string][]LandingVariant)
+	loaded := make(map[string]LandingVariant, len(variants))
+	var missing []LandingVariant
+	for _, v := range variants {
+		loaded[v.landingId()] = v
+		if !Svc.Campaigns.VariantDeployed(v) {
+			missing = append(missing, v)
+			continue
+		}
+		byCampaign[v.CampaignId] = append(byCampaign[v.CampaignId], v)
+	}
+	for _, campaignVariants := range byCampaign {
+		sortLandingVariants(campaignVariants)
+	}
+	lv.Lock()
+	lv.ByCampaign = byCampaign
+	lv.loaded = loaded
+	lv.Unlock()
+	Svc.Campaigns.DownloadVariants(missing, lv.deployed)
+	log.WithFields(log.Fields{
+		"count":       len(variants),
+		"downloading": len(missing),
+	}).Debug("landing variants")
+	return nil
+}
+
+// variant which is not in the last reload or is already there is skipped,
+// slices are not changed in place, they are shared with campaigns
+func (lv *LandingVariants) deployed(v LandingVariant) {
+	lv.Lock()
+	defer lv.Unlock()
+	if current, ok := lv.loaded[v.landingId()]; !ok || current != v {
+		return
+	}
+	for _, existing := range lv.ByCampaign[v.CampaignId] {
+		if existing.Id == v.Id {
+			return
+		}
+	}
+	if lv.ByCampaign == nil {
+		lv.ByCampaign = make(map[string][]LandingVariant)
+	}
+	variants := append(append([]LandingVariant(nil), lv.ByCampaign[v.CampaignId]...), v)
+	sortLandingVariants(variants)
+	lv.ByCampaign[v.CampaignId] = variants
+}
+
+// the variant is chosen by its place, so the order must not depend on reloads or downloads,
+// numeric ids are ordered as numbers
+func sortLandingVariants(variants []LandingVariant) {
+	sort.Slice(variants, func(i, j int) bool {
+		if len(variants[i].Id) != len(variants[j].Id) {
+			return len(variants[i].Id) < len(variants[j].Id)
+		}
+		return variants[i].Id < variants[j].Id
+	})
+}
+
+// the same msisdn or cookie always gets the same variant while weights are the same
+// empty key (no msisdn, no cookie) gets a random one
+// returns empty string if the campaign has no variants
+func (camp *Campaign) ChooseVariant(key string) string {
+	total := 0
+	for _, v := range camp.Variants {
+		total = total + v.Weight
+	}
+	if total <= 0 {
+		return ""
+	}
+
+	var point int
+	if key == "" {
+		point = rand.Intn(total)
+	} else {
+		h := fnv.New32a()
+		h.Write([]byte(camp.Id + ":" + key))
+		point = int(h.Sum32() % uint32(total))
+	}
+	for _, v := range camp.Variants {
+		if point < v.Weight {
+			return v.Id
+		}
+		point = point - v.Weight
+	}
+	return ""
+}
+
+// serves the landing of the variant, the campaign landing if variant is empty or unknown
+func (camp *Campaign) VariantServe(c *gin.Context, variantId string, data interface{}) {
+	for _, v := range camp.Variants {
+		if v.Id != variantId {
+			continue
+		}
+		camp.NextAutoClick()
+		log.WithFields(log.Fields{
+			"id":        camp.Id,
+			"variant":   variantId,
+			"autoclick": camp.CanAutoClick,
+		}).Debug("serve variant")
+
+		c.Writer.Header().Set("Content-Type", "text/html; charset-utf-8")
+		c.HTML(http.StatusOK, v.templateName(), data)
+		return
+	}
+	camp.SimpleServe(c, data)
+}
@@ -0,0 +1,75 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChooseVariant(t *testing.T) {
+	camp := &Campaign{}
+	camp.Id = testCampaignUUID
+	assert.Equal(t, "", camp.ChooseVariant("923001234567"), "no variants")
+
+	camp.Variants = []LandingVariant{
+		{Id: "a", CampaignId: testCampaignUUID, Weight: 3},
+		{Id: "b", CampaignId: testCampaignUUID, Weight: 1},
+	}
+	chosen := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		key := fmt.Sprintf("92300%07d", i)
+		variant := camp.ChooseVariant(key)
+		assert.Equal(t, variant, camp.ChooseVariant(key), "deterministic "+key)
+		chosen[variant]++
+	}
+	assert.Equal(t, 2, len(chosen), "only known variants")
+	assert.InDelta(t, 3000, chosen["a"], 200, "weight 3")
+	assert.InDelta(t, 1000, chosen["b"], 200, "weight 1")
+
+	assert.NotEqual(t, "", camp.ChooseVariant(""), "random for empty key")
+}
+
+func TestReportKey(t *testing.T) {
+	r := Collect{CampaignUUID: testCampaignUUID}
+	campaignUUID, variant := splitReportKey(r.reportKey())
+	assert.Equal(t, testCampaignUUID, campaignUUID)
+	assert.Equal(t, "", variant)
+
+	r.LandingVariant = "b"
+	campaignUUID, variant = splitReportKey(r.reportKey())
+	assert.Equal(t, testCampaignUUID, campaignUUID)
+	assert.Equal(t, "b", variant)
+}
+
+func TestLandingVariantsDeployed(t *testing.T) {
+	a := LandingVariant{Id: "a", CampaignId: testCampaignUUID, Lp: "a.zip", Weight: 1}
+	b := LandingVariant{Id: "b", CampaignId: testCampaignUUID, Lp: "b.zip", Weight: 1}
+	lv := &LandingVariants{
+		ByCampaign: map[string][]LandingVariant{testCampaignUUID: {a}},
+		loaded:     map[string]LandingVariant{a.landingId(): a, b.landingId(): b},
+	}
+	shared := lv.Get(testCampaignUUID)
+
+	lv.deployed(b)
+	lv.deployed(b)
+	assert.Equal(t, []LandingVariant{a, b}, lv.Get(testCampaignUUID), "added once")
+	assert.Equal(t, []LandingVariant{a}, shared, "not changed in place")
+
+	old := b
+	old.Lp = "b-old.zip"
+	lv.ByCampaign[testCampaignUUID] = []LandingVariant{a}
+	lv.deployed(old)
+	lv.deployed(LandingVariant{Id: "c", CampaignId: testCampaignUUID})
+	assert.Equal(t, []LandingVariant{a}, lv.Get(testCampaignUUID), "not of the last reload")
+}
+
+func TestLandingVariantsOrder(t *testing.T) {
+	v9 := LandingVariant{Id: "9", CampaignId: testCampaignUUID, Lp: "9.zip", Weight: 1}
+	v10 := LandingVariant{Id: "10", CampaignId: testCampaignUUID, Lp: "10.zip", Weight: 1}
+	lv := &LandingVariants{loaded: map[string]LandingVariant{v9.landingId(): v9, v10.landingId(): v10}}
+
+	lv.deployed(v10)
+	lv.deployed(v9)
+	assert.Equal(t, []LandingVariant{v9, v10}, lv.Get(testCampaignUUID), "by id, not by the download order")
+}
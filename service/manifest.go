@@ -0,0 +1,167 @@
+package service
+
+// manifest of a downloaded object: etag of the object and checksum of every unpacked file,
+// object is downloaded again if its files are missing or changed or the object is changed in the store
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type Manifest struct {
+	Bucket       string            `json:"bucket"`
+	Key          string            `json:"key"`
+	ETag         string            `json:"etag"`  // etag of the store or md5 of the object
+	Files        map[string]string `json:"files"` // path relative to the root -> sha256
+	DownloadedAt time.Time         `json:"downloaded_at"`
+}
+
+func newManifest(bucket, key string, buff []byte) Manifest {
+	sum := md5.Sum(buff)
+	return Manifest{
+		Bucket:       bucket,
+		Key:          key,
+		ETag:         hex.EncodeToString(sum[:]),
+		Files:        make(map[string]string),
+		DownloadedAt: time.Now().UTC(),
+	}
+}
+
+// etag of the store is taken before the download: if the object is changed meanwhile,
+// the manifest has the old etag and the object is downloaded again,
+// taken after the download it could keep the new etag with the old files for good
+func storeETag(store ObjectStore, bucket, key string) string {
+	etag, err := store.ETag(bucket, key)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"bucket": bucket,
+			"key":    key,
+			"error":  err.Error(),
+		}).Warn("cannot get etag")
+		return ""
+	}
+	return etag
+}
+
+// etag of the store is kept if the store could tell it, md5 of the object otherwise
+func downloadedManifest(bucket, key, etag string, buff []byte) Manifest {
+	mf := newManifest(bucket, key, buff)
+	if etag != "" {
+		mf.ETag = etag
+	}
+	return mf
+}
+
+// the object in the store is changed since the download,
+// false if the store cannot tell it
+func (mf Manifest) changed(store ObjectStore) bool {
+	etag, err := store.ETag(mf.Bucket, mf.Key)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"bucket": mf.Bucket,
+			"key":    mf.Key,
+			"error":  err.Error(),
+		}).Warn("cannot get etag")
+		return false
+	}
+	return etag != "" && etag != mf.ETag
+}
+
+// files of the zip, without directories
+func zipFileNames(buff []byte) ([]string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(buff), int64(len(buff)))
+	if err != nil {
+		return nil, fmt.Errorf("zip.NewReader: %s", err.Error())
+	}
+	var names []string
+	for _, f := range zr.File {
+		if !f.FileInfo().IsDir() {
+			names = append(names, path.Clean(f.Name))
+		}
+	}
+	return names, nil
+}
+
+func fileChecksum(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checksums of the files are taken from the disk after unpack
+func (mf *Manifest) addFiles(root string, names []string) error {
+	for _, name := range names {
+		sum, err := fileChecksum(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil {
+			return fmt.Errorf("checksum: %s", err.Error())
+		}
+		mf.Files[name] = sum
+	}
+	return nil
+}
+
+// the first missing or changed file
+func (mf Manifest) verify(root string) error {
+	for name, expected := range mf.Files {
+		sum, err := fileChecksum(filepath.Join(root, filepath.FromSlash(name)))
+		if os.IsNotExist(err) {
+			return fmt.Errorf("missing file: %s", name)
+		}
+		if err != nil {
+			return fmt.Errorf("checksum: %s: %s", name, err.Error())
+		}
+		if sum != expected {
+			return fmt.Errorf("changed file: %s", name)
+		}
+	}
+	return nil
+}
+
+func writeManifest(filePath string, mf Manifest) error {
+	mfJson, err := json.Marshal(mf)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %s", err.Error())
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return fmt.Errorf("os.MkdirAll: %s", err.Error())
+	}
+	tmpPath := filePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, mfJson, 0644); err != nil {
+		return fmt.Errorf("ioutil.WriteFile: %s", err.Error())
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return fmt.Errorf("os.Rename: %s", err.Error())
+	}
+	return nil
+}
+
+func readManifest(filePath string) (Manifest, error) {
+	var mf Manifest
+	mfJson, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return mf, fmt.Errorf("ioutil.ReadFile: %s", err.Error())
+	}
+	if err := json.Unmarshal(mfJson, &mf); err != nil {
+		return mf, fmt.Errorf("json.Unmarshal: %s", err.Error())
+	}
+	return mf, nil
+}
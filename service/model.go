@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -34,10 +35,11 @@ type MemService struct {
 	cqrConfig          []cqr.CQRConfig
 	m                  *serviceMetrics
 	dbConf             db.DataBaseConfig
-	downloader         aws.S3
+	downloader         ObjectStore
 	conf               Config
 	xmpAPIConf         xmp_api.ClientConfig
 	reporter           Collector
+	deadLetters        *deadLetters
 	Campaigns          Campaigns
 	Services           Services
 	Contents           Contents
@@ -48,6 +50,13 @@ type MemService struct {
 	PixelSettings      PixelSettings
 	Publishers         *Publishers
 	KeyWords           *KeyWords
+	CampaignSchedules  *CampaignSchedules
+	LandingVariants    *LandingVariants
+	CampaignCaps       *CampaignCaps
+	CampaignRoutes     *CampaignRoutes
+	ServicePrices      *ServicePrices
+	RatioCounters      *RatioCounters
+	History            *History
 	RejectedByCampaign *cache.Cache
 	RejectedByService  *cache.Cache
 	UniqueUrls         *UniqueUrls
@@ -56,7 +65,8 @@ type MemService struct {
 }
 
 type Config struct {
-	CountryName   string              `yaml:"country_name"` // get them from control panel, otherwise from config
+	CountryName   string              `yaml:"country_name"`            // get them from control panel, otherwise from config
+	TimeZone      string              `yaml:"time_zone" default:"UTC"` // of the country, for campaign schedules, caps and charging
 	StateFilePath string              `yaml:"state_file_path"`
 	UniqueDays    int                 `yaml:"unique_days" default:"10"`
 	StaticPath    string              `yaml:"static_path" default:""`
@@ -65,10 +75,51 @@ type Config struct {
 	Services      ServicesConfig      `yaml:"service"`
 	Campaigns     CampaignsConfig     `yaml:"campaign"`
 	Contents      ContentConfig       `yaml:"content"`
+	SentContents  SentContentsConfig  `yaml:"sent_contents"`
 	BlackList     BlackListConfig     `yaml:"blacklist"`
 	Pixel         PixelSettingsConfig `yaml:"pixel"`
 	Operator      OperatorsConfig     `yaml:"operator"`
+	Publisher     PublishersConfig    `yaml:"publisher"`
+	History       HistoryConfig       `yaml:"history"`
 	Enabled       EnabledConfig       `yaml:"enabled"`
+
+	TransactionResults TransactionResultsConfig `yaml:"transaction_results"`
+	Sinks              SinksConfig              `yaml:"sinks"`
+	AggregateTables    AggregateTablesConfig    `yaml:"aggregate_tables"`
+	Currency           string                   `yaml:"currency"`                     // ISO 4217 code of the prices
+	PriceUnit          string                   `yaml:"price_unit" default:"cents"`   // cents or units
+	ReporterShards     int                      `yaml:"reporter_shards" default:"16"` // counters are locked by shards of campaigns
+	RatiosFilePath     string                   `yaml:"ratios_file_path"`             // autoclick and pixel counters, empty - not saved
+	ObjectStores       ObjectStoresConfig       `yaml:"object_stores"`                // by bucket
+	Downloads          DownloadsConfig          `yaml:"downloads"`
+}
+
+// tables for aggregate api, each must have sent_at, id_campaign and operator_code columns
+// table prefix is added unless the name has schema, empty name disables the counter,
+// all are disabled unless configured (see dev/mid.yml)
+type AggregateTablesConfig struct {
+	Unsubscribes string `yaml:"unsubscribes"`
+	Content      string `yaml:"content"`
+	SMS          string `yaml:"sms"`
+	Redirects    string `yaml:"redirects"`
+	// columns with the landing variant, hits and transactions are split by landing variants only if both are set
+	HitsVariant         string `yaml:"hits_variant"`         // of campaigns_access
+	TransactionsVariant string `yaml:"transactions_variant"` // of transactions
+}
+
+// sql expressions of the landing variant of hits and transactions, empty strings if not split
+func (atc AggregateTablesConfig) variants() (string, string) {
+	if atc.HitsVariant == "" || atc.TransactionsVariant == "" {
+		return "''", "''"
+	}
+	return "COALESCE(" + atc.HitsVariant + ", '')", "COALESCE(" + atc.TransactionsVariant + ", '')"
+}
+
+func (atc AggregateTablesConfig) name(table string) string {
+	if table == "" || strings.Contains(table, ".") {
+		return table
+	}
+	return Svc.dbConf.TablePrefix + table
 }
 
 type QueuesConfig struct {
@@ -76,6 +127,11 @@ type QueuesConfig struct {
 	ReporterTransaction qconf.ConsumeQueueConfig `yaml:"reporter_transaction"`
 	ReporterPixel       qconf.ConsumeQueueConfig `yaml:"reporter_pixel"`
 	ReporterOutflow     qconf.ConsumeQueueConfig `yaml:"reporter_outflow"`
+	ReporterUnsubscribe qconf.ConsumeQueueConfig `yaml:"reporter_unsubscribe"`
+	ReporterContent     qconf.ConsumeQueueConfig `yaml:"reporter_content"`
+	ReporterSMS         qconf.ConsumeQueueConfig `yaml:"reporter_sms"`
+	ReporterRedirect    qconf.ConsumeQueueConfig `yaml:"reporter_redirect"`
+	DeadLetter          DeadLetterConfig         `yaml:"dead_letter"`
 }
 
 type EnabledConfig struct {
@@ -95,13 +151,11 @@ type EnabledConfig struct {
 	Destinations       bool `yaml:"destinations"`
 	RedirectStatCounts bool `yaml:"redirect_stats_count"`
 	Reporter           bool `yaml:"reporter"`
-}
-
-type Consumers struct {
-	Hit         *amqp.Consumer `yaml:"hit"`
-	Transaction *amqp.Consumer `yaml:"transaction"`
-	Pixel       *amqp.Consumer `yaml:"pixel"`
-	Outflow     *amqp.Consumer `yaml:"outflow"`
+	CampaignSchedules  bool `yaml:"campaign_schedules"`
+	LandingVariants    bool `yaml:"landing_variants"`
+	CampaignCaps       bool `yaml:"campaign_caps"`
+	CampaignRoutes     bool `yaml:"campaign_routes"`
+	ServicePrices      bool `yaml:"service_prices"` // reporter counts effective prices of events without price
 }
 
 func Init(
@@ -123,22 +177,37 @@ func Init(
 	Svc.dbConf = dbConf
 	Svc.conf = svcConf
 	Svc.xmpAPIConf = xmpAPIConf
-	Svc.downloader = aws.New(awsConfig)
+	downloader, err := initObjectStores(awsConfig, svcConf.Region, svcConf.ObjectStores)
+	if err != nil {
+		log.WithField("error", err.Error()).Fatal("cannot init object stores")
+	}
+	Svc.downloader = newDownloadManager(
+		downloader,
+		awsConfig.DownloadConcurrency,
+		svcConf.Downloads.Retries,
+		time.Duration(svcConf.Downloads.Backoff)*time.Second,
+		initDownloadMetrics(appName),
+	)
 
 	initPrevSubscriptionsCache()
 
-	Svc.reporter = initReporter(appName, svcConf.StateFilePath, svcConf.Queue, consumerConf)
-
+	Svc.History = initHistory(svcConf.History)
 	Svc.Campaigns = initCampaigns(appName, svcConf.Campaigns)
-	Svc.Services = initServices(appName, svcConf.Services)
+	Svc.Services = initServices(appName, svcConf.Services, svcConf.TimeZone)
 	Svc.Contents = initContents(appName, svcConf.Contents)
 	Svc.PixelSettings = initPixelSettings(appName, svcConf.Pixel)
-	Svc.SentContents = &SentContents{}
+	Svc.SentContents = initSentContents(appName, svcConf.Contents.Rotation, svcConf.SentContents)
 	Svc.Operators = initOperators(appName, svcConf.Operator)
 	Svc.BlackList = initBlackList(appName, svcConf.BlackList)
 	Svc.PostPaid = &PostPaid{}
-	Svc.Publishers = &Publishers{}
+	Svc.Publishers = initPublishers(appName, svcConf.Publisher)
 	Svc.KeyWords = &KeyWords{}
+	Svc.CampaignSchedules = initCampaignSchedules(svcConf.TimeZone)
+	Svc.LandingVariants = &LandingVariants{}
+	Svc.CampaignCaps = initCampaignCaps(appName, svcConf.TimeZone)
+	Svc.CampaignRoutes = initCampaignRoutes(appName)
+	Svc.ServicePrices = &ServicePrices{}
+	Svc.RatioCounters = initRatioCounters(svcConf.RatiosFilePath)
 	Svc.UniqueUrls = &UniqueUrls{}
 	Svc.Destinations = &Destinations{}
 	Svc.RedirectStatCounts = &RedirectStatCounts{}
@@ -161,6 +230,32 @@ func Init(
 			WebHook: Svc.conf.Campaigns.WebHook,
 			Enabled: Svc.conf.Enabled.Campaigns, // always enabled
 		},
+		{
+			Tables:  []string{"campaign_schedules"},
+			Data:    Svc.CampaignSchedules,
+			Enabled: Svc.conf.Enabled.CampaignSchedules,
+		},
+		{
+			Tables:  []string{"campaign_landings"},
+			Data:    Svc.LandingVariants,
+			WebHook: Svc.conf.Campaigns.WebHook,
+			Enabled: Svc.conf.Enabled.LandingVariants,
+		},
+		{
+			Tables:  []string{"campaign_caps"},
+			Data:    Svc.CampaignCaps,
+			Enabled: Svc.conf.Enabled.CampaignCaps,
+		},
+		{
+			Tables:  []string{"campaign_routes"},
+			Data:    Svc.CampaignRoutes,
+			Enabled: Svc.conf.Enabled.CampaignRoutes,
+		},
+		{
+			Tables:  []string{"service_prices"},
+			Data:    Svc.ServicePrices,
+			Enabled: Svc.conf.Enabled.ServicePrices,
+		},
 		{
 			Tables:  []string{"content"},
 			Data:    Svc.Contents,
@@ -217,6 +312,11 @@ func Init(
 		log.Info("cqr.InitCQR: " + err.Error())
 	}
 
+	// consumers are started after the first load of the tables:
+	// events use campaigns, schedules, caps, services and prices
+	Svc.deadLetters = initDeadLetters(appName, svcConf.Queue.DeadLetter, consumerConf)
+	Svc.reporter = initReporter(appName, svcConf, consumerConf)
+
 	if xmpAPIConf.Enabled {
 		var xmpConfig xmp_api_structs.HandShake
 		log.Debug("xmp_api.Call..")
@@ -280,6 +380,11 @@ func Init(
 
 func OnExit() {
 	Svc.reporter.SaveState()
+	if err := Svc.RatioCounters.Save(); err != nil {
+		log.WithField("error", err.Error()).Error("cannot save ratio counters")
+	}
+	Svc.History.Close()
+	Svc.SentContents.Close()
 }
 
 func AddTablesHandler(r *gin.Engine) {
@@ -367,36 +472,43 @@ func getStatus(c *gin.Context) {
 	}
 }
 
+// /api/aggregate/get?from=2017-01-01&to=2017-02-01
+// optional: campaign, service, operator, group_by, tz, format (json, csv, xlsx), limit, offset
 func getAggregateHandler(c *gin.Context) {
-
-	fromTimeString, ok := c.GetQuery("from")
-	if !ok {
-		c.JSON(500, gin.H{"error": "From bound required (time from to)"})
-		return
-	}
-	from, err := time.Parse("2006-01-02", fromTimeString)
+	f, err := parseAggregateFilter(c)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Error parse time: " + err.Error()})
+		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
-	toTimeString, ok := c.GetQuery("to")
-	if !ok {
-		c.JSON(500, gin.H{"error": "To bound required (time from to)"})
-		return
-	}
-	to, err := time.Parse("2006-01-02", toTimeString)
+
+	res, err := Svc.reporter.GetAggregate(f)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Error parse time: " + err.Error()})
+		c.JSON(500, gin.H{"error": "Error while get aggregate: " + err.Error()})
 		return
 	}
+	sortAggregates(res)
+	c.Writer.Header().Set("X-Total-Count", strconv.Itoa(len(res)))
 
-	res, err := Svc.reporter.GetAggregate(from, to)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Error while get aggregate: " + err.Error()})
+	if res, err = paginateAggregates(c, res); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(200, res)
+	switch format := c.DefaultQuery("format", "json"); format {
+	case "json":
+		c.JSON(200, res)
+	case "csv":
+		err = writeAggregateCSV(c, f, res)
+	case "xlsx":
+		err = writeAggregateXLSX(c, f, res)
+	default:
+		c.JSON(500, gin.H{"error": "Unknown format: " + format})
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("cannot write aggregate")
+	}
 }
 
 func tablesHandler(c *gin.Context) {
@@ -0,0 +1,295 @@
+package service
+
+// storage of landings, content and blacklists, chosen by bucket:
+// s3, s3 compatible (minio and others with custom endpoint) and local directory
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	log "github.com/sirupsen/logrus"
+
+	aws_utils "github.com/linkit360/go-utils/aws"
+)
+
+const (
+	ObjectStoreS3    = "s3"
+	ObjectStoreLocal = "local"
+)
+
+type ObjectStore interface {
+	Download(bucket, key string) ([]byte, int64, error)
+	// empty etag - the store cannot tell it
+	ETag(bucket, key string) (string, error)
+}
+
+// the object is not in the store, the download is not retried
+type objectNotFoundError struct {
+	bucket string
+	key    string
+}
+
+func (e objectNotFoundError) Error() string {
+	return fmt.Sprintf("object not found: %s/%s", e.bucket, e.key)
+}
+
+func isObjectNotFound(err error) bool {
+	_, ok := err.(objectNotFoundError)
+	return ok
+}
+
+// s3 answers NoSuchKey to get and NotFound to head requests
+func s3NotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, s3.ErrCodeNoSuchBucket, "NotFound":
+			return true
+		}
+	}
+	return false
+}
+
+// buckets which are not in the config are downloaded with aws config of the app
+type ObjectStoresConfig map[string]ObjectStoreConfig
+
+type ObjectStoreConfig struct {
+	Type            string `yaml:"type" default:"s3"` // s3 or local
+	Endpoint        string `yaml:"endpoint"`          // s3 compatible storage, empty - aws
+	Region          string `yaml:"region"`
+	AccessKeyId     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	PathStyle       bool   `yaml:"path_style"`            // http://endpoint/bucket/key, minio needs it
+	Timeout         int    `yaml:"timeout" default:"120"` // seconds
+	Path            string `yaml:"path"`                  // local: objects are in path/bucket/key
+	Bucket          string `yaml:"bucket"`                // name of the bucket in the store, if it is not the same
+}
+
+type objectStores struct {
+	byBucket map[string]ObjectStore
+	names    map[string]string
+	fallback ObjectStore
+}
+
+// region of the app is used if the store has none
+func initObjectStores(awsConfig aws_utils.Config, region string, conf ObjectStoresConfig) (ObjectStore, error) {
+	fallback, err := newAWSUtilsStore(awsConfig, region)
+	if err != nil {
+		return nil, fmt.Errorf("aws: %s", err.Error())
+	}
+	stores := &objectStores{
+		byBucket: make(map[string]ObjectStore, len(conf)),
+		names:    make(map[string]string, len(conf)),
+		fallback: fallback,
+	}
+	for bucket, storeConf := range conf {
+		if storeConf.Region == "" {
+			storeConf.Region = region
+		}
+		store, err := newObjectStore(storeConf)
+		if err != nil {
+			return nil, fmt.Errorf("bucket %s: %s", bucket, err.Error())
+		}
+		stores.byBucket[bucket] = store
+		if storeConf.Bucket != "" {
+			stores.names[bucket] = storeConf.Bucket
+		}
+		log.WithFields(log.Fields{
+			"bucket":   bucket,
+			"type":     storeConf.Type,
+			"endpoint": storeConf.Endpoint,
+			"path":     storeConf.Path,
+		}).Info("object store")
+	}
+	return stores, nil
+}
+
+func newObjectStore(conf ObjectStoreConfig) (ObjectStore, error) {
+	switch conf.Type {
+	case ObjectStoreS3, "":
+		return newS3Store(conf)
+	case ObjectStoreLocal:
+		if conf.Path == "" {
+			return nil, fmt.Errorf("empty path of local store%s", "")
+		}
+		return localStore{path: conf.Path}, nil
+	default:
+		return nil, fmt.Errorf("unknown object store type: %s", conf.Type)
+	}
+}
+
+func (ss *objectStores) get(bucket string) (ObjectStore, string) {
+	name := bucket
+	if n, ok := ss.names[bucket]; ok {
+		name = n
+	}
+	if store, ok := ss.byBucket[bucket]; ok {
+		return store, name
+	}
+	return ss.fallback, name
+}
+
+func (ss *objectStores) Download(bucket, key string) ([]byte, int64, error) {
+	store, name := ss.get(bucket)
+	return store.Download(name, key)
+}
+
+func (ss *objectStores) ETag(bucket, key string) (string, error) {
+	store, name := ss.get(bucket)
+	return store.ETag(name, key)
+}
+
+// aws config of the app, as before the object stores,
+// go-utils has no head request, so etags are taken by the s3 client with the same config
+type awsUtilsStore struct {
+	s3   aws_utils.S3
+	head *s3Store
+}
+
+func newAWSUtilsStore(awsConfig aws_utils.Config, region string) (awsUtilsStore, error) {
+	if awsConfig.Region != "" {
+		region = awsConfig.Region
+	}
+	head, err := newS3Store(ObjectStoreConfig{
+		Region:          region,
+		AccessKeyId:     awsConfig.AccessKeyId,
+		SecretAccessKey: awsConfig.SecretAccessKey,
+		Timeout:         int(awsConfig.DownloadTimeout.Seconds()),
+	})
+	if err != nil {
+		return awsUtilsStore{}, err
+	}
+	return awsUtilsStore{s3: aws_utils.New(awsConfig), head: head}, nil
+}
+
+// go-utils tells only the text of the error
+func (s awsUtilsStore) Download(bucket, key string) ([]byte, int64, error) {
+	buff, size, err := s.s3.Download(bucket, key)
+	if err != nil && (strings.Contains(err.Error(), s3.ErrCodeNoSuchKey) || strings.Contains(err.Error(), s3.ErrCodeNoSuchBucket)) {
+		return nil, 0, objectNotFoundError{bucket: bucket, key: key}
+	}
+	return buff, size, err
+}
+
+func (s awsUtilsStore) ETag(bucket, key string) (string, error) {
+	return s.head.ETag(bucket, key)
+}
+
+type s3Store struct {
+	client  *s3.S3
+	timeout time.Duration
+}
+
+func newS3Store(conf ObjectStoreConfig) (*s3Store, error) {
+	awsConf := aws.NewConfig().WithRegion(conf.Region)
+	if conf.Endpoint != "" {
+		awsConf = awsConf.WithEndpoint(conf.Endpoint).WithS3ForcePathStyle(conf.PathStyle)
+	}
+	if conf.AccessKeyId != "" {
+		awsConf = awsConf.WithCredentials(credentials.NewStaticCredentials(conf.AccessKeyId, conf.SecretAccessKey, ""))
+	}
+	sess, err := session.NewSession(awsConf)
+	if err != nil {
+		return nil, fmt.Errorf("session.NewSession: %s", err.Error())
+	}
+	return &s3Store{
+		client:  s3.New(sess),
+		timeout: time.Duration(conf.Timeout) * time.Second,
+	}, nil
+}
+
+func (s *s3Store) Download(bucket, key string) ([]byte, int64, error) {
+	ctx, cancel := timeoutContext(s.timeout)
+	defer cancel()
+
+	buff := aws.NewWriteAtBuffer([]byte{})
+	size, err := s3manager.NewDownloaderWithClient(s.client).DownloadWithContext(ctx, buff, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if s3NotFound(err) {
+		return nil, 0, objectNotFoundError{bucket: bucket, key: key}
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("s3.Download: %s", err.Error())
+	}
+	return buff.Bytes(), size, nil
+}
+
+func (s *s3Store) ETag(bucket, key string) (string, error) {
+	ctx, cancel := timeoutContext(s.timeout)
+	defer cancel()
+
+	out, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", fmt.Errorf("s3.HeadObject: %s", err.Error())
+	}
+	return strings.Trim(aws.StringValue(out.ETag), `"`), nil
+}
+
+// no timeout if it is zero
+func timeoutContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// objects are files: path/bucket/key
+type localStore struct {
+	path string
+}
+
+// objects out of the path are not allowed
+func (s localStore) filePath(bucket, key string) (string, error) {
+	for _, name := range []string{bucket, key} {
+		if name == "" || strings.Contains(name, "\\") || path.Clean("/"+name) != "/"+name {
+			return "", fmt.Errorf("wrong object name: %s/%s", bucket, key)
+		}
+	}
+	return filepath.Join(s.path, bucket, filepath.FromSlash(key)), nil
+}
+
+func (s localStore) Download(bucket, key string) ([]byte, int64, error) {
+	filePath, err := s.filePath(bucket, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	buff, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil, 0, objectNotFoundError{bucket: bucket, key: key}
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("ioutil.ReadFile: %s", err.Error())
+	}
+	return buff, int64(len(buff)), nil
+}
+
+// md5 of the file, as s3 etag of not multipart upload
+func (s localStore) ETag(bucket, key string) (string, error) {
+	filePath, err := s.filePath(bucket, key)
+	if err != nil {
+		return "", err
+	}
+	buff, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return "", fmt.Errorf("ioutil.ReadFile: %s", err.Error())
+	}
+	sum := md5.Sum(buff)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,179 @@
+package service
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	m "github.com/linkit360/go-utils/metrics"
+	xmp_api_structs "github.com/linkit360/xmp-api/src/structs"
+)
+
+func testLocalStore(t *testing.T) (localStore, func()) {
+	dir, err := ioutil.TempDir("", "mid_objects")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return localStore{path: dir}, func() { os.RemoveAll(dir) }
+}
+
+func testPutObject(t *testing.T, s localStore, bucket, key string, buff []byte) {
+	filePath := filepath.Join(s.path, bucket, key)
+	assert.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755))
+	assert.NoError(t, ioutil.WriteFile(filePath, buff, 0644))
+}
+
+func TestLocalStore(t *testing.T) {
+	s, cleanup := testLocalStore(t)
+	defer cleanup()
+	testPutObject(t, s, "xmp-lp", "lp/1.zip", []byte("zip"))
+
+	buff, size, err := s.Download("xmp-lp", "lp/1.zip")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("zip"), buff)
+	assert.Equal(t, int64(3), size)
+
+	etag, err := s.ETag("xmp-lp", "lp/1.zip")
+	assert.NoError(t, err)
+	assert.Equal(t, newManifest("", "", []byte("zip")).ETag, etag, "md5 of the file")
+
+	_, _, err = s.Download("xmp-lp", "lp/2.zip")
+	assert.True(t, isObjectNotFound(err), "not found")
+	for _, key := range []string{"", "../xmp-lp/lp/1.zip", "lp/../../1.zip", "/lp/1.zip"} {
+		_, _, err = s.Download("xmp-lp", key)
+		assert.Error(t, err, "wrong key "+key)
+	}
+}
+
+func TestS3StoreETag(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" || r.URL.Path != "/xmp-lp/lp/1.zip" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", `"9a0364b9e99bb480dd25e1f0284c8555"`)
+	}))
+	defer srv.Close()
+
+	s, err := newS3Store(ObjectStoreConfig{
+		Endpoint:        srv.URL,
+		Region:          "ap-southeast-1",
+		AccessKeyId:     "key",
+		SecretAccessKey: "secret",
+		PathStyle:       true,
+		Timeout:         5,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	etag, err := s.ETag("xmp-lp", "lp/1.zip")
+	assert.NoError(t, err)
+	assert.Equal(t, "9a0364b9e99bb480dd25e1f0284c8555", etag, "without quotes")
+
+	_, err = awsUtilsStore{head: s}.ETag("xmp-lp", "lp/2.zip")
+	assert.Error(t, err, "not found")
+}
+
+func TestObjectStoresByBucket(t *testing.T) {
+	lp, cleanupLp := testLocalStore(t)
+	defer cleanupLp()
+	other, cleanupOther := testLocalStore(t)
+	defer cleanupOther()
+	testPutObject(t, lp, "landings", "1.zip", []byte("landing"))
+	testPutObject(t, other, "xmp-content", "1", []byte("content"))
+
+	stores := &objectStores{
+		byBucket: map[string]ObjectStore{"xmp-lp": lp},
+		names:    map[string]string{"xmp-lp": "landings"},
+		fallback: other,
+	}
+	buff, _, err := stores.Download("xmp-lp", "1.zip")
+	assert.NoError(t, err)
+	assert.Equal(t, "landing", string(buff), "store and name of the bucket")
+
+	buff, _, err = stores.Download("xmp-content", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(buff), "bucket which is not in the config")
+
+	_, err = newObjectStore(ObjectStoreConfig{Type: ObjectStoreLocal})
+	assert.Error(t, err, "local store without path")
+	_, err = newObjectStore(ObjectStoreConfig{Type: "ftp"})
+	assert.Error(t, err, "unknown type")
+}
+
+func TestLandingRedownload(t *testing.T) {
+	store, cleanupStore := testLocalStore(t)
+	defer cleanupStore()
+	ls, cleanupLandings := testLandingStore(t)
+	defer cleanupLandings()
+
+	Svc.downloader = &objectStores{byBucket: map[string]ObjectStore{"xmp-lp": store}, fallback: store}
+	defer func() { Svc.downloader = nil }()
+	s := &сampaigns{
+		conf:            CampaignsConfig{Bucket: "xmp-lp"},
+		landings:        ls,
+		landingMismatch: m.NewGauge("test", "campaign", "landing_mismatch", "landing files are missing or changed"),
+	}
+	camp := xmp_api_structs.Campaign{Id: "camp", Lp: "lp1.zip"}
+
+	testPutObject(t, store, "xmp-lp", "lp1.zip", testLandingZip(t, map[string]string{"index.html": "v1"}))
+	assert.NoError(t, s.Download(camp))
+	assert.Equal(t, "v1", testLandingContent(ls, "camp", "camp.html"))
+	assert.False(t, s.verifyLanding("camp", camp.Lp, "camp.html"), "landing is ok")
+
+	os.Remove(filepath.Join(ls.linkPath("camp"), "camp.html"))
+	assert.True(t, s.verifyLanding("camp", camp.Lp, "camp.html"), "missing file")
+	assert.Equal(t, "v1", testLandingContent(ls, "camp", "camp.html"), "downloaded again")
+
+	testPutObject(t, store, "xmp-lp", "lp1.zip", testLandingZip(t, map[string]string{"index.html": "v2"}))
+	assert.True(t, s.verifyLanding("camp", camp.Lp, "camp.html"), "changed in the store")
+	assert.Equal(t, "v2", testLandingContent(ls, "camp", "camp.html"), "new object")
+}
+
+// the object is replaced right after it is downloaded
+type replacedStore struct {
+	localStore
+	replace func()
+}
+
+func (s replacedStore) Download(bucket, key string) ([]byte, int64, error) {
+	buff, size, err := s.localStore.Download(bucket, key)
+	if s.replace != nil {
+		s.replace()
+	}
+	return buff, size, err
+}
+
+func TestLandingChangedDuringDownload(t *testing.T) {
+	store, cleanupStore := testLocalStore(t)
+	defer cleanupStore()
+	ls, cleanupLandings := testLandingStore(t)
+	defer cleanupLandings()
+
+	replaced := replacedStore{localStore: store}
+	replaced.replace = func() {
+		testPutObject(t, store, "xmp-lp", "lp1.zip", testLandingZip(t, map[string]string{"index.html": "v2"}))
+	}
+	Svc.downloader = replaced
+	defer func() { Svc.downloader = nil }()
+	s := &сampaigns{
+		conf:            CampaignsConfig{Bucket: "xmp-lp"},
+		landings:        ls,
+		landingMismatch: m.NewGauge("test", "campaign", "landing_mismatch", "landing files are missing or changed"),
+	}
+	camp := xmp_api_structs.Campaign{Id: "camp", Lp: "lp1.zip"}
+
+	testPutObject(t, store, "xmp-lp", "lp1.zip", testLandingZip(t, map[string]string{"index.html": "v1"}))
+	assert.NoError(t, s.Download(camp))
+	assert.Equal(t, "v1", testLandingContent(ls, "camp", "camp.html"))
+
+	replaced.replace = nil
+	Svc.downloader = replaced
+	assert.True(t, s.verifyLanding("camp", camp.Lp, "camp.html"), "etag of the downloaded object is kept")
+	assert.Equal(t, "v2", testLandingContent(ls, "camp", "camp.html"))
+}
@@ -114,19 +114,17 @@ func (pss *pixelSettings) ByKeyWithRatio(key string) (PixelSetting, error) {
 		pss.notFound.Inc()
 		return PixelSetting{}, fmt.Errorf("Key %s: not found", key)
 	}
-	ps.Count = ps.Count + 1
-	if ps.Count == ps.Ratio {
-		ps.Count = 0
-		ps.SkipPixelSend = false
-	} else {
-		ps.SkipPixelSend = true
-	}
+	// campaign, operator and campaign-operator keys of the setting share the counter
+	res := *ps
+	send, count := Svc.RatioCounters.Next("pixel:"+ps.Id, int64(ps.Ratio))
+	res.Count = int(count)
+	res.SkipPixelSend = !send
 	log.WithFields(log.Fields{
-		"skip":  ps.SkipPixelSend,
-		"count": ps.Count,
+		"skip":  res.SkipPixelSend,
+		"count": res.Count,
 		"key":   key,
 	}).Debug("pixel")
-	return *ps, nil
+	return res, nil
 }
 
 func (ps *PixelSetting) CampaignKey() string {
@@ -236,22 +234,37 @@ func (ps *pixelSettings) updateOnUUID() {
 
 type Publishers struct {
 	sync.RWMutex
-	All map[string]Publisher
+	All     map[string]Publisher
+	ordered []Publisher // by priority
+	loaded  PublishersLoaded
+	cache   *publisherCache
+	dm      publisherDetectMetrics
 }
 
 type Publisher struct {
 	Name        string
 	RegexString string
 	Regex       *regexp.Regexp
+	Priority    int // the higher is tried first
 }
 
+// priority column is optional, publishers are of the same priority without it
 func (p *Publishers) Reload() (err error) {
 	p.Lock()
 	defer p.Unlock()
 
+	priority := "0"
+	var hasPriority bool
+	if hasPriority, err = tableHasColumn(Svc.dbConf.TablePrefix+"publishers", "priority"); err != nil {
+		return
+	}
+	if hasPriority {
+		priority = "priority"
+	}
 	query := fmt.Sprintf("SELECT "+
 		"name, "+
-		"regex "+
+		"regex, "+
+		priority+" "+
 		"FROM %spublishers ",
 		Svc.dbConf.TablePrefix,
 	)
@@ -264,7 +277,7 @@ func (p *Publishers) Reload() (err error) {
 	}
 	defer rows.Close()
 
-	loadPublisherErrorFlag := false
+	loaded := PublishersLoaded{At: time.Now().UTC()}
 	var records []Publisher
 	for rows.Next() {
 		p := Publisher{}
@@ -272,34 +285,67 @@ func (p *Publishers) Reload() (err error) {
 		if err = rows.Scan(
 			&p.Name,
 			&p.RegexString,
+			&p.Priority,
 		); err != nil {
 			err = fmt.Errorf("rows.Scan: %s", err.Error())
 			return
 		}
 		p.Name = strings.ToLower(p.Name)
-		p.Regex, err = regexp.Compile(p.RegexString)
-		if err != nil {
-			log.WithField("regex", p.RegexString).Error("wrong regex")
-			loadPublisherErrorFlag = true
+		var compileErr error
+		if p.Regex, compileErr = compilePublisherRegex(p.RegexString); compileErr != nil {
+			log.WithFields(log.Fields{
+				"name":  p.Name,
+				"regex": p.RegexString,
+				"error": compileErr.Error(),
+			}).Error("wrong regex")
+			loaded.Errors = append(loaded.Errors, PublisherLoadError{
+				Name:  p.Name,
+				Regex: p.RegexString,
+				Error: compileErr.Error(),
+			})
+			continue
 		}
 		records = append(records, p)
 	}
 
 	if rows.Err() != nil {
-		err = fmt.Errorf("rows.Err: %s", err.Error())
+		err = fmt.Errorf("rows.Err: %s", rows.Err().Error())
 		return
 	}
 
-	if loadPublisherErrorFlag == true {
-		Svc.m.LoadPublisherRegexError.Set(1.)
-		return
-	} else {
-		Svc.m.LoadPublisherRegexError.Set(0.)
-	}
-
+	// valid rows are applied, wrong ones are reported
+	loaded.Loaded = len(records)
+	p.loaded = loaded
 	p.All = make(map[string]Publisher, len(records))
 	for _, publisher := range records {
 		p.All[publisher.Name] = publisher
 	}
+	p.order()
+	if len(loaded.Errors) > 0 {
+		Svc.m.LoadPublisherRegexError.Set(1.)
+		var names []string
+		for _, e := range loaded.Errors {
+			names = append(names, e.Name+": "+e.Error)
+		}
+		return fmt.Errorf("wrong regex of %d publishers: %s", len(names), strings.Join(names, "; "))
+	}
+	Svc.m.LoadPublisherRegexError.Set(0.)
 	return nil
 }
+
+// table name could have schema: schema.table
+func tableHasColumn(table, column string) (bool, error) {
+	query := "SELECT count(*) " +
+		"FROM information_schema.columns " +
+		"WHERE table_name = $1 AND column_name = $2"
+	args := []interface{}{table, column}
+	if i := strings.Index(table, "."); i >= 0 {
+		query = query + " AND table_schema = $3"
+		args = []interface{}{table[i+1:], column, table[:i]}
+	}
+	var count int
+	if err := Svc.db.QueryRow(query, args...).Scan(&count); err != nil {
+		return false, fmt.Errorf("db.QueryRow: %s, query: %s", err.Error(), query)
+	}
+	return count > 0, nil
+}
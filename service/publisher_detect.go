@@ -0,0 +1,219 @@
+package service
+
+// detection of the publisher of the hit by url, query string or referer:
+// regexes are tried by priority, the higher first, then by name,
+// click id is the named group click_id of the regex
+// matched publishers are cached by the source without the query parameters of click ids,
+// the click id is taken by the regex of the cached publisher
+import (
+	"net/url"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	m "github.com/linkit360/go-utils/metrics"
+)
+
+const publisherClickIdGroup = "click_id"
+
+type PublishersConfig struct {
+	CacheSize int `yaml:"cache_size" default:"10000"` // matched sources, the oldest are dropped, 0 - no cache
+}
+
+type PublisherDetected struct {
+	Publisher string `json:"publisher,omitempty"` // empty - no publisher matched
+	ClickId   string `json:"click_id,omitempty"`
+}
+
+type publisherDetectMetrics struct {
+	matched   m.Gauge
+	unmatched m.Gauge
+	cached    m.Gauge
+}
+
+// publisher names by normalized sources, empty name - no publisher matched
+type publisherCache struct {
+	sync.Mutex
+	size        int
+	names       map[string]string
+	keys        []string            // in the order they are added
+	clickParams map[string]struct{} // query parameters which carried click ids
+}
+
+func initPublishers(appName string, conf PublishersConfig) *Publishers {
+	p := &Publishers{
+		cache: &publisherCache{
+			size:        conf.CacheSize,
+			names:       make(map[string]string),
+			clickParams: make(map[string]struct{}),
+		},
+		dm: publisherDetectMetrics{
+			matched:   m.NewGauge(appName, "publisher", "matched", "publisher detected"),
+			unmatched: m.NewGauge(appName, "publisher", "unmatched", "no publisher regex matched"),
+			cached:    m.NewGauge(appName, "publisher", "cached", "publisher detected from cache"),
+		},
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			p.dm.matched.Update()
+			p.dm.unmatched.Update()
+			p.dm.cached.Update()
+		}
+	}()
+	return p
+}
+
+// the source without values of click id parameters, the source itself if it is not an url
+func (pc *publisherCache) key(source string) string {
+	u, err := url.Parse(source)
+	if err != nil || u.RawQuery == "" {
+		return source
+	}
+	query := u.Query()
+	for param := range pc.clickParams {
+		if _, ok := query[param]; ok {
+			query.Set(param, "")
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func (pc *publisherCache) get(source string) (key, name string, ok bool) {
+	if pc == nil || pc.size <= 0 {
+		return "", "", false
+	}
+	pc.Lock()
+	defer pc.Unlock()
+	key = pc.key(source)
+	name, ok = pc.names[key]
+	return
+}
+
+// parameters which carry the click id are learned, so the next sources with them are found
+func (pc *publisherCache) set(key, source string, d PublisherDetected) {
+	if pc == nil || pc.size <= 0 {
+		return
+	}
+	pc.Lock()
+	defer pc.Unlock()
+	if d.ClickId != "" {
+		if u, err := url.Parse(source); err == nil {
+			for param, values := range u.Query() {
+				for _, value := range values {
+					if value == d.ClickId {
+						pc.clickParams[param] = struct{}{}
+					}
+				}
+			}
+			key = pc.key(source)
+		}
+	}
+	if _, ok := pc.names[key]; !ok {
+		pc.keys = append(pc.keys, key)
+	}
+	pc.names[key] = d.Publisher
+	for len(pc.keys) > pc.size {
+		delete(pc.names, pc.keys[0])
+		pc.keys = pc.keys[1:]
+	}
+}
+
+func (pc *publisherCache) flush() {
+	if pc == nil {
+		return
+	}
+	pc.Lock()
+	defer pc.Unlock()
+	pc.names = make(map[string]string)
+	pc.keys = nil
+}
+
+// must be called under the lock, after publishers are changed
+func (p *Publishers) order() {
+	p.ordered = make([]Publisher, 0, len(p.All))
+	for _, publisher := range p.All {
+		if publisher.Regex != nil {
+			p.ordered = append(p.ordered, publisher)
+		}
+	}
+	sort.Slice(p.ordered, func(i, j int) bool {
+		if p.ordered[i].Priority != p.ordered[j].Priority {
+			return p.ordered[i].Priority > p.ordered[j].Priority
+		}
+		return p.ordered[i].Name < p.ordered[j].Name
+	})
+	p.cache.flush()
+}
+
+// the cached publisher is checked by its regex, all are tried again if it does not match
+func (p *Publishers) Detect(source string) PublisherDetected {
+	key, name, cached := p.cache.get(source)
+	p.RLock()
+	var d PublisherDetected
+	if cached {
+		d, cached = detectCachedPublisher(p.All, name, source)
+	}
+	if !cached {
+		d = detectPublisher(p.ordered, source)
+	}
+	p.RUnlock()
+
+	if cached {
+		p.dm.cached.Inc()
+	} else {
+		p.cache.set(key, source, d)
+	}
+	if d.Publisher == "" {
+		p.dm.unmatched.Inc()
+	} else {
+		p.dm.matched.Inc()
+	}
+	return d
+}
+
+func detectPublisher(ordered []Publisher, source string) PublisherDetected {
+	for _, publisher := range ordered {
+		match := publisher.Regex.FindStringSubmatch(source)
+		if match == nil {
+			continue
+		}
+		return PublisherDetected{
+			Publisher: publisher.Name,
+			ClickId:   publisherClickId(publisher.Regex, match),
+		}
+	}
+	return PublisherDetected{}
+}
+
+func detectCachedPublisher(all map[string]Publisher, name, source string) (PublisherDetected, bool) {
+	if name == "" {
+		return PublisherDetected{}, true
+	}
+	publisher, ok := all[name]
+	if !ok || publisher.Regex == nil {
+		return PublisherDetected{}, false
+	}
+	match := publisher.Regex.FindStringSubmatch(source)
+	if match == nil {
+		return PublisherDetected{}, false
+	}
+	return PublisherDetected{
+		Publisher: publisher.Name,
+		ClickId:   publisherClickId(publisher.Regex, match),
+	}, true
+}
+
+// empty if the regex has no click_id group or did not match
+func publisherClickId(re *regexp.Regexp, match []string) string {
+	if match == nil {
+		return ""
+	}
+	for i, group := range re.SubexpNames() {
+		if group == publisherClickIdGroup {
+			return match[i]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,38 @@
+package service
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishersDetect(t *testing.T) {
+	p := initPublishers("test", PublishersConfig{CacheSize: 2})
+	p.All = map[string]Publisher{
+		"kimia":  {Name: "kimia", Regex: regexp.MustCompile(`aff_sub=kimia&click=(?P<click_id>\w+)`)},
+		"mobusi": {Name: "mobusi", Regex: regexp.MustCompile(`mobusi`), Priority: 10},
+		"any":    {Name: "any", Regex: regexp.MustCompile(`click=`), Priority: -1},
+		"broken": {Name: "broken"},
+	}
+	p.order()
+
+	assert.Equal(t, PublisherDetected{Publisher: "kimia", ClickId: "c123"},
+		p.Detect("http://lp/?aff_sub=kimia&click=c123"), "click id group")
+	assert.Equal(t, PublisherDetected{Publisher: "mobusi"},
+		p.Detect("http://lp/?aff_sub=kimia&click=c123&src=mobusi"), "by priority")
+	assert.Equal(t, PublisherDetected{}, p.Detect("http://lp/"), "no publisher")
+
+	assert.Equal(t, PublisherDetected{Publisher: "kimia", ClickId: "c456"},
+		p.Detect("http://lp/?aff_sub=kimia&click=c456"), "click id of the source")
+	assert.Equal(t, 2, len(p.cache.names), "cache is bounded")
+	_, name, ok := p.cache.get("http://lp/?aff_sub=kimia&click=c789")
+	assert.True(t, ok, "the source with another click id is cached")
+	assert.Equal(t, "kimia", name)
+
+	p.Lock()
+	p.All = map[string]Publisher{}
+	p.order()
+	p.Unlock()
+	assert.Equal(t, PublisherDetected{}, p.Detect("http://lp/?aff_sub=kimia&click=c123"), "cache is flushed on reload")
+}
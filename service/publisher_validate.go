@@ -0,0 +1,134 @@
+package service
+
+// validation of publisher regexes before they are inserted,
+// errors of the rows of the last reload and test match of a source
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type PublisherLoadError struct {
+	Name  string `json:"name"`
+	Regex string `json:"regex"`
+	Error string `json:"error"`
+}
+
+type PublishersLoaded struct {
+	At     time.Time            `json:"at"`
+	Loaded int                  `json:"loaded"`
+	Errors []PublisherLoadError `json:"errors,omitempty"` // rows which are skipped
+}
+
+type PublisherSampleMatch struct {
+	Source  string `json:"source"`
+	Matched bool   `json:"matched"`
+	ClickId string `json:"click_id,omitempty"`
+}
+
+type PublisherValidation struct {
+	Error   string                 `json:"error,omitempty"` // regex cannot be used
+	Samples []PublisherSampleMatch `json:"samples,omitempty"`
+}
+
+// regex of the row, empty one would match all the traffic
+func compilePublisherRegex(regex string) (*regexp.Regexp, error) {
+	if strings.TrimSpace(regex) == "" {
+		return nil, fmt.Errorf("empty regex%s", "")
+	}
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return nil, fmt.Errorf("regexp.Compile: %s", err.Error())
+	}
+	return re, nil
+}
+
+func samplesMatch(re *regexp.Regexp, samples []string) []PublisherSampleMatch {
+	res := make([]PublisherSampleMatch, 0, len(samples))
+	for _, source := range samples {
+		match := re.FindStringSubmatch(source)
+		res = append(res, PublisherSampleMatch{
+			Source:  source,
+			Matched: match != nil,
+			ClickId: publisherClickId(re, match),
+		})
+	}
+	return res
+}
+
+// the regex and how it matches the sample urls
+func ValidatePublisher(regex string, samples []string) PublisherValidation {
+	re, err := compilePublisherRegex(regex)
+	if err != nil {
+		return PublisherValidation{Error: err.Error()}
+	}
+	return PublisherValidation{Samples: samplesMatch(re, samples)}
+}
+
+// publishers in the order of detection with the result for the source
+type PublisherTestMatch struct {
+	Detected   PublisherDetected `json:"detected"`
+	Publishers []PublisherMatch  `json:"publishers"`
+}
+
+type PublisherMatch struct {
+	Publisher string `json:"publisher"`
+	Priority  int    `json:"priority"`
+	Matched   bool   `json:"matched"`
+	ClickId   string `json:"click_id,omitempty"`
+}
+
+func (p *Publishers) TestMatch(source string) PublisherTestMatch {
+	p.RLock()
+	defer p.RUnlock()
+
+	res := PublisherTestMatch{
+		Detected:   detectPublisher(p.ordered, source),
+		Publishers: make([]PublisherMatch, 0, len(p.ordered)),
+	}
+	for _, publisher := range p.ordered {
+		match := publisher.Regex.FindStringSubmatch(source)
+		res.Publishers = append(res.Publishers, PublisherMatch{
+			Publisher: publisher.Name,
+			Priority:  publisher.Priority,
+			Matched:   match != nil,
+			ClickId:   publisherClickId(publisher.Regex, match),
+		})
+	}
+	return res
+}
+
+func (p *Publishers) LastLoaded() PublishersLoaded {
+	p.RLock()
+	defer p.RUnlock()
+	return p.loaded
+}
+
+func AddPublisherHandlers(e *gin.Engine) {
+	g := e.Group("api")
+	g.GET("/publisher/match", publisherMatchHandler)
+	g.GET("/publisher/loaded", publisherLoadedHandler)
+	g.GET("/publisher/validate", publisherValidateHandler)
+}
+
+// /api/publisher/match?source=<url>
+func publisherMatchHandler(c *gin.Context) {
+	c.JSON(200, Svc.Publishers.TestMatch(c.Query("source")))
+}
+
+func publisherLoadedHandler(c *gin.Context) {
+	c.JSON(200, Svc.Publishers.LastLoaded())
+}
+
+// /api/publisher/validate?regex=<regex>&sample=<url>&sample=<url>
+func publisherValidateHandler(c *gin.Context) {
+	res := ValidatePublisher(c.Query("regex"), c.Request.URL.Query()["sample"])
+	if res.Error != "" {
+		c.JSON(400, res)
+		return
+	}
+	c.JSON(200, res)
+}
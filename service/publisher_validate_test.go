@@ -0,0 +1,38 @@
+package service
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatePublisher(t *testing.T) {
+	assert.NotEmpty(t, ValidatePublisher("", nil).Error, "empty regex")
+	assert.NotEmpty(t, ValidatePublisher("aff_sub=(kimia", nil).Error, "wrong regex")
+
+	res := ValidatePublisher(`aff_sub=kimia&click=(?P<click_id>\w+)`, []string{
+		"http://lp/?aff_sub=kimia&click=c1",
+		"http://lp/?aff_sub=mobusi",
+	})
+	assert.Equal(t, "", res.Error)
+	assert.Equal(t, []PublisherSampleMatch{
+		{Source: "http://lp/?aff_sub=kimia&click=c1", Matched: true, ClickId: "c1"},
+		{Source: "http://lp/?aff_sub=mobusi"},
+	}, res.Samples)
+}
+
+func TestPublishersTestMatch(t *testing.T) {
+	p := &Publishers{All: map[string]Publisher{
+		"kimia":  {Name: "kimia", Regex: regexp.MustCompile(`kimia`), Priority: 1},
+		"mobusi": {Name: "mobusi", Regex: regexp.MustCompile(`click=(?P<click_id>\w+)`)},
+	}}
+	p.ordered = []Publisher{p.All["kimia"], p.All["mobusi"]}
+
+	res := p.TestMatch("http://lp/?aff_sub=kimia&click=c1")
+	assert.Equal(t, PublisherDetected{Publisher: "kimia"}, res.Detected)
+	assert.Equal(t, []PublisherMatch{
+		{Publisher: "kimia", Priority: 1, Matched: true},
+		{Publisher: "mobusi", Matched: true, ClickId: "c1"},
+	}, res.Publishers, "all publishers in the order of detection")
+}
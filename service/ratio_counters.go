@@ -0,0 +1,122 @@
+package service
+
+// counters of ratios: autoclick of campaigns, pixels of pixel settings
+// every ratio-th call of the key is selected, counters are shared by all requests
+// and saved to the file (if set), so they continue after restart
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type RatioCounters struct {
+	sync.Mutex
+	filePath string
+	changed  bool
+	counts   map[string]int64
+}
+
+func initRatioCounters(filePath string) *RatioCounters {
+	rc := &RatioCounters{
+		filePath: filePath,
+		counts:   make(map[string]int64),
+	}
+	if filePath == "" {
+		return rc
+	}
+	if err := rc.load(); err != nil {
+		log.WithFields(log.Fields{
+			"file":  filePath,
+			"error": err.Error(),
+		}).Error("cannot load ratio counters")
+	}
+	go func() {
+		for range time.Tick(10 * time.Second) {
+			if err := rc.Save(); err != nil {
+				log.WithField("error", err.Error()).Error("cannot save ratio counters")
+			}
+		}
+	}()
+	return rc
+}
+
+// increments the counter of the key, the counter is reset when it reaches the ratio
+// ratio < 1 or no counters (not in mid) - never selected
+func (rc *RatioCounters) Next(key string, ratio int64) (selected bool, count int64) {
+	if rc == nil || ratio < 1 {
+		return false, 0
+	}
+	rc.Lock()
+	defer rc.Unlock()
+
+	count = rc.counts[key] + 1
+	// ratio could be lowered while the counter is over it
+	if count >= ratio {
+		count = 0
+		selected = true
+	}
+	rc.counts[key] = count
+	rc.changed = true
+	return
+}
+
+func (rc *RatioCounters) Save() error {
+	if rc.filePath == "" {
+		return nil
+	}
+	rc.Lock()
+	if !rc.changed {
+		rc.Unlock()
+		return nil
+	}
+	countsJson, err := json.Marshal(rc.counts)
+	rc.changed = false
+	rc.Unlock()
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %s", err.Error())
+	}
+
+	if err := rc.write(countsJson); err != nil {
+		rc.Lock()
+		rc.changed = true
+		rc.Unlock()
+		return err
+	}
+	return nil
+}
+
+// the file is never left half written
+func (rc *RatioCounters) write(countsJson []byte) error {
+	tmpPath := rc.filePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, countsJson, 0644); err != nil {
+		return fmt.Errorf("ioutil.WriteFile: %s", err.Error())
+	}
+	if err := os.Rename(tmpPath, rc.filePath); err != nil {
+		return fmt.Errorf("os.Rename: %s", err.Error())
+	}
+	return nil
+}
+
+func (rc *RatioCounters) load() error {
+	countsJson, err := ioutil.ReadFile(rc.filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("ioutil.ReadFile: %s", err.Error())
+	}
+	counts := make(map[string]int64)
+	if err := json.Unmarshal(countsJson, &counts); err != nil {
+		return fmt.Errorf("json.Unmarshal: %s", err.Error())
+	}
+	rc.Lock()
+	rc.counts = counts
+	rc.Unlock()
+	log.WithField("count", len(counts)).Info("ratio counters loaded")
+	return nil
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	xmp_api_structs "github.com/linkit360/xmp-api/src/structs"
+)
+
+func TestRatioCountersNext(t *testing.T) {
+	rc := initRatioCounters("")
+
+	var selected []bool
+	for i := 0; i < 6; i++ {
+		s, _ := rc.Next("key", 3)
+		selected = append(selected, s)
+	}
+	assert.Equal(t, []bool{false, false, true, false, false, true}, selected, "every third")
+
+	s, _ := rc.Next("key", 0)
+	assert.False(t, s, "zero ratio")
+
+	rc.Next("lowered", 5)
+	rc.Next("lowered", 5)
+	s, count := rc.Next("lowered", 2)
+	assert.True(t, s, "ratio is lowered")
+	assert.Equal(t, int64(0), count, "counter is reset")
+}
+
+func TestRatioCountersConcurrent(t *testing.T) {
+	rc := initRatioCounters("")
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	selected := 0
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if s, _ := rc.Next("key", 4); s {
+					mutex.Lock()
+					selected++
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 250, selected, "every fourth of concurrent calls")
+}
+
+func TestRatioCountersSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mid_ratios")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, "ratios.json")
+
+	rc := &RatioCounters{filePath: filePath, counts: make(map[string]int64)}
+	rc.Next("key", 3)
+	rc.Next("key", 3)
+	assert.NoError(t, rc.Save())
+
+	restarted := &RatioCounters{filePath: filePath, counts: make(map[string]int64)}
+	assert.NoError(t, restarted.load())
+	s, _ := restarted.Next("key", 3)
+	assert.True(t, s, "counter continues after restart")
+}
+
+func TestCampaignNextAutoClick(t *testing.T) {
+	Svc.RatioCounters = initRatioCounters("")
+	defer func() { Svc.RatioCounters = nil }()
+
+	camp := Campaign{Campaign: xmp_api_structs.Campaign{Id: testCampaignUUID, AutoClickEnabled: true, AutoClickRatio: 2}}
+	// every call gets its own copy of the campaign
+	first, second := camp, camp
+	assert.False(t, first.NextAutoClick(), "first hit")
+	assert.True(t, second.NextAutoClick(), "second hit of another copy")
+
+	camp.AutoClickEnabled = false
+	assert.False(t, camp.NextAutoClick(), "autoclick disabled")
+}
+
+func TestCampaignNextAutoClickRemote(t *testing.T) {
+	camp := Campaign{Campaign: xmp_api_structs.Campaign{Id: testCampaignUUID, AutoClickEnabled: true, AutoClickRatio: 2}}
+	assert.False(t, camp.NextAutoClick(), "no counters, no panic")
+
+	calls := 0
+	RemoteAutoClick = func(campaignId string) (bool, int64, error) {
+		calls++
+		return true, 0, nil
+	}
+	defer func() { RemoteAutoClick = nil }()
+	assert.True(t, camp.NextAutoClick(), "counters of mid")
+	assert.Equal(t, 1, calls)
+
+	Svc.RatioCounters = initRatioCounters("")
+	defer func() { Svc.RatioCounters = nil }()
+	camp.NextAutoClick()
+	assert.Equal(t, 1, calls, "in mid its own counters are used")
+}
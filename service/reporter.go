@@ -14,46 +14,76 @@ import (
 	amqp_driver "github.com/streadway/amqp"
 
 	"github.com/linkit360/go-utils/amqp"
+	qconf "github.com/linkit360/go-utils/config"
 	m "github.com/linkit360/go-utils/metrics"
-	xmp_api "github.com/linkit360/xmp-api/src/client"
 	xmp_api_structs "github.com/linkit360/xmp-api/src/structs"
 )
 
 type Collector interface {
 	SaveState()
-	GetAggregate(time.Time, time.Time) ([]xmp_api_structs.Aggregate, error)
+	GetAggregate(AggregateFilter) ([]Aggregate, error)
+	GetRevenue(AggregateFilter) ([]RevenueReport, error)
+	StartBackfill(AggregateFilter) (BackfillJob, error)
+	BackfillStatus() (BackfillJob, bool)
+	CancelBackfill() (BackfillJob, error)
+}
+
+// xmp api aggregate with counters it doesn't know yet
+type Aggregate struct {
+	xmp_api_structs.Aggregate
+	Unsubscribes     int64  `json:"unsubscribes"`
+	ContentDelivered int64  `json:"content_delivered"`
+	SMSSent          int64  `json:"sms_sent"`
+	Redirects        int64  `json:"redirects"`
+	LpHitsInactive   int64  `json:"lp_hits_inactive"` // hits outside of the campaign schedule
+	LandingVariant   string `json:"landing_variant,omitempty"`
+	Currency         string `json:"currency,omitempty"` // charge sums are in cents of the currency
+	Backfill         bool   `json:"backfill,omitempty"` // rebuilt from the db
 }
 
 type Collect struct {
-	Tid               string `json:"tid,omitempty"`
-	CampaignUUID      string `json:"campaign_id,omitempty"`
-	OperatorCode      int64  `json:"operator_code,omitempty"`
-	Msisdn            string `json:"msisdn,omitempty"`
-	TransactionResult string `json:"transaction_result,omitempty"`
-	Price             int    `json:"price,omitempty"`
-	AttemptsCount     int    `json:"attempts_count,omitempty"`
+	Tid               string    `json:"tid,omitempty"`
+	CampaignUUID      string    `json:"campaign_id,omitempty"`
+	OperatorCode      int64     `json:"operator_code,omitempty"`
+	Msisdn            string    `json:"msisdn,omitempty"`
+	TransactionResult string    `json:"transaction_result,omitempty"`
+	Price             int       `json:"price,omitempty"`
+	AttemptsCount     int       `json:"attempts_count,omitempty"`
+	UniqueUrl         string    `json:"unique_url,omitempty"` // content delivery events
+	Currency          string    `json:"currency,omitempty"`   // config currency if empty
+	PriceUnit         string    `json:"price_unit,omitempty"` // cents or units, config price unit if empty
+	Inactive          bool      `json:"inactive,omitempty"`   // hit outside of the campaign schedule
+	LandingVariant    string    `json:"landing_variant,omitempty"`
+	SentAt            time.Time `json:"sent_at,omitempty"` // when the event happened, zero if not sent
 }
 
 type collectorService struct {
 	sync.RWMutex
-	state         CollectorState
-	db            *sql.DB
-	m             *ReporterMetrics
-	adReport      map[string]OperatorAgregate // map[campaign][operator]acceptor.Aggregate
-	consume       *Consumers
-	hitCh         <-chan amqp_driver.Delivery
-	transactionCh <-chan amqp_driver.Delivery
-	pixelCh       <-chan amqp_driver.Delivery
-	outflowCh     <-chan amqp_driver.Delivery
+	state       CollectorState
+	db          *sql.DB
+	m           *ReporterMetrics
+	revenue     *revenueMetrics
+	results     transactionResults
+	queues      QueuesConfig
+	deadLetters *deadLetters
+	sinks       []Sink
+	eventsSize  int // archive size of raw events by sink, 0 - not limited
+	eventsMutex sync.Mutex
+	events      []ReporterEvent
+	shards      reportShards
 }
 
 type OperatorAgregate map[int64]adAggregate       // by operator code
 type CampaignAgregate map[string]OperatorAgregate // by campaign code
 
 type CollectorState struct {
-	LastSendTime time.Time     `json:"last_send_time"`
-	FilePath     string        `json:"file_path"`
-	Archive      []interface{} `json:"archive"`
+	LastSendTime time.Time                `json:"last_send_time"`
+	FilePath     string                   `json:"file_path"`
+	Archive      []interface{}            `json:"archive,omitempty"`  // before sinks, xmp api only
+	Archives     map[string][]interface{} `json:"archives"`           // by sink name
+	Backfill     *BackfillJob             `json:"backfill,omitempty"` // the last one
+
+	EventArchives map[string][]ReporterEvent `json:"event_archives,omitempty"` // raw events by sink name
 }
 
 type ReporterMetrics struct {
@@ -62,22 +92,43 @@ type ReporterMetrics struct {
 
 	ErrorCampaignIdEmpty   m.Gauge
 	ErrorOperatorCodeEmpty m.Gauge
+	UnknownResult          m.Gauge
+	CurrencyMismatch       m.Gauge
 
 	BreatheDuration prometheus.Summary
 	SendDuration    prometheus.Summary
 	AggregateSum    prometheus.Summary
+
+	Processed       *prometheus.CounterVec // by queue
+	ProcessDuration *prometheus.SummaryVec // by queue
+	EventsDropped   *prometheus.CounterVec // by sink, over the event archive size
 }
 
 func initReporterMetrics(appName string) *ReporterMetrics {
 	mm := &ReporterMetrics{
 		ErrorCampaignIdEmpty:   m.NewGauge(appName+"_reporter", "campaign_id", "empty", "errors"),
 		ErrorOperatorCodeEmpty: m.NewGauge(appName+"_reporter", "operator_code", "empty", "errors"),
+		UnknownResult:          m.NewGauge(appName+"_reporter", "transaction_result", "unknown", "errors"),
+		CurrencyMismatch:       m.NewGauge(appName+"_reporter", "currency", "mismatch", "errors"),
 		Success:                m.NewGauge(appName, "reporter", "success", "success"),
 		Errors:                 m.NewGauge(appName, "reporter", "errors", "errors"),
 		BreatheDuration:        m.NewSummary(appName+"_breathe_duration_seconds", "breathe duration seconds"),
 		SendDuration:           m.NewSummary(appName+"_send_duration_seconds", "send duration seconds"),
 		AggregateSum:           m.NewSummary(appName+"_aggregatae_sum", "aggregate sum"),
+		Processed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: appName + "_reporter_processed",
+			Help: "processed events by queue",
+		}, []string{"queue"}),
+		ProcessDuration: prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Name: appName + "_reporter_process_duration_seconds",
+			Help: "event processing duration seconds by queue",
+		}, []string{"queue"}),
+		EventsDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: appName + "_reporter_events_dropped",
+			Help: "raw events dropped from the archive of a sink which is down",
+		}, []string{"sink"}),
 	}
+	prometheus.MustRegister(mm.Processed, mm.ProcessDuration, mm.EventsDropped)
 
 	go func() {
 		for range time.Tick(time.Minute) {
@@ -85,6 +136,8 @@ func initReporterMetrics(appName string) *ReporterMetrics {
 			mm.Errors.Update()
 			mm.ErrorCampaignIdEmpty.Update()
 			mm.ErrorOperatorCodeEmpty.Update()
+			mm.UnknownResult.Update()
+			mm.CurrencyMismatch.Update()
 		}
 	}()
 
@@ -113,6 +166,11 @@ type adAggregate struct {
 	ExpiredChargeSum       *counter `json:"expired_charge_sum,omitempty"`
 	ExpiredFailed          *counter `json:"expired_failed,omitempty"`
 	Pixels                 *counter `json:"pixels,omitempty"`
+	Unsubscribes           *counter `json:"unsubscribes,omitempty"`
+	ContentDelivered       *counter `json:"content_delivered,omitempty"`
+	SMSSent                *counter `json:"sms_sent,omitempty"`
+	Redirects              *counter `json:"redirects,omitempty"`
+	LpHitsInactive         *counter `json:"lp_hits_inactive,omitempty"`
 }
 
 type counter struct {
@@ -153,7 +211,72 @@ func (a *adAggregate) Sum() int64 {
 		a.InjectionFailed.count +
 
 		a.Outflow.count +
-		a.Pixels.count
+		a.Pixels.count +
+
+		a.Unsubscribes.count +
+		a.ContentDelivered.count +
+		a.SMSSent.count +
+		a.Redirects.count +
+		a.LpHitsInactive.count
+}
+
+// counter by its json name, nil if there is no such counter
+func (a *adAggregate) counter(name string) *counter {
+	switch name {
+	case "lp_hits":
+		return a.LpHits
+	case "lp_msisdn_hits":
+		return a.LpMsisdnHits
+	case "mo":
+		return a.MoTotal
+	case "mo_charge_success":
+		return a.MoChargeSuccess
+	case "mo_charge_sum":
+		return a.MoChargeSum
+	case "mo_charge_failed":
+		return a.MoChargeFailed
+	case "mo_rejected":
+		return a.MoRejected
+	case "outflow":
+		return a.Outflow
+	case "renewal":
+		return a.RenewalTotal
+	case "renewal_charge_success":
+		return a.RenewalChargeSuccess
+	case "renewal_charge_sum":
+		return a.RenewalChargeSum
+	case "renewal_failed":
+		return a.RenewalFailed
+	case "injection":
+		return a.InjectionTotal
+	case "injection_charge_success":
+		return a.InjectionChargeSuccess
+	case "injection_charge_sum":
+		return a.InjectionChargeSum
+	case "injection_failed":
+		return a.InjectionFailed
+	case "expired":
+		return a.ExpiredTotal
+	case "expired_charge_success":
+		return a.ExpiredChargeSuccess
+	case "expired_charge_sum":
+		return a.ExpiredChargeSum
+	case "expired_failed":
+		return a.ExpiredFailed
+	case "pixels":
+		return a.Pixels
+	case "unsubscribes":
+		return a.Unsubscribes
+	case "content_delivered":
+		return a.ContentDelivered
+	case "sms_sent":
+		return a.SMSSent
+	case "redirects":
+		return a.Redirects
+	case "lp_hits_inactive":
+		return a.LpHitsInactive
+	}
+	return nil
 }
 func newAdAggregate() adAggregate {
 	return adAggregate{
@@ -178,20 +301,35 @@ func newAdAggregate() adAggregate {
 		ExpiredChargeSum:       &counter{},
 		ExpiredFailed:          &counter{},
 		Pixels:                 &counter{},
+		Unsubscribes:           &counter{},
+		ContentDelivered:       &counter{},
+		SMSSent:                &counter{},
+		Redirects:              &counter{},
+		LpHitsInactive:         &counter{},
 	}
 }
 
-func (a *adAggregate) generateReport(instanceId, campaignUUID string, operatorCode int64, reportAt time.Time) xmp_api_structs.Aggregate {
+func (a *adAggregate) generateReport(instanceId, campaignUUID string, operatorCode int64, reportAt time.Time) Aggregate {
 	campaignCode := "0"
-	camp, err := Svc.Campaigns.GetByUUID(campaignUUID)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"error": err.Error(),
-			"uuid":  campaignUUID,
-		}).Error("cannot get campaign code by uuid")
+	if campaignUUID != "" {
+		camp, err := Svc.Campaigns.GetByUUID(campaignUUID)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+				"uuid":  campaignUUID,
+			}).Error("cannot get campaign code by uuid")
+		}
+		campaignCode = camp.Code
+	}
+	ag := Aggregate{
+		Unsubscribes:     a.Unsubscribes.count,
+		ContentDelivered: a.ContentDelivered.count,
+		SMSSent:          a.SMSSent.count,
+		Redirects:        a.Redirects.count,
+		LpHitsInactive:   a.LpHitsInactive.count,
+		Currency:         Svc.conf.Currency,
 	}
-	campaignCode = camp.Code
-	return xmp_api_structs.Aggregate{
+	ag.Aggregate = xmp_api_structs.Aggregate{
 		ReportAt:               reportAt.UTC().Unix(),
 		InstanceId:             instanceId,
 		CampaignId:             campaignUUID,
@@ -219,21 +357,27 @@ func (a *adAggregate) generateReport(instanceId, campaignUUID string, operatorCo
 		ExpiredFailed:          a.ExpiredFailed.count,
 		Pixels:                 a.Pixels.count,
 	}
+	return ag
 }
 
-func initReporter(appName, stateFilePath string, queue QueuesConfig, consumerConf amqp.ConsumerConfig) Collector {
-	as := &collectorService{}
-
-	as.loadState(stateFilePath)
-	as.m = initReporterMetrics(appName)
-	as.consume = &Consumers{
-		Hit:         amqp.InitConsumer(consumerConf, queue.ReporterHit, as.hitCh, as.processHit),
-		Transaction: amqp.InitConsumer(consumerConf, queue.ReporterTransaction, as.transactionCh, as.processTransactions),
-		Pixel:       amqp.InitConsumer(consumerConf, queue.ReporterPixel, as.pixelCh, as.processPixel),
-		Outflow:     amqp.InitConsumer(consumerConf, queue.ReporterOutflow, as.outflowCh, as.processOutflow),
+func initReporter(appName string, svcConf Config, consumerConf amqp.ConsumerConfig) Collector {
+	sinks, err := initSinks(svcConf.Sinks)
+	if err != nil {
+		log.WithField("error", err.Error()).Fatal("cannot init reporter sinks")
 	}
+	as, err := newCollector(svcConf, initReporterMetrics(appName), initRevenueMetrics(appName), sinks)
+	if err != nil {
+		log.WithField("error", err.Error()).Fatal("wrong reporter config")
+	}
+	as.loadState(svcConf.StateFilePath)
+	if svcConf.Enabled.CampaignCaps {
+		if err := Svc.CampaignCaps.loadDay(as.results, time.Now()); err != nil {
+			log.WithField("error", err.Error()).Error("cannot load campaign caps counters")
+		}
+	}
+	as.consumeFrom(newAMQPSource(consumerConf))
+	as.resumeBackfill()
 
-	as.adReport = make(map[string]OperatorAgregate)
 	go func() {
 		for range time.Tick(time.Second) {
 			as.send()
@@ -241,6 +385,39 @@ func initReporter(appName, stateFilePath string, queue QueuesConfig, consumerCon
 	}()
 	return as
 }
+
+// collector without consumers and send loop, metrics are registered once per process
+func newCollector(svcConf Config, mm *ReporterMetrics, rm *revenueMetrics, sinks []Sink) (*collectorService, error) {
+	if svcConf.PriceUnit != PriceUnitCents && svcConf.PriceUnit != PriceUnitUnits {
+		return nil, fmt.Errorf("wrong price unit %s, must be cents or units", svcConf.PriceUnit)
+	}
+	results, err := newTransactionResults(svcConf.TransactionResults)
+	if err != nil {
+		return nil, fmt.Errorf("newTransactionResults: %s", err.Error())
+	}
+	return &collectorService{
+		m:           mm,
+		revenue:     rm,
+		results:     results,
+		queues:      svcConf.Queue,
+		deadLetters: Svc.deadLetters,
+		sinks:       sinks,
+		eventsSize:  svcConf.Sinks.EventArchiveSize,
+		shards:      newReportShards(svcConf.ReporterShards),
+	}, nil
+}
+
+func (as *collectorService) consumeFrom(source DeliverySource) {
+	source.Consume(as.queues.ReporterHit, as.processHit)
+	source.Consume(as.queues.ReporterTransaction, as.processTransactions)
+	source.Consume(as.queues.ReporterPixel, as.processPixel)
+	source.Consume(as.queues.ReporterOutflow, as.processOutflow)
+	source.Consume(as.queues.ReporterUnsubscribe, as.processUnsubscribe)
+	source.Consume(as.queues.ReporterContent, as.processContent)
+	source.Consume(as.queues.ReporterSMS, as.processSMS)
+	source.Consume(as.queues.ReporterRedirect, as.processRedirect)
+}
+
 func (as *collectorService) SaveState() {
 	if !Svc.conf.Enabled.Reporter {
 		return
@@ -291,7 +468,19 @@ func (as *collectorService) loadState(filePath string) error {
 		as.state.LastSendTime = time.Now().UTC()
 		logCtx.WithField("path", filePath).Warn("invalid time")
 	}
-	logCtx.Infof("%s, count: %s", as.state.LastSendTime.String(), len(as.state.Archive))
+	if len(as.state.Archive) > 0 {
+		if as.state.Archives == nil {
+			as.state.Archives = make(map[string][]interface{})
+		}
+		as.state.Archives[xmpAPISink{}.Name()] = append(as.state.Archives[xmpAPISink{}.Name()], as.state.Archive...)
+		as.state.Archive = nil
+	}
+	for name, archive := range as.state.Archives {
+		logCtx.Infof("%s, sink: %s, count: %d", as.state.LastSendTime.String(), name, len(archive))
+	}
+	for name, archive := range as.state.EventArchives {
+		logCtx.Infof("%s, sink: %s, events: %d", as.state.LastSendTime.String(), name, len(archive))
+	}
 	return nil
 }
 
@@ -303,7 +492,8 @@ func (as *collectorService) send() {
 	var data []interface{}
 	aggregateSum := int64(.0)
 
-	for campaignUUID, operatorAgregate := range as.adReport {
+	for reportKey, operatorAgregate := range as.breathe() {
+		campaignUUID, landingVariant := splitReportKey(reportKey)
 		for operatorCode, coa := range operatorAgregate {
 			if coa.Sum() == 0 {
 				continue
@@ -311,83 +501,151 @@ func (as *collectorService) send() {
 
 			aggregateSum = aggregateSum + coa.Sum()
 
-			data = append(data, coa.generateReport(
+			report := coa.generateReport(
 				Svc.xmpAPIConf.InstanceId,
 				campaignUUID,
 				operatorCode,
 				time.Now(),
-			))
-
+			)
+			report.LandingVariant = landingVariant
+			data = append(data, report)
 		}
 	}
-	as.state.Archive = append(as.state.Archive, data...)
-	as.breathe()
 
-	if len(as.state.Archive) > 0 {
-		log.WithFields(log.Fields{"took": time.Since(begin)}).Info("prepare")
-		var resp struct {
-			Ok    bool   `json:"ok,omitempty"`
-			Error string `json:"error,omitempty"`
+	if as.state.Archives == nil {
+		as.state.Archives = make(map[string][]interface{})
+	}
+	for _, sink := range as.sinks {
+		archive := append(as.state.Archives[sink.Name()], data...)
+		as.state.Archives[sink.Name()] = archive
+		if len(archive) == 0 {
+			continue
 		}
+		log.WithFields(log.Fields{"took": time.Since(begin), "sink": sink.Name()}).Info("prepare")
 
-		err := xmp_api.Call("aggregate", &resp, as.state.Archive...)
-		if err != nil {
+		if err := sink.SendAggregates(archive); err != nil {
 			as.m.Errors.Inc()
-			log.WithFields(log.Fields{"error": err.Error()}).Error("cannot send data")
-		} else if !resp.Ok {
+			log.WithFields(log.Fields{
+				"sink":  sink.Name(),
+				"error": err.Error(),
+			}).Error("cannot send data")
+			continue
+		}
+		queueJson, _ := json.Marshal(archive)
+		log.WithFields(log.Fields{
+			"sink":  sink.Name(),
+			"count": len(archive),
+			"data":  string(queueJson),
+		}).Debug("sent")
+		as.state.Archives[sink.Name()] = []interface{}{}
+	}
+
+	// raw events are archived by sink as aggregates are, the oldest are dropped over the size
+	as.eventsMutex.Lock()
+	events := as.events
+	as.events = nil
+	as.eventsMutex.Unlock()
+	if as.state.EventArchives == nil {
+		as.state.EventArchives = make(map[string][]ReporterEvent)
+	}
+	for _, sink := range as.sinks {
+		archive := as.capEvents(sink.Name(), append(as.state.EventArchives[sink.Name()], events...))
+		as.state.EventArchives[sink.Name()] = archive
+		if len(archive) == 0 {
+			continue
+		}
+		if err := sink.SendEvents(archive); err != nil {
 			as.m.Errors.Inc()
-			log.WithFields(log.Fields{"reason": resp.Error}).Warn("haven't received the data")
-		} else {
-			queueJson, _ := json.Marshal(as.state.Archive)
 			log.WithFields(log.Fields{
-				"count": len(as.state.Archive),
-				"data":  string(queueJson),
-			}).Debug("sent")
-			as.state.Archive = []interface{}{}
+				"sink":  sink.Name(),
+				"count": len(archive),
+				"error": err.Error(),
+			}).Error("cannot send events")
+			continue
 		}
+		as.state.EventArchives[sink.Name()] = nil
 	}
 
 	as.m.SendDuration.Observe(time.Since(begin).Seconds())
 	as.m.AggregateSum.Observe(float64(aggregateSum))
 }
 
-// clean stats of a second.
-func (as *collectorService) breathe() {
-	begin := time.Now()
-	for campaignUUID, operatorAgregate := range as.adReport {
-		for operatorCode, _ := range operatorAgregate {
-			delete(as.adReport[campaignUUID], operatorCode)
-		}
-		delete(as.adReport, campaignUUID)
+func (as *collectorService) capEvents(sinkName string, archive []ReporterEvent) []ReporterEvent {
+	if as.eventsSize <= 0 || len(archive) <= as.eventsSize {
+		return archive
 	}
+	dropped := len(archive) - as.eventsSize
+	as.m.EventsDropped.WithLabelValues(sinkName).Add(float64(dropped))
+	log.WithFields(log.Fields{
+		"sink":    sinkName,
+		"dropped": dropped,
+	}).Warn("event archive is full, the oldest events are dropped")
+	return append([]ReporterEvent(nil), archive[dropped:]...)
+}
+
+// take and clean stats of a second.
+func (as *collectorService) breathe() map[string]OperatorAgregate {
+	begin := time.Now()
+	report := as.shards.flush()
 	log.WithFields(log.Fields{"took": time.Since(begin)}).Debug("breathe")
 	as.m.BreatheDuration.Observe(time.Since(begin).Seconds())
+	return report
+}
+
+type dateAgregate map[string]CampaignAgregate // by date
+
+func (agg dateAgregate) get(date, campaignUUID string, operatorCode int64) adAggregate {
+	if _, ok := agg[date]; !ok {
+		agg[date] = CampaignAgregate{}
+	}
+	if _, ok := agg[date][campaignUUID]; !ok {
+		agg[date][campaignUUID] = OperatorAgregate{}
+	}
+	if _, ok := agg[date][campaignUUID][operatorCode]; !ok {
+		agg[date][campaignUUID][operatorCode] = newAdAggregate()
+	}
+	return agg[date][campaignUUID][operatorCode]
+}
+
+// transactions are grouped by whether they have attempts, the count itself does not matter
+func attemptsOf(retried bool) int {
+	if retried {
+		return 1
+	}
+	return 0
 }
 
 // api call to get data from database
-func (as *collectorService) GetAggregate(from, to time.Time) (res []xmp_api_structs.Aggregate, err error) {
+func (as *collectorService) GetAggregate(f AggregateFilter) (res []Aggregate, err error) {
+	from, to := f.From, f.To
 	log.WithFields(log.Fields{
-		"from": from.Format("2006-01-02"),
-		"to":   to.Format("2006-01-02"),
+		"from":     from.Format("2006-01-02"),
+		"to":       to.Format("2006-01-02"),
+		"tz":       f.Location.String(),
+		"group_by": f.GroupBy,
 	}).Debug("aggregate api get req")
 
-	agg := make(map[string]CampaignAgregate) // time.Time (date) - campaign - operator code
+	agg := dateAgregate{} // time.Time (date) - campaign - operator code
+	where, args := f.where()
+	hitsVariant, transactionsVariant := Svc.conf.AggregateTables.variants()
 
 	query := fmt.Sprintf("SELECT "+
-		"date(sent_at), "+
+		"date("+aggregateLocalSentAt+") sent_date, "+
 		"id_campaign, "+
 		"operator_code, "+
+		transactionsVariant+" landing_variant, "+
 		"result, "+
+		"COALESCE(attempts_count, 0) > 0 retried, "+
 		"sum(price), "+
 		"count(*) "+
 		"FROM %stransactions "+
-		"WHERE sent_at > $1 AND sent_at < $2 "+
-		"GROUP BY date(sent_at), id_campaign, operator_code, result",
+		"WHERE "+aggregateBounds+where+" "+
+		"GROUP BY sent_date, id_campaign, operator_code, landing_variant, result, retried",
 		Svc.dbConf.TablePrefix,
 	)
 	var rows *sql.Rows
 
-	rows, err = Svc.db.Query(query, from, to)
+	rows, err = Svc.db.Query(query, args...)
 	if err != nil {
 		err = fmt.Errorf("db.Query: %s, query: %s", err.Error(), query)
 		return
@@ -399,58 +657,30 @@ func (as *collectorService) GetAggregate(from, to time.Time) (res []xmp_api_stru
 	defer rows.Close()
 	for rows.Next() {
 		var sentAt string
+		var landingVariant string
 		var result string
+		var retried bool
 		var sum int
 		var count int
-		if err = rows.Scan(&sentAt, &campaignUUID, &operatorCode, &result, &sum, &count); err != nil {
+		if err = rows.Scan(&sentAt, &campaignUUID, &operatorCode, &landingVariant, &result, &retried, &sum, &count); err != nil {
 			err = fmt.Errorf("rows.Scan: %s", err.Error())
 			return
 		}
-		sentAt = sentAt[0:10]
 		rowsCount++
-		if _, ok := agg[sentAt]; !ok {
-			agg[sentAt] = CampaignAgregate{}
-		}
-		if _, ok := agg[sentAt][campaignUUID]; !ok {
-			agg[sentAt][campaignUUID] = OperatorAgregate{}
-		}
-		if _, ok := agg[sentAt][campaignUUID][operatorCode]; !ok {
-			agg[sentAt][campaignUUID][operatorCode] = newAdAggregate()
-		}
+		date, groupCampaign, groupOperator := f.groupKey(sentAt[0:10], campaignUUID, operatorCode)
+		a := agg.get(date, Collect{CampaignUUID: groupCampaign, LandingVariant: landingVariant}.reportKey(), groupOperator)
+		// as the live reporter does, a charge after attempts is a renewal
+		result = as.results.key(result, attemptsOf(retried))
 
-		switch result {
-		case "paid":
-			agg[sentAt][campaignUUID][operatorCode].MoChargeSuccess.Set(count)
-			agg[sentAt][campaignUUID][operatorCode].MoChargeSum.Set(sum)
-			agg[sentAt][campaignUUID][operatorCode].MoTotal.Add(count)
-		case "failed":
-			agg[sentAt][campaignUUID][operatorCode].MoTotal.Add(count)
-			agg[sentAt][campaignUUID][operatorCode].MoChargeFailed.Set(count)
-		case "retry_paid":
-			agg[sentAt][campaignUUID][operatorCode].RenewalChargeSuccess.Set(count)
-			agg[sentAt][campaignUUID][operatorCode].RenewalChargeSum.Set(sum)
-			agg[sentAt][campaignUUID][operatorCode].RenewalTotal.Add(count)
-		case "retry_failed":
-			agg[sentAt][campaignUUID][operatorCode].RenewalTotal.Add(count)
-			agg[sentAt][campaignUUID][operatorCode].RenewalFailed.Set(count)
-		case "injection_paid":
-			agg[sentAt][campaignUUID][operatorCode].InjectionChargeSuccess.Set(count)
-			agg[sentAt][campaignUUID][operatorCode].InjectionChargeSum.Set(sum)
-			agg[sentAt][campaignUUID][operatorCode].InjectionTotal.Add(count)
-		case "injection_failed":
-			agg[sentAt][campaignUUID][operatorCode].InjectionTotal.Add(count)
-			agg[sentAt][campaignUUID][operatorCode].InjectionFailed.Set(count)
-		case "expired_paid":
-			agg[sentAt][campaignUUID][operatorCode].MoChargeSuccess.Set(count)
-			agg[sentAt][campaignUUID][operatorCode].MoChargeSum.Set(sum)
-			agg[sentAt][campaignUUID][operatorCode].MoTotal.Add(count)
-		case "expired_failed":
-			agg[sentAt][campaignUUID][operatorCode].MoTotal.Add(count)
-			agg[sentAt][campaignUUID][operatorCode].MoChargeFailed.Set(count)
+		if !as.results.apply(a, result, count, toCents(sum, Svc.conf.PriceUnit)) {
+			log.WithFields(log.Fields{
+				"result": result,
+				"count":  count,
+			}).Debug("unknown transaction result")
 		}
 	}
 	if rows.Err() != nil {
-		err = fmt.Errorf("rows.Err: %s", err.Error())
+		err = fmt.Errorf("rows.Err: %s", rows.Err().Error())
 		return
 	}
 
@@ -463,68 +693,40 @@ func (as *collectorService) GetAggregate(from, to time.Time) (res []xmp_api_stru
 	rowsCount = 0
 
 	//============================
-	query = fmt.Sprintf("SELECT "+
-		"date(sent_at), "+
-		"id_campaign, "+
-		"operator_code, "+
-		"count(*) "+
-		"FROM %spixel_transactions "+
-		"WHERE sent_at > $1 AND sent_at < $2 "+
-		"GROUP BY date(sent_at), id_campaign, operator_code",
-		Svc.dbConf.TablePrefix,
-	)
-	rows, err = Svc.db.Query(query, from, to)
-	if err != nil {
-		err = fmt.Errorf("db.Query: %s, query: %s", err.Error(), query)
-		return
+	counted := []struct {
+		table   string
+		counter string
+	}{
+		{Svc.dbConf.TablePrefix + "pixel_transactions", "pixels"},
+		{Svc.conf.AggregateTables.name(Svc.conf.AggregateTables.Unsubscribes), "unsubscribes"},
+		{Svc.conf.AggregateTables.name(Svc.conf.AggregateTables.Content), "content_delivered"},
+		{Svc.conf.AggregateTables.name(Svc.conf.AggregateTables.SMS), "sms_sent"},
+		{Svc.conf.AggregateTables.name(Svc.conf.AggregateTables.Redirects), "redirects"},
 	}
-
-	defer rows.Close()
-	for rows.Next() {
-		var sentAt string
-		var count int
-		if err = rows.Scan(&sentAt, &campaignUUID, &operatorCode, &count); err != nil {
-			err = fmt.Errorf("rows.Scan: %s", err.Error())
-			return
-		}
-		sentAt = sentAt[0:10]
-		rowsCount++
-		if _, ok := agg[sentAt]; !ok {
-			agg[sentAt] = CampaignAgregate{}
-		}
-		if _, ok := agg[sentAt][campaignUUID]; !ok {
-			agg[sentAt][campaignUUID] = OperatorAgregate{}
+	for _, v := range counted {
+		if v.table == "" {
+			continue
 		}
-		if _, ok := agg[sentAt][campaignUUID][operatorCode]; !ok {
-			agg[sentAt][campaignUUID][operatorCode] = newAdAggregate()
+		if err = as.countRows(agg, f, v.table, v.counter); err != nil {
+			return
 		}
-		agg[sentAt][campaignUUID][operatorCode].Pixels.Set(count)
 	}
-	if rows.Err() != nil {
-		err = fmt.Errorf("rows.Err: %s", err.Error())
-		return
-	}
-	log.WithFields(log.Fields{
-		"from":  from.Format("2006-01-02"),
-		"to":    to.Format("2006-01-02"),
-		"table": "pixel_transactions",
-		"count": rowsCount,
-	}).Debug("aggregate api get req")
-	rowsCount = 0
 
 	//============================
+	// hits and transactions of landing variants are counted separately, as the reporter does
 	query = fmt.Sprintf("SELECT "+
-		"date(sent_at), "+
+		"date("+aggregateLocalSentAt+") sent_date, "+
 		"id_campaign, "+
 		"operator_code, "+
+		hitsVariant+" landing_variant, "+
 		"CASE length(msisdn) WHEN 0 THEN false ELSE true END msisdn_present, "+
 		"count(*) "+
 		"FROM %scampaigns_access "+
-		"WHERE sent_at > $1 AND sent_at < $2 "+
-		"GROUP BY date(sent_at), msisdn_present, id_campaign, operator_code",
+		"WHERE "+aggregateBounds+where+" "+
+		"GROUP BY sent_date, msisdn_present, id_campaign, operator_code, landing_variant",
 		Svc.dbConf.TablePrefix,
 	)
-	rows, err = Svc.db.Query(query, from, to)
+	rows, err = Svc.db.Query(query, args...)
 	if err != nil {
 		err = fmt.Errorf("db.Query: %s, query: %s", err.Error(), query)
 		return
@@ -533,30 +735,24 @@ func (as *collectorService) GetAggregate(from, to time.Time) (res []xmp_api_stru
 	defer rows.Close()
 	for rows.Next() {
 		var sentAt string
+		var landingVariant string
 		var present bool
 		var count int
-		if err = rows.Scan(&sentAt, &campaignUUID, &operatorCode, &present, &count); err != nil {
+		if err = rows.Scan(&sentAt, &campaignUUID, &operatorCode, &landingVariant, &present, &count); err != nil {
 			err = fmt.Errorf("rows.Scan: %s", err.Error())
 			return
 		}
 		rowsCount++
-		sentAt = sentAt[0:10]
-		if _, ok := agg[sentAt]; !ok {
-			agg[sentAt] = CampaignAgregate{}
-		}
-		if _, ok := agg[sentAt][campaignUUID]; !ok {
-			agg[sentAt][campaignUUID] = OperatorAgregate{}
-		}
-		if _, ok := agg[sentAt][campaignUUID][operatorCode]; !ok {
-			agg[sentAt][campaignUUID][operatorCode] = newAdAggregate()
-		}
-		agg[sentAt][campaignUUID][operatorCode].LpHits.Add(count)
+		date, groupCampaign, groupOperator := f.groupKey(sentAt[0:10], campaignUUID, operatorCode)
+		reportKey := Collect{CampaignUUID: groupCampaign, LandingVariant: landingVariant}.reportKey()
+		a := agg.get(date, reportKey, groupOperator)
+		a.LpHits.Add(count)
 		if present {
-			agg[sentAt][campaignUUID][operatorCode].LpMsisdnHits.Add(count)
+			a.LpMsisdnHits.Add(count)
 		}
 	}
 	if rows.Err() != nil {
-		err = fmt.Errorf("rows.Err: %s", err.Error())
+		err = fmt.Errorf("rows.Err: %s", rows.Err().Error())
 		return
 	}
 	log.WithFields(log.Fields{
@@ -567,22 +763,25 @@ func (as *collectorService) GetAggregate(from, to time.Time) (res []xmp_api_stru
 	}).Debug("aggregate api get req")
 	rowsCount = 0
 
-	res = []xmp_api_structs.Aggregate{}
+	res = []Aggregate{}
 	for dateSent, agByCampaign := range agg {
-		for campaignUUID, agByOperatorCode := range agByCampaign {
+		for reportKey, agByOperatorCode := range agByCampaign {
+			campaignUUID, landingVariant := splitReportKey(reportKey)
 			for operatorCode, ag := range agByOperatorCode {
 				var reportAt time.Time
-				reportAt, err = time.Parse("2006-01-02", dateSent)
+				reportAt, err = time.ParseInLocation("2006-01-02", dateSent, f.Location)
 				if err != nil {
 					err = fmt.Errorf("time.Parse: %s", err.Error())
 					return
 				}
-				res = append(res, ag.generateReport(
+				report := ag.generateReport(
 					Svc.xmpAPIConf.InstanceId,
 					campaignUUID,
 					operatorCode,
 					reportAt,
-				))
+				)
+				report.LandingVariant = landingVariant
+				res = append(res, report)
 			}
 		}
 
@@ -595,7 +794,54 @@ func (as *collectorService) GetAggregate(from, to time.Time) (res []xmp_api_stru
 	return
 }
 
-// map[campaign][operator]acceptor.Aggregate
+// count rows of the table grouped by date, campaign and operator
+// table must have sent_at, id_campaign and operator_code columns
+func (as *collectorService) countRows(agg dateAgregate, f AggregateFilter, table, counterName string) (err error) {
+	where, args := f.where()
+	query := fmt.Sprintf("SELECT "+
+		"date("+aggregateLocalSentAt+") sent_date, "+
+		"id_campaign, "+
+		"operator_code, "+
+		"count(*) "+
+		"FROM %s "+
+		"WHERE "+aggregateBounds+where+" "+
+		"GROUP BY sent_date, id_campaign, operator_code",
+		table,
+	)
+	rows, err := Svc.db.Query(query, args...)
+	if err != nil {
+		err = fmt.Errorf("db.Query: %s, query: %s", err.Error(), query)
+		return
+	}
+	defer rows.Close()
+
+	var rowsCount int
+	for rows.Next() {
+		var sentAt string
+		var campaignUUID string
+		var operatorCode int64
+		var count int
+		if err = rows.Scan(&sentAt, &campaignUUID, &operatorCode, &count); err != nil {
+			err = fmt.Errorf("rows.Scan: %s", err.Error())
+			return
+		}
+		rowsCount++
+		a := agg.get(f.groupKey(sentAt[0:10], campaignUUID, operatorCode))
+		a.counter(counterName).Add(count)
+	}
+	if rows.Err() != nil {
+		err = fmt.Errorf("rows.Err: %s", rows.Err().Error())
+		return
+	}
+	log.WithFields(log.Fields{
+		"from":  f.From.Format("2006-01-02"),
+		"to":    f.To.Format("2006-01-02"),
+		"table": table,
+		"count": rowsCount,
+	}).Debug("aggregate api get req")
+	return nil
+}
+
 func (as *collectorService) check(r Collect) error {
 	if r.CampaignUUID == "" {
 		as.m.Errors.Inc()
@@ -604,137 +850,137 @@ func (as *collectorService) check(r Collect) error {
 		return fmt.Errorf("CampaignIdEmpty: %#v", r)
 	}
 
+	// operator code == 0
+	// unknown operator in access campaign
 	if r.OperatorCode == 0 {
 		as.m.Errors.Inc()
 		as.m.ErrorOperatorCodeEmpty.Inc()
 		log.WithField("collect", fmt.Sprintf("%#v", r)).Error("operator code is empty")
 	}
-	as.Lock()
-	defer as.Unlock()
-
-	// operator code == 0
-	// unknown operator in access campaign
-	if as.adReport == nil {
-		as.adReport = make(map[string]OperatorAgregate)
-	}
-	_, found := as.adReport[r.CampaignUUID]
-	if !found {
-		as.adReport[r.CampaignUUID] = OperatorAgregate{}
-	}
-	_, found = as.adReport[r.CampaignUUID][r.OperatorCode]
-	if !found {
-		as.adReport[r.CampaignUUID][r.OperatorCode] = newAdAggregate()
-	}
 	as.m.Success.Inc()
 	return nil
 }
-func (as *collectorService) incHit(r Collect) error {
+
+// checks the event and changes counters of its campaign and operator
+func (as *collectorService) inc(r Collect, fn func(a adAggregate)) error {
 	if err := as.check(r); err != nil {
 		return err
 	}
-	as.Lock()
-	defer as.Unlock()
-
-	as.adReport[r.CampaignUUID][r.OperatorCode].LpHits.Inc()
-	if r.Msisdn != "" {
-		as.adReport[r.CampaignUUID][r.OperatorCode].LpMsisdnHits.Inc()
-	}
+	as.shards.inc(r.reportKey(), r.OperatorCode, fn)
 	return nil
 }
-func (as *collectorService) incTransaction(r Collect) error {
-	if err := as.check(r); err != nil {
-		return err
-	}
-	as.Lock()
-	defer as.Unlock()
-
-	if r.AttemptsCount == 0 {
-		as.adReport[r.CampaignUUID][r.OperatorCode].MoTotal.Inc()
-		if r.TransactionResult == "paid" {
-			as.adReport[r.CampaignUUID][r.OperatorCode].MoChargeSuccess.Inc()
-			as.adReport[r.CampaignUUID][r.OperatorCode].MoChargeSum.Add(r.Price)
+func (as *collectorService) incHit(r Collect) error {
+	return as.inc(r, func(a adAggregate) {
+		a.LpHits.Inc()
+		if r.Msisdn != "" {
+			a.LpMsisdnHits.Inc()
 		}
-		if r.TransactionResult == "rejected" {
-			as.adReport[r.CampaignUUID][r.OperatorCode].MoRejected.Inc()
+		// set by the dispatcher, checked again at the time of the hit for events which come late
+		if r.Inactive || (!r.SentAt.IsZero() && !Svc.CampaignSchedules.Active(r.CampaignUUID, r.SentAt)) {
+			a.LpHitsInactive.Inc()
 		}
-		if r.TransactionResult == "failed" {
-			as.adReport[r.CampaignUUID][r.OperatorCode].MoChargeFailed.Inc()
+		as.revenue.event(r, "lp_hit")
+	})
+}
+func (as *collectorService) incTransaction(r Collect) error {
+	r.TransactionResult = as.results.key(r.TransactionResult, r.AttemptsCount)
+
+	// the price is looked up only for charges, sums in different currencies cannot be added up
+	price, currency := 0, Svc.conf.Currency
+	success, _ := as.results.charge(r.TransactionResult)
+	if success || as.results.summed(r.TransactionResult) {
+		price, currency = r.price()
+		if r.CampaignUUID != "" && currency != Svc.conf.Currency {
+			as.m.CurrencyMismatch.Inc()
+			log.WithFields(log.Fields{
+				"tid":      r.Tid,
+				"currency": currency,
+				"expected": Svc.conf.Currency,
+			}).Warn("currency mismatch, price is not counted")
+			price = 0
 		}
-		log.WithField("tid", r.Tid).Debug("mo")
-		return nil
 	}
 
-	if strings.Contains(r.TransactionResult, "retry") {
-		as.adReport[r.CampaignUUID][r.OperatorCode].RenewalTotal.Inc()
-
-		if strings.Contains(r.TransactionResult, "retry_paid") {
-			as.adReport[r.CampaignUUID][r.OperatorCode].RenewalChargeSuccess.Inc()
-			as.adReport[r.CampaignUUID][r.OperatorCode].RenewalChargeSum.Add(r.Price)
-		}
-
-		if strings.Contains(r.TransactionResult, "retry_failed") {
-			as.adReport[r.CampaignUUID][r.OperatorCode].RenewalFailed.Inc()
-		}
-		log.WithField("tid", r.Tid).Debug("retry")
-		return nil
+	known := true
+	if err := as.inc(r, func(a adAggregate) {
+		known = as.results.apply(a, r.TransactionResult, 1, price)
+	}); err != nil {
+		return err
 	}
-
-	if strings.Contains(r.TransactionResult, "injection") {
-		as.adReport[r.CampaignUUID][r.OperatorCode].InjectionTotal.Inc()
-
-		if strings.Contains(r.TransactionResult, "injection_paid") {
-			as.adReport[r.CampaignUUID][r.OperatorCode].InjectionChargeSuccess.Inc()
-			as.adReport[r.CampaignUUID][r.OperatorCode].InjectionChargeSum.Add(r.Price)
-		}
-
-		if strings.Contains(r.TransactionResult, "injection_failed") {
-			as.adReport[r.CampaignUUID][r.OperatorCode].InjectionFailed.Inc()
-		}
-		log.WithField("tid", r.Tid).Debug("injection")
+	if !known {
+		as.m.UnknownResult.Inc()
+		log.WithFields(log.Fields{
+			"tid":    r.Tid,
+			"result": r.TransactionResult,
+		}).Warn("unknown transaction result")
 		return nil
 	}
+	as.revenue.transaction(r, as.results, price, currency)
 
-	if strings.Contains(r.TransactionResult, "expired") {
-		as.adReport[r.CampaignUUID][r.OperatorCode].ExpiredTotal.Inc()
-
-		if strings.Contains(r.TransactionResult, "expired_paid") {
-			as.adReport[r.CampaignUUID][r.OperatorCode].ExpiredChargeSuccess.Inc()
-			as.adReport[r.CampaignUUID][r.OperatorCode].ExpiredChargeSum.Add(r.Price)
-		}
-
-		if strings.Contains(r.TransactionResult, "expired_failed") {
-			as.adReport[r.CampaignUUID][r.OperatorCode].ExpiredFailed.Inc()
-		}
-		log.WithField("tid", r.Tid).Debug("expired")
-		return nil
+	// caps count only what is charged, on the day of the event
+	spend := 0
+	if success {
+		spend = price
 	}
-
+	Svc.CampaignCaps.Transaction(r.CampaignUUID, r.OperatorCode, as.results.mo(r.TransactionResult), spend, r.eventAt())
+	log.WithFields(log.Fields{
+		"tid":    r.Tid,
+		"result": r.TransactionResult,
+	}).Debug("transaction")
 	return nil
 }
 func (as *collectorService) incOutflow(r Collect) error {
-	if err := as.check(r); err != nil {
-		return err
-	}
-	as.Lock()
-	defer as.Unlock()
-
-	if strings.Contains(r.TransactionResult, "inact") ||
-		strings.Contains(r.TransactionResult, "purge") ||
-		strings.Contains(r.TransactionResult, "cancel") {
-		log.WithField("tid", r.Tid).Debug("outflow")
-		as.adReport[r.CampaignUUID][r.OperatorCode].Outflow.Inc()
-	}
-	return nil
+	return as.inc(r, func(a adAggregate) {
+		if strings.Contains(r.TransactionResult, "inact") ||
+			strings.Contains(r.TransactionResult, "purge") ||
+			strings.Contains(r.TransactionResult, "cancel") {
+			log.WithField("tid", r.Tid).Debug("outflow")
+			a.Outflow.Inc()
+		}
+	})
 }
 func (as *collectorService) incPixel(r Collect) error {
-	if err := as.check(r); err != nil {
-		return err
-	}
-	as.Lock()
-	defer as.Unlock()
 	log.WithField("tid", r.Tid).Debug("pixel")
-	as.adReport[r.CampaignUUID][r.OperatorCode].Pixels.Inc()
-	return nil
+	return as.inc(r, func(a adAggregate) {
+		a.Pixels.Inc()
+	})
+}
+func (as *collectorService) incUnsubscribe(r Collect) error {
+	log.WithField("tid", r.Tid).Debug("unsubscribe")
+	return as.inc(r, func(a adAggregate) {
+		a.Unsubscribes.Inc()
+	})
+}
+
+// content delivery event has only unique url,
+// campaign and operator are taken from the unique urls cache
+func (as *collectorService) incContent(r Collect) error {
+	if r.CampaignUUID == "" && r.UniqueUrl != "" {
+		p, err := Svc.UniqueUrls.Get(r.UniqueUrl)
+		if err != nil {
+			return fmt.Errorf("UniqueUrls.Get: %s", err.Error())
+		}
+		r.CampaignUUID = p.CampaignId
+		r.OperatorCode = p.OperatorCode
+		r.Msisdn = p.Msisdn
+		r.Tid = p.Tid
+	}
+	log.WithField("tid", r.Tid).Debug("content delivered")
+	return as.inc(r, func(a adAggregate) {
+		a.ContentDelivered.Inc()
+	})
+}
+func (as *collectorService) incSMS(r Collect) error {
+	log.WithField("tid", r.Tid).Debug("sms")
+	return as.inc(r, func(a adAggregate) {
+		a.SMSSent.Inc()
+	})
+}
+func (as *collectorService) incRedirect(r Collect) error {
+	log.WithField("tid", r.Tid).Debug("redirect")
+	return as.inc(r, func(a adAggregate) {
+		a.Redirects.Inc()
+	})
 }
 
 type EventNotifyReporter struct {
@@ -743,101 +989,77 @@ type EventNotifyReporter struct {
 }
 
 func (as *collectorService) processHit(deliveries <-chan amqp_driver.Delivery) {
-
-	for msg := range deliveries {
-		var c EventNotifyReporter
-
-		if !Svc.conf.Enabled.Reporter {
-			goto ack
-		}
-		if err := json.Unmarshal(msg.Body, &c); err != nil {
-			log.WithFields(log.Fields{
-				"error": err.Error(),
-				"body":  string(msg.Body),
-				"msg":   "dropped",
-			}).Error("failed")
-		} else {
-			as.incHit(c.EventData)
-		}
-	ack:
-		if err := msg.Ack(false); err != nil {
-			log.WithFields(log.Fields{
-				"mo":    string(msg.Body),
-				"error": err.Error(),
-			}).Error("cannot ack")
-			time.Sleep(time.Second)
-			goto ack
-		}
-	}
+	as.process(as.queues.ReporterHit, deliveries, as.incHit)
 }
 func (as *collectorService) processPixel(deliveries <-chan amqp_driver.Delivery) {
-	for msg := range deliveries {
-		var c EventNotifyReporter
-
-		if !Svc.conf.Enabled.Reporter {
-			goto ack
-		}
-		if err := json.Unmarshal(msg.Body, &c); err != nil {
-			log.WithFields(log.Fields{
-				"error": err.Error(),
-				"body":  string(msg.Body),
-				"msg":   "dropped",
-			}).Error("failed")
-		} else {
-			as.incPixel(c.EventData)
-		}
-	ack:
-		if err := msg.Ack(false); err != nil {
-			log.WithFields(log.Fields{
-				"mo":    string(msg.Body),
-				"error": err.Error(),
-			}).Error("cannot ack")
-			time.Sleep(time.Second)
-			goto ack
-		}
-	}
+	as.process(as.queues.ReporterPixel, deliveries, as.incPixel)
 }
 func (as *collectorService) processTransactions(deliveries <-chan amqp_driver.Delivery) {
-	for msg := range deliveries {
-		var c EventNotifyReporter
-		if !Svc.conf.Enabled.Reporter {
-			goto ack
-		}
-		if err := json.Unmarshal(msg.Body, &c); err != nil {
-			log.WithFields(log.Fields{
-				"error": err.Error(),
-				"body":  string(msg.Body),
-				"msg":   "dropped",
-			}).Error("failed")
-		} else {
-			as.incTransaction(c.EventData)
-		}
-	ack:
-		if err := msg.Ack(false); err != nil {
-			log.WithFields(log.Fields{
-				"mo":    string(msg.Body),
-				"error": err.Error(),
-			}).Error("cannot ack")
-			time.Sleep(time.Second)
-			goto ack
-		}
-	}
+	as.process(as.queues.ReporterTransaction, deliveries, as.incTransaction)
 }
 func (as *collectorService) processOutflow(deliveries <-chan amqp_driver.Delivery) {
+	as.process(as.queues.ReporterOutflow, deliveries, as.incOutflow)
+}
+func (as *collectorService) processUnsubscribe(deliveries <-chan amqp_driver.Delivery) {
+	as.process(as.queues.ReporterUnsubscribe, deliveries, as.incUnsubscribe)
+}
+func (as *collectorService) processContent(deliveries <-chan amqp_driver.Delivery) {
+	as.process(as.queues.ReporterContent, deliveries, as.incContent)
+}
+func (as *collectorService) processSMS(deliveries <-chan amqp_driver.Delivery) {
+	as.process(as.queues.ReporterSMS, deliveries, as.incSMS)
+}
+func (as *collectorService) processRedirect(deliveries <-chan amqp_driver.Delivery) {
+	as.process(as.queues.ReporterRedirect, deliveries, as.incRedirect)
+}
+
+// keep raw event for sinks till the next send
+func (as *collectorService) pushEvent(queue string, c EventNotifyReporter) {
+	as.eventsMutex.Lock()
+	defer as.eventsMutex.Unlock()
+	as.events = append(as.events, ReporterEvent{
+		EventName:  c.EventName,
+		Queue:      queue,
+		ReceivedAt: time.Now().UTC(),
+		Collect:    c.EventData,
+	})
+}
+
+// threads_count workers share deliveries of the queue
+func (as *collectorService) process(queue qconf.ConsumeQueueConfig, deliveries <-chan amqp_driver.Delivery, inc func(Collect) error) {
+	threads := queue.ThreadsCount
+	if threads < 1 {
+		threads = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			as.work(queue.Name, deliveries, inc)
+		}()
+	}
+	wg.Wait()
+}
+
+// malformed and invalid events go to the dead letter queue
+func (as *collectorService) work(queue string, deliveries <-chan amqp_driver.Delivery, inc func(Collect) error) {
 	for msg := range deliveries {
 		var c EventNotifyReporter
+		begin := time.Now()
+
 		if !Svc.conf.Enabled.Reporter {
 			goto ack
 		}
 		if err := json.Unmarshal(msg.Body, &c); err != nil {
-			log.WithFields(log.Fields{
-				"error": err.Error(),
-				"body":  string(msg.Body),
-				"msg":   "dropped",
-			}).Error("failed")
+			as.deadLetters.publish(queue, msg, deadLetterMalformed, err)
+		} else if err := inc(c.EventData); err != nil {
+			as.deadLetters.publish(queue, msg, deadLetterInvalid, err)
 		} else {
-			as.incOutflow(c.EventData)
+			as.pushEvent(queue, c)
 		}
+		as.m.Processed.WithLabelValues(queue).Inc()
+		as.m.ProcessDuration.WithLabelValues(queue).Observe(time.Since(begin).Seconds())
 	ack:
 		if err := msg.Ack(false); err != nil {
 			log.WithFields(log.Fields{
@@ -0,0 +1,246 @@
+package service
+
+// rebuild aggregates of a period from the db and push them to the sinks again
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	BackfillRunning   = "running"
+	BackfillDone      = "done"
+	BackfillFailed    = "failed"
+	BackfillCancelled = "cancelled"
+)
+
+// job is kept in the collector state, so it continues after restart
+type BackfillJob struct {
+	Id            string    `json:"id"`
+	Status        string    `json:"status"`
+	Error         string    `json:"error,omitempty"`
+	From          time.Time `json:"from"`
+	To            time.Time `json:"to"`
+	Next          time.Time `json:"next"` // the first day which isn't pushed yet
+	TimeZone      string    `json:"tz"`
+	CampaignUUIDs []string  `json:"campaigns,omitempty"`
+	OperatorCode  int64     `json:"operator_code,omitempty"`
+	Days          int       `json:"days"`
+	DaysDone      int       `json:"days_done"`
+	Aggregates    int       `json:"aggregates"`
+	StartedAt     time.Time `json:"started_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+func newBackfillJob(f AggregateFilter) BackfillJob {
+	now := time.Now().UTC()
+	return BackfillJob{
+		Id:            strconv.FormatInt(now.UnixNano(), 36),
+		Status:        BackfillRunning,
+		From:          f.From,
+		To:            f.To,
+		Next:          f.From,
+		TimeZone:      f.Location.String(),
+		CampaignUUIDs: f.CampaignUUIDs,
+		OperatorCode:  f.OperatorCode,
+		Days:          int(f.To.Sub(f.From).Hours()/24 + 0.5),
+		StartedAt:     now,
+		UpdatedAt:     now,
+	}
+}
+
+// filter of the next day of the job, false if the job is over
+func (job BackfillJob) nextDay() (AggregateFilter, bool, error) {
+	loc, err := time.LoadLocation(job.TimeZone)
+	if err != nil {
+		return AggregateFilter{}, false, fmt.Errorf("time.LoadLocation: %s", err.Error())
+	}
+	from := job.Next.In(loc)
+	if !from.Before(job.To) {
+		return AggregateFilter{}, false, nil
+	}
+	return AggregateFilter{
+		From:          from,
+		To:            from.AddDate(0, 0, 1),
+		CampaignUUIDs: job.CampaignUUIDs,
+		OperatorCode:  job.OperatorCode,
+		GroupBy:       GroupByDay,
+		Location:      loc,
+	}, true, nil
+}
+
+func (as *collectorService) StartBackfill(f AggregateFilter) (BackfillJob, error) {
+	as.Lock()
+	defer as.Unlock()
+
+	if as.state.Backfill != nil && as.state.Backfill.Status == BackfillRunning {
+		return *as.state.Backfill, fmt.Errorf("Backfill %s is running", as.state.Backfill.Id)
+	}
+	if !f.From.Before(f.To) {
+		return BackfillJob{}, fmt.Errorf("Wrong period: %s - %s", f.From.Format("2006-01-02"), f.To.Format("2006-01-02"))
+	}
+	job := newBackfillJob(f)
+	as.state.Backfill = &job
+	go as.runBackfill(job.Id)
+	return job, nil
+}
+
+func (as *collectorService) BackfillStatus() (BackfillJob, bool) {
+	as.RLock()
+	defer as.RUnlock()
+	if as.state.Backfill == nil {
+		return BackfillJob{}, false
+	}
+	return *as.state.Backfill, true
+}
+
+func (as *collectorService) CancelBackfill() (BackfillJob, error) {
+	as.Lock()
+	defer as.Unlock()
+	if as.state.Backfill == nil || as.state.Backfill.Status != BackfillRunning {
+		return BackfillJob{}, fmt.Errorf("No running backfill%s", "")
+	}
+	as.state.Backfill.Status = BackfillCancelled
+	as.state.Backfill.UpdatedAt = time.Now().UTC()
+	if err := as.saveState(); err != nil {
+		log.WithField("error", err.Error()).Error("cannot save backfill state")
+	}
+	return *as.state.Backfill, nil
+}
+
+// continue the job after restart
+func (as *collectorService) resumeBackfill() {
+	if job, ok := as.BackfillStatus(); ok && job.Status == BackfillRunning {
+		log.WithFields(log.Fields{
+			"id":   job.Id,
+			"next": job.Next.Format("2006-01-02"),
+		}).Info("resume backfill")
+		go as.runBackfill(job.Id)
+	}
+}
+
+// checked by the backfill while the archives of the sinks are not sent
+const backfillDrainInterval = time.Second
+
+// day by day, aggregates are added to the archives of all sinks and sent by the usual send,
+// the next day waits till the archives are drained, so a sink which is down doesn't get the whole range,
+// progress is saved after each day
+func (as *collectorService) runBackfill(id string) {
+	for {
+		job, ok := as.BackfillStatus()
+		if !ok || job.Id != id || job.Status != BackfillRunning {
+			return
+		}
+		logCtx := log.WithFields(log.Fields{
+			"id":   job.Id,
+			"next": job.Next.Format("2006-01-02"),
+		})
+
+		f, ok, err := job.nextDay()
+		if err == nil && ok && !as.archivesDrained() {
+			logCtx.Debug("backfill waits for the archives")
+			time.Sleep(backfillDrainInterval)
+			continue
+		}
+		var res []Aggregate
+		if err == nil && ok {
+			res, err = as.GetAggregate(f)
+		}
+
+		as.Lock()
+		if as.state.Backfill == nil || as.state.Backfill.Id != id || as.state.Backfill.Status != BackfillRunning {
+			as.Unlock()
+			return
+		}
+		current := as.state.Backfill
+		current.UpdatedAt = time.Now().UTC()
+		switch {
+		case err != nil:
+			current.Status = BackfillFailed
+			current.Error = err.Error()
+			logCtx.WithField("error", err.Error()).Error("backfill failed")
+		case !ok:
+			current.Status = BackfillDone
+			logCtx.WithField("aggregates", current.Aggregates).Info("backfill done")
+		default:
+			as.archiveBackfill(res)
+			current.Next = f.To
+			current.DaysDone++
+			current.Aggregates += len(res)
+			logCtx.WithField("aggregates", len(res)).Debug("backfill day")
+		}
+		if err := as.saveState(); err != nil {
+			logCtx.WithField("error", err.Error()).Error("cannot save backfill progress")
+		}
+		as.Unlock()
+	}
+}
+
+func (as *collectorService) archivesDrained() bool {
+	as.Lock()
+	defer as.Unlock()
+	for _, sink := range as.sinks {
+		if len(as.state.Archives[sink.Name()]) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// must be called under the lock
+func (as *collectorService) archiveBackfill(res []Aggregate) {
+	if as.state.Archives == nil {
+		as.state.Archives = make(map[string][]interface{})
+	}
+	for _, sink := range as.sinks {
+		for _, a := range res {
+			a.Backfill = true
+			as.state.Archives[sink.Name()] = append(as.state.Archives[sink.Name()], a)
+		}
+	}
+}
+
+func AddBackfillHandlers(e *gin.Engine) {
+	g := e.Group("api")
+	g.POST("/aggregate/backfill", startBackfillHandler)
+	g.GET("/aggregate/backfill/status", getBackfillStatusHandler)
+	g.POST("/aggregate/backfill/cancel", cancelBackfillHandler)
+}
+
+// /api/aggregate/backfill?from=2017-01-01&to=2017-02-01&campaign=290
+// takes the same filters as /api/aggregate/get, aggregates are always by day
+func startBackfillHandler(c *gin.Context) {
+	f, err := parseAggregateFilter(c)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	job, err := Svc.reporter.StartBackfill(f)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error(), "job": job})
+		return
+	}
+	c.JSON(200, job)
+}
+
+func getBackfillStatusHandler(c *gin.Context) {
+	job, ok := Svc.reporter.BackfillStatus()
+	if !ok {
+		c.JSON(404, gin.H{"error": "No backfill"})
+		return
+	}
+	c.JSON(200, job)
+}
+
+func cancelBackfillHandler(c *gin.Context) {
+	job, err := Svc.reporter.CancelBackfill()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, job)
+}
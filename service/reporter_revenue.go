@@ -0,0 +1,303 @@
+package service
+
+// revenue, conversion and arpu per campaign, operator and date
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	PriceUnitCents = "cents"
+	PriceUnitUnits = "units"
+)
+
+// reporter counts charge sums in cents
+func toCents(price int, unit string) int {
+	if unit == PriceUnitUnits {
+		return 100 * price
+	}
+	return price
+}
+
+// price of the event in cents and its currency,
+// price unit and currency of the config are used if the event has none,
+// effective price of the service of the campaign at the time of the event if the event has no price
+func (r Collect) price() (int, string) {
+	currency := r.Currency
+	if r.Price == 0 {
+		if ep, ok := r.effectivePrice(); ok {
+			if currency == "" {
+				currency = ep.Currency
+			}
+			if currency == "" {
+				currency = Svc.conf.Currency
+			}
+			return ep.PriceCents, currency
+		}
+	}
+	if currency == "" {
+		currency = Svc.conf.Currency
+	}
+	unit := r.PriceUnit
+	if unit == "" {
+		unit = Svc.conf.PriceUnit
+	}
+	return toCents(r.Price, unit), currency
+}
+
+// time the event is sent, now for the events without one
+func (r Collect) eventAt() time.Time {
+	if r.SentAt.IsZero() {
+		return time.Now()
+	}
+	return r.SentAt
+}
+
+// price of the service of the campaign for the operator at the time of the event
+func (r Collect) effectivePrice() (EffectivePrice, bool) {
+	if !Svc.conf.Enabled.ServicePrices || r.CampaignUUID == "" {
+		return EffectivePrice{}, false
+	}
+	camp, err := Svc.Campaigns.GetByUUID(r.CampaignUUID)
+	if err != nil || camp.ServiceCode == "" {
+		return EffectivePrice{}, false
+	}
+	ep, err := Svc.ServicePrices.PriceFor(camp.ServiceCode, r.OperatorCode, r.eventAt())
+	if err != nil {
+		return EffectivePrice{}, false
+	}
+	return ep, true
+}
+
+type RevenueReport struct {
+	ReportAt          int64   `json:"report_at"`
+	CampaignId        string  `json:"campaign_id"`
+	CampaignCode      string  `json:"campaign_code"`
+	OperatorCode      int64   `json:"operator_code"`
+	LandingVariant    string  `json:"landing_variant,omitempty"`
+	Currency          string  `json:"currency"`
+	Revenue           float64 `json:"revenue"` // in currency units, not cents
+	LpHits            int64   `json:"lp_hits"`
+	MoTotal           int64   `json:"mo"`
+	ChargeSuccess     int64   `json:"charge_success"`
+	ChargeFailed      int64   `json:"charge_failed"`
+	Subscribers       int64   `json:"subscribers"`         // unique charged msisdns
+	ConversionRate    float64 `json:"conversion_rate"`     // mo / lp hits
+	ChargeSuccessRate float64 `json:"charge_success_rate"` // success / (success + failed)
+	ARPU              float64 `json:"arpu"`                // revenue / subscribers
+}
+
+func newRevenueReport(a Aggregate, subscribers int64) RevenueReport {
+	r := RevenueReport{
+		ReportAt:       a.ReportAt,
+		CampaignId:     a.CampaignId,
+		CampaignCode:   a.CampaignCode,
+		OperatorCode:   a.OperatorCode,
+		LandingVariant: a.LandingVariant,
+		Currency:       a.Currency,
+		Revenue: float64(a.MoChargeSum+
+			a.RenewalChargeSum+
+			a.InjectionChargeSum+
+			a.ExpiredChargeSum) / 100,
+		LpHits:  a.LpHits,
+		MoTotal: a.MoTotal,
+		ChargeSuccess: a.MoChargeSuccess +
+			a.RenewalChargeSuccess +
+			a.InjectionChargeSuccess +
+			a.ExpiredChargeSuccess,
+		ChargeFailed: a.MoChargeFailed +
+			a.RenewalFailed +
+			a.InjectionFailed +
+			a.ExpiredFailed,
+		Subscribers: subscribers,
+	}
+	if r.LpHits > 0 {
+		r.ConversionRate = float64(r.MoTotal) / float64(r.LpHits)
+	}
+	if r.ChargeSuccess+r.ChargeFailed > 0 {
+		r.ChargeSuccessRate = float64(r.ChargeSuccess) / float64(r.ChargeSuccess+r.ChargeFailed)
+	}
+	if r.Subscribers > 0 {
+		r.ARPU = r.Revenue / float64(r.Subscribers)
+	}
+	return r
+}
+
+// group expressions have to match AggregateFilter.groupKey,
+// otherwise unique msisdns would be counted twice
+func (f AggregateFilter) groupSQL() (date, campaign, operator string) {
+	date, campaign, operator = "date("+aggregateLocalSentAt+")", "id_campaign", "operator_code"
+	switch f.GroupBy {
+	case GroupByWeek:
+		date = "date(date_trunc('week', " + aggregateLocalSentAt + "))"
+	case GroupByMonth:
+		date = "date(date_trunc('month', " + aggregateLocalSentAt + "))"
+	case GroupByCampaign:
+		date, operator = aggregateLocalFrom, "0"
+	case GroupByOperator:
+		date, campaign = aggregateLocalFrom, "''"
+	}
+	return
+}
+
+func (as *collectorService) GetRevenue(f AggregateFilter) (res []RevenueReport, err error) {
+	aggregates, err := as.GetAggregate(f)
+	if err != nil {
+		err = fmt.Errorf("GetAggregate: %s", err.Error())
+		return
+	}
+
+	subscribers := make(map[string]int64)
+	key := func(date, campaignUUID string, operatorCode int64, landingVariant string) string {
+		return fmt.Sprintf("%s-%s-%d-%s", date, campaignUUID, operatorCode, landingVariant)
+	}
+	_, transactionsVariant := Svc.conf.AggregateTables.variants()
+
+	// charged results differ with attempts as the live reporter counts them
+	charged, chargedRetried := as.results.chargedResults(0), as.results.chargedResults(1)
+	if len(charged) > 0 || len(chargedRetried) > 0 {
+		where, args := f.where()
+		placeHolders := func(results []string) string {
+			if len(results) == 0 {
+				return "NULL"
+			}
+			res := []string{}
+			for _, result := range results {
+				args = append(args, result)
+				res = append(res, fmt.Sprintf("$%d", len(args)))
+			}
+			return strings.Join(res, ", ")
+		}
+		chargedIn, chargedRetriedIn := placeHolders(charged), placeHolders(chargedRetried)
+		date, campaign, operator := f.groupSQL()
+		query := fmt.Sprintf("SELECT "+
+			date+" sent_date, "+
+			campaign+" campaign, "+
+			operator+" operator, "+
+			transactionsVariant+" landing_variant, "+
+			"count(DISTINCT msisdn) "+
+			"FROM %stransactions "+
+			"WHERE "+aggregateBounds+where+" "+
+			"AND ((COALESCE(attempts_count, 0) = 0 AND lower(result) IN ("+chargedIn+")) "+
+			"OR (attempts_count > 0 AND lower(result) IN ("+chargedRetriedIn+"))) "+
+			"GROUP BY sent_date, campaign, operator, landing_variant",
+			Svc.dbConf.TablePrefix,
+		)
+
+		var rows *sql.Rows
+		rows, err = Svc.db.Query(query, args...)
+		if err != nil {
+			err = fmt.Errorf("db.Query: %s, query: %s", err.Error(), query)
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var sentAt string
+			var campaignUUID string
+			var operatorCode int64
+			var landingVariant string
+			var count int64
+			if err = rows.Scan(&sentAt, &campaignUUID, &operatorCode, &landingVariant, &count); err != nil {
+				err = fmt.Errorf("rows.Scan: %s", err.Error())
+				return
+			}
+			date, groupCampaign, groupOperator := f.groupKey(sentAt[0:10], campaignUUID, operatorCode)
+			subscribers[key(date, groupCampaign, groupOperator, landingVariant)] = count
+		}
+		if rows.Err() != nil {
+			err = fmt.Errorf("rows.Err: %s", rows.Err().Error())
+			return
+		}
+	}
+
+	res = make([]RevenueReport, 0, len(aggregates))
+	for _, a := range aggregates {
+		date := time.Unix(a.ReportAt, 0).In(f.Location).Format("2006-01-02")
+		res = append(res, newRevenueReport(a, subscribers[key(date, a.CampaignId, a.OperatorCode, a.LandingVariant)]))
+	}
+	log.WithFields(log.Fields{
+		"from": f.From.Format("2006-01-02"),
+		"to":   f.To.Format("2006-01-02"),
+		"len":  len(res),
+	}).Debug("revenue api get req")
+	return
+}
+
+func AddAPIGetRevenueHandler(e *gin.Engine) {
+	e.Group("api").GET("/revenue/get", getRevenueHandler)
+}
+
+// /api/revenue/get?from=2017-01-01&to=2017-02-01
+// takes the same filters as /api/aggregate/get, revenue per operator is group_by=operator
+func getRevenueHandler(c *gin.Context) {
+	f, err := parseAggregateFilter(c)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	res, err := Svc.reporter.GetRevenue(f)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Error while get revenue: " + err.Error()})
+		return
+	}
+	c.Writer.Header().Set("X-Total-Count", strconv.Itoa(len(res)))
+	c.JSON(200, res)
+}
+
+// live counters, rates and arpu are expected to be calculated in prometheus queries
+type revenueMetrics struct {
+	RevenueCents *prometheus.CounterVec // campaign, operator, currency
+	Events       *prometheus.CounterVec // campaign, operator, event: lp_hit, mo, charge_success, charge_failed
+}
+
+func initRevenueMetrics(appName string) *revenueMetrics {
+	rm := &revenueMetrics{
+		RevenueCents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: appName + "_reporter_revenue_cents",
+			Help: "charged sum in cents",
+		}, []string{"campaign", "operator", "currency"}),
+		Events: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: appName + "_reporter_events",
+			Help: "lp hits, mo and charges",
+		}, []string{"campaign", "operator", "event"}),
+	}
+	prometheus.MustRegister(rm.RevenueCents, rm.Events)
+	return rm
+}
+
+func (rm *revenueMetrics) event(r Collect, event string) {
+	rm.Events.WithLabelValues(campaignCode(r.CampaignUUID), strconv.FormatInt(r.OperatorCode, 10), event).Inc()
+}
+
+// price is counted in the currency for charged transactions
+func (rm *revenueMetrics) transaction(r Collect, results transactionResults, priceCents int, currency string) {
+	campaign, operator := campaignCode(r.CampaignUUID), strconv.FormatInt(r.OperatorCode, 10)
+	if results.mo(r.TransactionResult) {
+		rm.Events.WithLabelValues(campaign, operator, "mo").Inc()
+	}
+	success, failed := results.charge(r.TransactionResult)
+	if success {
+		rm.Events.WithLabelValues(campaign, operator, "charge_success").Inc()
+		rm.RevenueCents.WithLabelValues(campaign, operator, currency).Add(float64(priceCents))
+	}
+	if failed {
+		rm.Events.WithLabelValues(campaign, operator, "charge_failed").Inc()
+	}
+}
+
+// campaign uuid is too long for a label, uuid is kept for unknown campaigns
+func campaignCode(campaignUUID string) string {
+	if camp, err := Svc.Campaigns.GetByUUID(campaignUUID); err == nil && camp.Code != "" {
+		return camp.Code
+	}
+	return campaignUUID
+}
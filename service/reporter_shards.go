@@ -0,0 +1,80 @@
+package service
+
+// counters of the reporter are split by campaign,
+// so consumers of different campaigns don't wait for each other
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+)
+
+// counters of landing variants are kept separately, campaign/variant
+func (r Collect) reportKey() string {
+	if r.LandingVariant == "" {
+		return r.CampaignUUID
+	}
+	return r.CampaignUUID + "/" + r.LandingVariant
+}
+
+func splitReportKey(key string) (campaignUUID, landingVariant string) {
+	if i := strings.Index(key, "/"); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return key, ""
+}
+
+type reportShard struct {
+	sync.Mutex
+	adReport map[string]OperatorAgregate // map[campaign][operator]acceptor.Aggregate
+}
+
+type reportShards []*reportShard
+
+func newReportShards(count int) reportShards {
+	if count < 1 {
+		count = 1
+	}
+	rs := make(reportShards, count)
+	for i := range rs {
+		rs[i] = &reportShard{adReport: make(map[string]OperatorAgregate)}
+	}
+	return rs
+}
+
+func (rs reportShards) get(campaignUUID string) *reportShard {
+	h := fnv.New32a()
+	h.Write([]byte(campaignUUID))
+	return rs[h.Sum32()%uint32(len(rs))]
+}
+
+// changes counters of the campaign and operator under the lock of the shard
+func (rs reportShards) inc(campaignUUID string, operatorCode int64, fn func(a adAggregate)) {
+	s := rs.get(campaignUUID)
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.adReport[campaignUUID]; !ok {
+		s.adReport[campaignUUID] = OperatorAgregate{}
+	}
+	a, ok := s.adReport[campaignUUID][operatorCode]
+	if !ok {
+		a = newAdAggregate()
+		s.adReport[campaignUUID][operatorCode] = a
+	}
+	fn(a)
+}
+
+// takes counters of all shards and resets them
+func (rs reportShards) flush() map[string]OperatorAgregate {
+	res := make(map[string]OperatorAgregate)
+	for _, s := range rs {
+		s.Lock()
+		for campaignUUID, operatorAgregate := range s.adReport {
+			res[campaignUUID] = operatorAgregate
+		}
+		s.adReport = make(map[string]OperatorAgregate)
+		s.Unlock()
+	}
+	return res
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// inserts rows over clickhouse http interface in JSONEachRow format
+type ClickHouseSinkConfig struct {
+	Enabled        bool   `yaml:"enabled"`
+	Url            string `yaml:"url" default:"http://localhost:8123/"`
+	User           string `yaml:"user" default:"default"`
+	Password       string `yaml:"password"`
+	AggregateTable string `yaml:"aggregate_table"` // empty - do not send aggregates
+	EventTable     string `yaml:"event_table"`     // empty - do not send events
+	Timeout        int    `yaml:"timeout" default:"10"`
+}
+
+type clickHouseSink struct {
+	conf   ClickHouseSinkConfig
+	client *http.Client
+}
+
+func newClickHouseSink(conf ClickHouseSinkConfig) *clickHouseSink {
+	return &clickHouseSink{
+		conf:   conf,
+		client: &http.Client{Timeout: time.Duration(conf.Timeout) * time.Second},
+	}
+}
+
+func (s *clickHouseSink) Name() string {
+	return "clickhouse"
+}
+
+func (s *clickHouseSink) SendAggregates(data []interface{}) error {
+	if s.conf.AggregateTable == "" {
+		return nil
+	}
+	return s.insert(s.conf.AggregateTable, data)
+}
+
+func (s *clickHouseSink) SendEvents(events []ReporterEvent) error {
+	if s.conf.EventTable == "" {
+		return nil
+	}
+	data := make([]interface{}, 0, len(events))
+	for _, e := range events {
+		data = append(data, e)
+	}
+	return s.insert(s.conf.EventTable, data)
+}
+
+func (s *clickHouseSink) insert(table string, data []interface{}) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, v := range data {
+		if err := enc.Encode(v); err != nil {
+			return fmt.Errorf("json.Encode: %s", err.Error())
+		}
+	}
+
+	params := url.Values{}
+	params.Set("query", "INSERT INTO "+table+" FORMAT JSONEachRow")
+	params.Set("input_format_skip_unknown_fields", "1")
+	params.Set("date_time_input_format", "best_effort")
+
+	req, err := http.NewRequest("POST", s.conf.Url+"?"+params.Encode(), &body)
+	if err != nil {
+		return fmt.Errorf("http.NewRequest: %s", err.Error())
+	}
+	req.Header.Set("X-ClickHouse-User", s.conf.User)
+	req.Header.Set("X-ClickHouse-Key", s.conf.Password)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("client.Do: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("clickhouse: %s: %s", resp.Status, string(respBody))
+	}
+	return nil
+}
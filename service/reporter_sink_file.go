@@ -0,0 +1,157 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// writes aggregates.ndjson and events.ndjson into the directory,
+// files are rotated by size, only the last max_files rotated files are kept
+type FileSinkConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	Path       string `yaml:"path" default:"/var/log/linkit/reporter/"`
+	Aggregates bool   `yaml:"aggregates"`
+	Events     bool   `yaml:"events"`
+	MaxSizeMb  int64  `yaml:"max_size_mb" default:"100"`
+	MaxFiles   int    `yaml:"max_files" default:"10"`
+}
+
+type fileSink struct {
+	conf       FileSinkConfig
+	aggregates *rotatingFile
+	events     *rotatingFile
+}
+
+func newFileSink(conf FileSinkConfig) (*fileSink, error) {
+	if err := os.MkdirAll(conf.Path, 0755); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll: %s", err.Error())
+	}
+	return &fileSink{
+		conf: conf,
+		aggregates: &rotatingFile{
+			path:     filepath.Join(conf.Path, "aggregates.ndjson"),
+			maxSize:  conf.MaxSizeMb * 1024 * 1024,
+			maxFiles: conf.MaxFiles,
+		},
+		events: &rotatingFile{
+			path:     filepath.Join(conf.Path, "events.ndjson"),
+			maxSize:  conf.MaxSizeMb * 1024 * 1024,
+			maxFiles: conf.MaxFiles,
+		},
+	}, nil
+}
+
+func (s *fileSink) Name() string {
+	return "file"
+}
+
+func (s *fileSink) SendAggregates(data []interface{}) error {
+	if !s.conf.Aggregates {
+		return nil
+	}
+	return s.aggregates.write(data)
+}
+
+func (s *fileSink) SendEvents(events []ReporterEvent) error {
+	if !s.conf.Events {
+		return nil
+	}
+	data := make([]interface{}, 0, len(events))
+	for _, e := range events {
+		data = append(data, e)
+	}
+	return s.events.write(data)
+}
+
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+func (rf *rotatingFile) write(data []interface{}) error {
+	if rf.f == nil {
+		if err := rf.open(); err != nil {
+			return err
+		}
+	}
+	for _, v := range data {
+		line, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("json.Marshal: %s", err.Error())
+		}
+		n, err := rf.f.Write(append(line, '\n'))
+		rf.size = rf.size + int64(n)
+		if err != nil {
+			return fmt.Errorf("file.Write: %s", err.Error())
+		}
+	}
+	// the data is written, it must not be sent again if rotation fails
+	if rf.maxSize > 0 && rf.size >= rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			log.WithFields(log.Fields{
+				"path":  rf.path,
+				"error": err.Error(),
+			}).Error("cannot rotate reporter file")
+		}
+	}
+	return nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile: %s", err.Error())
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("file.Stat: %s", err.Error())
+	}
+	rf.f = f
+	rf.size = info.Size()
+	return nil
+}
+
+// aggregates.ndjson -> aggregates.20170102150405.000000001.ndjson
+// the suffix is unique, so rotated files of the same second are kept
+func (rf *rotatingFile) rotate() error {
+	rf.f.Close()
+	rf.f = nil
+
+	ext := filepath.Ext(rf.path)
+	base := strings.TrimSuffix(rf.path, ext)
+	now := time.Now().UTC()
+	rotatedPath := base + "." + now.Format("20060102150405") + fmt.Sprintf(".%09d", now.Nanosecond()) + ext
+	for n := 1; ; n++ {
+		if _, err := os.Stat(rotatedPath); os.IsNotExist(err) {
+			break
+		}
+		rotatedPath = base + "." + now.Format("20060102150405") + fmt.Sprintf(".%09d", now.Nanosecond()+n) + ext
+	}
+	if err := os.Rename(rf.path, rotatedPath); err != nil {
+		return fmt.Errorf("os.Rename: %s", err.Error())
+	}
+
+	rotated, err := filepath.Glob(base + ".*" + ext)
+	if err != nil {
+		return fmt.Errorf("filepath.Glob: %s", err.Error())
+	}
+	sort.Strings(rotated)
+	for len(rotated) > rf.maxFiles {
+		if err := os.Remove(rotated[0]); err != nil {
+			return fmt.Errorf("os.Remove: %s", err.Error())
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mid_reporter_file")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	rf := &rotatingFile{
+		path:     filepath.Join(dir, "events.ndjson"),
+		maxSize:  1,
+		maxFiles: 10,
+	}
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, rf.write([]interface{}{map[string]int{"n": i}}))
+	}
+	rotated, _ := filepath.Glob(filepath.Join(dir, "events.*.ndjson"))
+	assert.Equal(t, 3, len(rotated), "rotated files of the same second are kept")
+
+	rf.maxFiles = 2
+	assert.NoError(t, rf.write([]interface{}{map[string]int{"n": 3}}))
+	rotated, _ = filepath.Glob(filepath.Join(dir, "events.*.ndjson"))
+	assert.Equal(t, 2, len(rotated), "old files are removed")
+}
@@ -0,0 +1,75 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Shopify/sarama"
+)
+
+type KafkaSinkConfig struct {
+	Enabled        bool     `yaml:"enabled"`
+	Brokers        []string `yaml:"brokers"`
+	AggregateTopic string   `yaml:"aggregate_topic"` // empty - do not send aggregates
+	EventTopic     string   `yaml:"event_topic"`     // empty - do not send events
+}
+
+type kafkaSink struct {
+	conf     KafkaSinkConfig
+	producer sarama.SyncProducer
+}
+
+func newKafkaSink(conf KafkaSinkConfig) (*kafkaSink, error) {
+	if len(conf.Brokers) == 0 {
+		return nil, fmt.Errorf("no brokers%s", "")
+	}
+	c := sarama.NewConfig()
+	c.Producer.RequiredAcks = sarama.WaitForAll
+	c.Producer.Return.Successes = true
+
+	producer, err := sarama.NewSyncProducer(conf.Brokers, c)
+	if err != nil {
+		return nil, fmt.Errorf("sarama.NewSyncProducer: %s", err.Error())
+	}
+	return &kafkaSink{conf: conf, producer: producer}, nil
+}
+
+func (s *kafkaSink) Name() string {
+	return "kafka"
+}
+
+func (s *kafkaSink) SendAggregates(data []interface{}) error {
+	if s.conf.AggregateTopic == "" {
+		return nil
+	}
+	return s.send(s.conf.AggregateTopic, data)
+}
+
+func (s *kafkaSink) SendEvents(events []ReporterEvent) error {
+	if s.conf.EventTopic == "" {
+		return nil
+	}
+	data := make([]interface{}, 0, len(events))
+	for _, e := range events {
+		data = append(data, e)
+	}
+	return s.send(s.conf.EventTopic, data)
+}
+
+func (s *kafkaSink) send(topic string, data []interface{}) error {
+	msgs := make([]*sarama.ProducerMessage, 0, len(data))
+	for _, v := range data {
+		value, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("json.Marshal: %s", err.Error())
+		}
+		msgs = append(msgs, &sarama.ProducerMessage{
+			Topic: topic,
+			Value: sarama.ByteEncoder(value),
+		})
+	}
+	if err := s.producer.SendMessages(msgs); err != nil {
+		return fmt.Errorf("producer.SendMessages: %s", err.Error())
+	}
+	return nil
+}
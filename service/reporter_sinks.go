@@ -0,0 +1,92 @@
+package service
+
+// reporter sinks: where aggregates and raw events are shipped to
+
+import (
+	"fmt"
+	"time"
+
+	xmp_api "github.com/linkit360/xmp-api/src/client"
+)
+
+type Sink interface {
+	Name() string
+	// aggregates are kept in the state archive and resent until the sink accepts them
+	SendAggregates([]interface{}) error
+	// raw events are kept in the state archive up to the event archive size and resent
+	// until the sink accepts them, the oldest are dropped, sinks which do not need them just return nil
+	SendEvents([]ReporterEvent) error
+}
+
+// raw event as it was received by the reporter
+type ReporterEvent struct {
+	EventName  string    `json:"event_name"`
+	Queue      string    `json:"queue"`
+	ReceivedAt time.Time `json:"received_at"`
+	Collect
+}
+
+type SinksConfig struct {
+	XMPAPI     XMPAPISinkConfig     `yaml:"xmp_api"`
+	Kafka      KafkaSinkConfig      `yaml:"kafka"`
+	ClickHouse ClickHouseSinkConfig `yaml:"clickhouse"`
+	File       FileSinkConfig       `yaml:"file"`
+	// raw events kept by sink while it is down, 0 - not limited
+	EventArchiveSize int `yaml:"event_archive_size" default:"10000"`
+}
+
+type XMPAPISinkConfig struct {
+	Disabled bool `yaml:"disabled"` // enabled by default
+}
+
+func initSinks(conf SinksConfig) (sinks []Sink, err error) {
+	if !conf.XMPAPI.Disabled {
+		sinks = append(sinks, xmpAPISink{})
+	}
+	if conf.Kafka.Enabled {
+		var s Sink
+		if s, err = newKafkaSink(conf.Kafka); err != nil {
+			return nil, fmt.Errorf("newKafkaSink: %s", err.Error())
+		}
+		sinks = append(sinks, s)
+	}
+	if conf.ClickHouse.Enabled {
+		sinks = append(sinks, newClickHouseSink(conf.ClickHouse))
+	}
+	if conf.File.Enabled {
+		var s Sink
+		if s, err = newFileSink(conf.File); err != nil {
+			return nil, fmt.Errorf("newFileSink: %s", err.Error())
+		}
+		sinks = append(sinks, s)
+	}
+	if len(sinks) == 0 {
+		return nil, fmt.Errorf("no reporter sinks enabled%s", "")
+	}
+	return sinks, nil
+}
+
+// aggregates only
+type xmpAPISink struct{}
+
+func (s xmpAPISink) Name() string {
+	return "xmp_api"
+}
+
+func (s xmpAPISink) SendAggregates(data []interface{}) error {
+	var resp struct {
+		Ok    bool   `json:"ok,omitempty"`
+		Error string `json:"error,omitempty"`
+	}
+	if err := xmp_api.Call("aggregate", &resp, data...); err != nil {
+		return fmt.Errorf("xmp_api.Call: %s", err.Error())
+	}
+	if !resp.Ok {
+		return fmt.Errorf("haven't received the data: %s", resp.Error)
+	}
+	return nil
+}
+
+func (s xmpAPISink) SendEvents([]ReporterEvent) error {
+	return nil
+}
@@ -0,0 +1,48 @@
+package service
+
+// where reporter events come from
+
+import (
+	"sync"
+
+	amqp_driver "github.com/streadway/amqp"
+
+	"github.com/linkit360/go-utils/amqp"
+	qconf "github.com/linkit360/go-utils/config"
+)
+
+// source of reporter events, fn gets deliveries of the queue
+type DeliverySource interface {
+	Consume(queue qconf.ConsumeQueueConfig, fn func(<-chan amqp_driver.Delivery))
+}
+
+type amqpSource struct {
+	sync.Mutex
+	conf      amqp.ConsumerConfig
+	consumers map[string]*amqp.Consumer // by queue name
+}
+
+func newAMQPSource(conf amqp.ConsumerConfig) *amqpSource {
+	return &amqpSource{
+		conf:      conf,
+		consumers: make(map[string]*amqp.Consumer),
+	}
+}
+
+// go-utils calls fn in threads_count goroutines, fn starts threads_count workers itself,
+// so fn is called once, otherwise there would be threads_count² workers on the queue
+// prefetch is not less than the workers, so none of them waits for the broker
+func (s *amqpSource) Consume(queue qconf.ConsumeQueueConfig, fn func(<-chan amqp_driver.Delivery)) {
+	s.Lock()
+	defer s.Unlock()
+	consumeQueue := queue
+	consumeQueue.ThreadsCount = 1
+	if consumeQueue.PrefetchCount < queue.ThreadsCount {
+		consumeQueue.PrefetchCount = queue.ThreadsCount
+	}
+	if consumeQueue.PrefetchCount < 1 {
+		consumeQueue.PrefetchCount = 1
+	}
+	var deliveries <-chan amqp_driver.Delivery
+	s.consumers[queue.Name] = amqp.InitConsumer(s.conf, consumeQueue, deliveries, fn)
+}
@@ -0,0 +1,673 @@
+package service
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+	amqp_driver "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/linkit360/go-utils/amqp"
+	qconf "github.com/linkit360/go-utils/config"
+	m "github.com/linkit360/go-utils/metrics"
+	xmp_api_structs "github.com/linkit360/xmp-api/src/structs"
+)
+
+const (
+	testCampaignUUID = "290ea9f6-1f85-4a35-8d29-37e71ab3f5d8"
+	testCampaignCode = "290"
+	testOperatorCode = int64(41001)
+)
+
+var (
+	testReporterMetrics *ReporterMetrics
+	testRevenueMetrics  *revenueMetrics
+	testDownloadMetrics *downloadMetrics
+)
+
+// metrics are registered once, every test gets its own collector
+func TestMain(tm *testing.M) {
+	Svc.conf = Config{Currency: "THB", PriceUnit: PriceUnitCents, ReporterShards: 4}
+	Svc.conf.Enabled.Reporter = true
+	Svc.deadLetters = initDeadLetters("test", DeadLetterConfig{}, amqp.ConsumerConfig{})
+	Svc.Campaigns = &сampaigns{
+		notFound: m.NewGauge("test", "campaign", "not_found", "campaign not found error"),
+		ByUUID: map[string]Campaign{
+			testCampaignUUID: {Campaign: xmp_api_structs.Campaign{Id: testCampaignUUID, Code: testCampaignCode}},
+		},
+	}
+	testReporterMetrics = initReporterMetrics("test")
+	testRevenueMetrics = initRevenueMetrics("test")
+	testDownloadMetrics = initDownloadMetrics("test")
+	os.Exit(tm.Run())
+}
+
+func testQueues() QueuesConfig {
+	return QueuesConfig{
+		ReporterHit:         qconf.ConsumeQueueConfig{Name: "reporter_hit"},
+		ReporterTransaction: qconf.ConsumeQueueConfig{Name: "reporter_transaction"},
+		ReporterPixel:       qconf.ConsumeQueueConfig{Name: "reporter_pixel"},
+		ReporterOutflow:     qconf.ConsumeQueueConfig{Name: "reporter_outflow"},
+		ReporterUnsubscribe: qconf.ConsumeQueueConfig{Name: "reporter_unsubscribe"},
+		ReporterContent:     qconf.ConsumeQueueConfig{Name: "reporter_content"},
+		ReporterSMS:         qconf.ConsumeQueueConfig{Name: "reporter_sms"},
+		ReporterRedirect:    qconf.ConsumeQueueConfig{Name: "reporter_redirect"},
+	}
+}
+
+func newTestCollector(t *testing.T, sinks ...Sink) *collectorService {
+	conf := Svc.conf
+	conf.Queue = testQueues()
+	as, err := newCollector(conf, testReporterMetrics, testRevenueMetrics, sinks)
+	if err != nil {
+		t.Fatalf("newCollector: %s", err.Error())
+	}
+	return as
+}
+
+func (as *collectorService) testAggregate() adAggregate {
+	s := as.shards.get(testCampaignUUID)
+	s.Lock()
+	defer s.Unlock()
+	if a, ok := s.adReport[testCampaignUUID][testOperatorCode]; ok {
+		return a
+	}
+	return newAdAggregate()
+}
+
+func (as *collectorService) testCampaignsCount() (count int) {
+	for _, s := range as.shards {
+		s.Lock()
+		count += len(s.adReport)
+		s.Unlock()
+	}
+	return
+}
+
+// in-memory amqp: every queue is a channel, acks are reported back to the publisher
+type memorySource struct {
+	sync.Mutex
+	queues map[string]chan amqp_driver.Delivery
+}
+
+func newMemorySource() *memorySource {
+	return &memorySource{queues: make(map[string]chan amqp_driver.Delivery)}
+}
+
+func (s *memorySource) Consume(queue qconf.ConsumeQueueConfig, fn func(<-chan amqp_driver.Delivery)) {
+	s.Lock()
+	defer s.Unlock()
+	ch := make(chan amqp_driver.Delivery)
+	s.queues[queue.Name] = ch
+	go fn(ch)
+}
+
+// waits till the message is acked, safe to call from goroutines of a test
+func (s *memorySource) publish(queue string, body []byte) error {
+	s.Lock()
+	ch, ok := s.queues[queue]
+	s.Unlock()
+	if !ok {
+		return fmt.Errorf("queue %s is not consumed", queue)
+	}
+	ack := &fakeAcknowledger{acked: make(chan struct{})}
+	ch <- amqp_driver.Delivery{Acknowledger: ack, Body: body}
+	select {
+	case <-ack.acked:
+		return nil
+	case <-time.After(time.Second):
+		return fmt.Errorf("message to %s is not acked", queue)
+	}
+}
+
+type fakeAcknowledger struct {
+	acked chan struct{}
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	close(a.acked)
+	return nil
+}
+func (a *fakeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	return nil
+}
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return nil
+}
+
+// aggregate receiver instead of xmp api
+type fakeSink struct {
+	fail       bool
+	aggregates []interface{}
+	events     []ReporterEvent
+}
+
+func (s *fakeSink) Name() string {
+	return "fake"
+}
+func (s *fakeSink) SendAggregates(data []interface{}) error {
+	if s.fail {
+		return fmt.Errorf("fake sink is down%s", "")
+	}
+	s.aggregates = append(s.aggregates, data...)
+	return nil
+}
+func (s *fakeSink) SendEvents(events []ReporterEvent) error {
+	if s.fail {
+		return fmt.Errorf("fake sink is down%s", "")
+	}
+	s.events = append(s.events, events...)
+	return nil
+}
+
+func testCollect(result string, price int) Collect {
+	return Collect{
+		Tid:               "tid",
+		CampaignUUID:      testCampaignUUID,
+		OperatorCode:      testOperatorCode,
+		Msisdn:            "923001234567",
+		TransactionResult: result,
+		Price:             price,
+	}
+}
+
+func TestReporterIncTransaction(t *testing.T) {
+	as := newTestCollector(t)
+
+	for _, result := range []string{"paid", "paid", "failed", "retry_paid", "unknown"} {
+		assert.NoError(t, as.incTransaction(testCollect(result, 1000)), result)
+	}
+	assertCounters(t, as.testAggregate(), map[string]int64{
+		"mo":                     3,
+		"mo_charge_success":      2,
+		"mo_charge_sum":          2000,
+		"mo_charge_failed":       1,
+		"renewal":                1,
+		"renewal_charge_success": 1,
+		"renewal_charge_sum":     1000,
+	}, "classification")
+
+	assert.Error(t, as.incTransaction(Collect{TransactionResult: "paid"}), "campaign is required")
+}
+
+func TestReporterIncTransactionPrice(t *testing.T) {
+	as := newTestCollector(t)
+
+	inUnits := testCollect("paid", 10)
+	inUnits.PriceUnit = PriceUnitUnits
+	as.incTransaction(inUnits)
+	otherCurrency := testCollect("paid", 1000)
+	otherCurrency.Currency = "USD"
+	as.incTransaction(otherCurrency)
+	sameCurrency := testCollect("paid", 500)
+	sameCurrency.Currency = "THB"
+	as.incTransaction(sameCurrency)
+
+	assertCounters(t, as.testAggregate(), map[string]int64{
+		"mo":                3,
+		"mo_charge_success": 3,
+		"mo_charge_sum":     1500,
+	}, "sum in cents of the config currency")
+}
+
+func TestReporterIncTransactionEffectivePrice(t *testing.T) {
+	as := newTestCollector(t)
+	enabled, prices, camp := Svc.conf.Enabled.ServicePrices, Svc.ServicePrices, Svc.Campaigns.(*сampaigns).ByUUID[testCampaignUUID]
+	defer func() {
+		Svc.conf.Enabled.ServicePrices, Svc.ServicePrices = enabled, prices
+		Svc.Campaigns.(*сampaigns).ByUUID[testCampaignUUID] = camp
+	}()
+	withService := camp
+	withService.ServiceCode = "777"
+	Svc.Campaigns.(*сampaigns).ByUUID[testCampaignUUID] = withService
+	switchAt := time.Now().UTC().Add(-time.Hour)
+	Svc.conf.Enabled.ServicePrices = true
+	Svc.ServicePrices = &ServicePrices{ByServiceCode: map[string][]ServicePrice{
+		"777": {
+			{Id: 1, ServiceCode: "777", PriceCents: 300, Currency: "USD", ValidTo: &switchAt},
+			{Id: 2, ServiceCode: "777", PriceCents: 700, ValidFrom: &switchAt},
+		},
+	}}
+
+	explicit := testCollect("paid", 500)
+	explicit.SentAt = switchAt.Add(-time.Minute)
+	as.incTransaction(explicit)
+	before := testCollect("paid", 0)
+	before.SentAt = switchAt.Add(-time.Minute)
+	as.incTransaction(before)
+	after := testCollect("paid", 0)
+	after.SentAt = switchAt.Add(time.Minute)
+	as.incTransaction(after)
+	as.incTransaction(testCollect("failed", 0))
+
+	assertCounters(t, as.testAggregate(), map[string]int64{
+		"mo":                4,
+		"mo_charge_success": 3,
+		"mo_charge_failed":  1,
+		"mo_charge_sum":     1200,
+	}, "explicit price in the config currency, effective price at the time of the event")
+}
+
+func TestReporterIncHitInactive(t *testing.T) {
+	as := newTestCollector(t)
+	schedules := Svc.CampaignSchedules
+	defer func() { Svc.CampaignSchedules = schedules }()
+	Svc.CampaignSchedules = initCampaignSchedules("Asia/Bangkok")
+	Svc.CampaignSchedules.ByCampaign = map[string][]CampaignSchedule{
+		testCampaignUUID: {{HourFrom: 8, HourTo: 22}},
+	}
+
+	hit := func(inactive bool, sentAt time.Time) {
+		r := testCollect("", 0)
+		r.Inactive = inactive
+		r.SentAt = sentAt
+		assert.NoError(t, as.incHit(r))
+	}
+	// 05:00 UTC is 12:00 in Bangkok, 16:00 UTC is 23:00
+	hit(false, time.Date(2017, 6, 5, 5, 0, 0, 0, time.UTC))
+	hit(false, time.Date(2017, 6, 5, 16, 0, 0, 0, time.UTC))
+	hit(true, time.Date(2017, 6, 5, 5, 0, 0, 0, time.UTC))
+	hit(false, time.Time{})
+
+	a := as.testAggregate()
+	assert.Equal(t, int64(4), a.LpHits.count)
+	assert.Equal(t, int64(2), a.LpHitsInactive.count, "at the time of the hit, not of the processing")
+}
+
+func TestReporterConsume(t *testing.T) {
+	as := newTestCollector(t)
+	source := newMemorySource()
+	as.consumeFrom(source)
+
+	hit, _ := json.Marshal(EventNotifyReporter{EventName: "hit", EventData: testCollect("", 0)})
+	assert.NoError(t, source.publish("reporter_hit", hit))
+	assert.NoError(t, source.publish("reporter_hit", []byte("{malformed")))
+	noCampaign, _ := json.Marshal(EventNotifyReporter{EventName: "hit", EventData: Collect{OperatorCode: testOperatorCode}})
+	assert.NoError(t, source.publish("reporter_hit", noCampaign))
+
+	pixel, _ := json.Marshal(EventNotifyReporter{EventName: "pixel", EventData: testCollect("", 0)})
+	assert.NoError(t, source.publish("reporter_pixel", pixel))
+
+	assertCounters(t, as.testAggregate(), map[string]int64{
+		"lp_hits":        1,
+		"lp_msisdn_hits": 1,
+		"pixels":         1,
+	}, "consumed")
+
+	as.eventsMutex.Lock()
+	defer as.eventsMutex.Unlock()
+	if assert.Equal(t, 2, len(as.events), "only valid events are kept") {
+		assert.Equal(t, "reporter_hit", as.events[0].Queue)
+		assert.Equal(t, "reporter_pixel", as.events[1].Queue)
+	}
+}
+
+func TestReporterConcurrentInc(t *testing.T) {
+	as := newTestCollector(t)
+	campaigns := []string{testCampaignUUID, "campaign-2", "campaign-3", "campaign-4", "campaign-5"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				r := testCollect("paid", 10)
+				r.CampaignUUID = campaigns[n%len(campaigns)]
+				as.incHit(r)
+				as.incTransaction(r)
+			}
+		}()
+	}
+	wg.Wait()
+
+	report := as.breathe()
+	assert.Equal(t, len(campaigns), len(report), "all campaigns")
+	for _, campaignUUID := range campaigns {
+		a := report[campaignUUID][testOperatorCode]
+		assert.Equal(t, int64(8*100/len(campaigns)), a.LpHits.count, campaignUUID)
+		assert.Equal(t, int64(8*100/len(campaigns)), a.MoChargeSuccess.count, campaignUUID)
+		assert.Equal(t, int64(10*8*100/len(campaigns)), a.MoChargeSum.count, campaignUUID)
+	}
+	assert.Equal(t, 0, as.testCampaignsCount(), "counters are reset")
+}
+
+func TestReporterWorkers(t *testing.T) {
+	as := newTestCollector(t)
+	as.queues.ReporterHit.ThreadsCount = 4
+	source := newMemorySource()
+	as.consumeFrom(source)
+
+	hit, _ := json.Marshal(EventNotifyReporter{EventName: "hit", EventData: testCollect("", 0)})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 25; n++ {
+				if err := source.publish("reporter_hit", hit); err != nil {
+					t.Errorf("publish: %s", err.Error())
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(100), as.testAggregate().LpHits.count, "all hits are counted")
+}
+
+func TestReporterLandingVariants(t *testing.T) {
+	sink := &fakeSink{}
+	as := newTestCollector(t, sink)
+
+	for _, variant := range []string{"", "a", "a", "b"} {
+		r := testCollect("", 0)
+		r.LandingVariant = variant
+		as.incHit(r)
+	}
+	paid := testCollect("paid", 100)
+	paid.LandingVariant = "a"
+	as.incTransaction(paid)
+	as.send()
+
+	byVariant := map[string]Aggregate{}
+	for _, v := range sink.aggregates {
+		a := v.(Aggregate)
+		assert.Equal(t, testCampaignUUID, a.CampaignId)
+		byVariant[a.LandingVariant] = a
+	}
+	assert.Equal(t, 3, len(byVariant), "campaign landing and two variants")
+	assert.Equal(t, int64(1), byVariant[""].LpHits)
+	assert.Equal(t, int64(2), byVariant["a"].LpHits)
+	assert.Equal(t, int64(1), byVariant["a"].MoTotal)
+	assert.Equal(t, int64(1), byVariant["b"].LpHits)
+}
+
+func TestReporterArchiveRetry(t *testing.T) {
+	sink := &fakeSink{fail: true}
+	as := newTestCollector(t, sink)
+
+	as.incHit(testCollect("", 0))
+	as.send()
+	assert.Equal(t, 1, len(as.state.Archives["fake"]), "archived on error")
+	assert.Equal(t, 0, as.testCampaignsCount(), "counters are reset")
+
+	as.incHit(testCollect("", 0))
+	as.incHit(testCollect("", 0))
+	as.send()
+	assert.Equal(t, 2, len(as.state.Archives["fake"]), "archive grows")
+
+	sink.fail = false
+	as.send()
+	assert.Equal(t, 0, len(as.state.Archives["fake"]), "archive is sent")
+	if assert.Equal(t, 2, len(sink.aggregates), "archive is sent") {
+		first := sink.aggregates[0].(Aggregate)
+		assert.Equal(t, int64(1), first.LpHits)
+		assert.Equal(t, testCampaignCode, first.CampaignCode)
+		assert.Equal(t, "THB", first.Currency)
+		assert.Equal(t, int64(2), sink.aggregates[1].(Aggregate).LpHits)
+	}
+
+	as.send()
+	assert.Equal(t, 2, len(sink.aggregates), "nothing to send")
+
+	sink.fail = true
+	as.pushEvent("reporter_hit", EventNotifyReporter{EventName: "hit", EventData: testCollect("", 0)})
+	as.send()
+	assert.Equal(t, 1, len(as.state.EventArchives["fake"]), "events are archived on error")
+	sink.fail = false
+	as.send()
+	assert.Equal(t, 0, len(as.state.EventArchives["fake"]), "event archive is sent")
+	assert.Equal(t, 1, len(sink.events), "event archive is sent")
+
+	as.eventsSize = 2
+	sink.fail = true
+	for i := 0; i < 3; i++ {
+		r := testCollect("", 0)
+		r.Tid = fmt.Sprint(i)
+		as.pushEvent("reporter_hit", EventNotifyReporter{EventName: "hit", EventData: r})
+		as.send()
+	}
+	if assert.Equal(t, 2, len(as.state.EventArchives["fake"]), "event archive is capped") {
+		assert.Equal(t, "1", as.state.EventArchives["fake"][0].Tid, "the oldest is dropped")
+	}
+}
+
+func TestReporterState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mid_reporter")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	sink := &fakeSink{fail: true}
+	as := newTestCollector(t, sink)
+	as.state.FilePath = path
+	as.state.LastSendTime = time.Now().UTC()
+	as.incHit(testCollect("", 0))
+	as.send()
+	assert.NoError(t, as.saveState(), "save")
+
+	loaded := newTestCollector(t, sink)
+	assert.NoError(t, loaded.loadState(path), "load")
+	assert.Equal(t, path, loaded.state.FilePath)
+	assert.Equal(t, as.state.LastSendTime.Unix(), loaded.state.LastSendTime.Unix())
+	assert.Equal(t, 1, len(loaded.state.Archives["fake"]), "archive is restored")
+
+	// state file of the version before sinks
+	legacy := []byte(`{"last_send_time":"2017-06-01T00:00:00Z","archive":[{"lp_hits":1},{"lp_hits":2}]}`)
+	assert.NoError(t, ioutil.WriteFile(path, legacy, 0644))
+	loaded = newTestCollector(t, sink)
+	assert.NoError(t, loaded.loadState(path), "load legacy")
+	assert.Equal(t, 0, len(loaded.state.Archive), "legacy archive is moved")
+	assert.Equal(t, 2, len(loaded.state.Archives[xmpAPISink{}.Name()]), "legacy archive goes to xmp api")
+
+	assert.Error(t, newTestCollector(t).loadState(filepath.Join(dir, "absent.json")), "no file")
+}
+
+// needs postgres, e.g. MID_TEST_DB="postgres://localhost/mid_test?sslmode=disable"
+// tables are temporary and disappear with the connection
+func TestReporterGetAggregate(t *testing.T) {
+	dsn := os.Getenv("MID_TEST_DB")
+	if dsn == "" {
+		t.Skip("MID_TEST_DB is not set")
+	}
+	testDB, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("sql.Open: %s", err.Error())
+	}
+	defer testDB.Close()
+	testDB.SetMaxOpenConns(1)
+
+	db, conf, tablePrefix := Svc.db, Svc.conf, Svc.dbConf.TablePrefix
+	defer func() {
+		Svc.db, Svc.conf, Svc.dbConf.TablePrefix = db, conf, tablePrefix
+	}()
+	Svc.db = testDB
+	Svc.dbConf.TablePrefix = "mid_test_"
+	Svc.conf.AggregateTables = AggregateTablesConfig{}
+
+	for _, query := range []string{
+		"CREATE TEMP TABLE mid_test_transactions (" +
+			"sent_at timestamp, id_campaign varchar, operator_code int, msisdn varchar, result varchar, price int, attempts_count int, landing_variant varchar)",
+		"CREATE TEMP TABLE mid_test_pixel_transactions (" +
+			"sent_at timestamp, id_campaign varchar, operator_code int)",
+		"CREATE TEMP TABLE mid_test_campaigns_access (" +
+			"sent_at timestamp, id_campaign varchar, operator_code int, msisdn varchar, landing_variant varchar)",
+		"INSERT INTO mid_test_transactions VALUES " +
+			"('2017-01-02 10:00:00', '" + testCampaignUUID + "', 41001, '923001', 'paid', 1000, 0), " +
+			"('2017-01-02 11:00:00', '" + testCampaignUUID + "', 41001, '923002', 'paid', 1000, NULL), " +
+			// paid after attempts is a renewal as in the live reporter
+			"('2017-01-02 12:00:00', '" + testCampaignUUID + "', 41001, '923002', 'paid', 1000, 2), " +
+			"('2017-01-02 13:00:00', '" + testCampaignUUID + "', 41001, '923003', 'failed', 1000, 0), " +
+			"('2017-01-05 10:00:00', '" + testCampaignUUID + "', 41001, '923003', 'paid', 1000, 0)",
+		"INSERT INTO mid_test_pixel_transactions VALUES " +
+			"('2017-01-02 10:00:00', '" + testCampaignUUID + "', 41001)",
+		"INSERT INTO mid_test_campaigns_access VALUES " +
+			"('2017-01-02 09:00:00', '" + testCampaignUUID + "', 41001, '923001'), " +
+			"('2017-01-02 09:00:00', '" + testCampaignUUID + "', 41001, '')",
+	} {
+		if _, err := testDB.Exec(query); err != nil {
+			t.Fatalf("db.Exec: %s, query: %s", err.Error(), query)
+		}
+	}
+
+	as := newTestCollector(t)
+	f := AggregateFilter{
+		From:     time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+		To:       time.Date(2017, 1, 3, 0, 0, 0, 0, time.UTC),
+		GroupBy:  GroupByDay,
+		Location: time.UTC,
+	}
+	res, err := as.GetAggregate(f)
+	assert.NoError(t, err, "GetAggregate")
+	if assert.Equal(t, 1, len(res), "one day, campaign and operator") {
+		a := res[0]
+		assert.Equal(t, time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC).Unix(), a.ReportAt)
+		assert.Equal(t, testCampaignCode, a.CampaignCode)
+		assert.Equal(t, testOperatorCode, a.OperatorCode)
+		assert.Equal(t, int64(3), a.MoTotal)
+		assert.Equal(t, int64(2), a.MoChargeSuccess)
+		assert.Equal(t, int64(2000), a.MoChargeSum)
+		assert.Equal(t, int64(1), a.MoChargeFailed)
+		assert.Equal(t, int64(1), a.RenewalChargeSuccess)
+		assert.Equal(t, int64(2), a.LpHits)
+		assert.Equal(t, int64(1), a.LpMsisdnHits)
+		assert.Equal(t, int64(1), a.Pixels)
+	}
+
+	revenue, err := as.GetRevenue(f)
+	assert.NoError(t, err, "GetRevenue")
+	if assert.Equal(t, 1, len(revenue), "revenue of the same groups") {
+		r := revenue[0]
+		assert.Equal(t, 30.0, r.Revenue)
+		assert.Equal(t, int64(2), r.Subscribers)
+		assert.Equal(t, 15.0, r.ARPU)
+		assert.Equal(t, 1.5, r.ConversionRate)
+		assert.Equal(t, 0.75, r.ChargeSuccessRate)
+	}
+
+	sink := &fakeSink{}
+	as.sinks = []Sink{sink}
+	as.Lock()
+	as.state.Archives = map[string][]interface{}{sink.Name(): {"pending"}}
+	as.Unlock()
+	_, err = as.StartBackfill(f)
+	assert.NoError(t, err, "StartBackfill")
+	time.Sleep(50 * time.Millisecond)
+	job, _ := as.BackfillStatus()
+	assert.Equal(t, 0, job.DaysDone, "backfill waits for the archive")
+	as.send()
+	sink.aggregates = nil
+	for i := 0; i < 300; i++ {
+		if job, _ := as.BackfillStatus(); job.Status != BackfillRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	job, _ = as.BackfillStatus()
+	assert.Equal(t, BackfillDone, job.Status, "backfill")
+	assert.Equal(t, 2, job.DaysDone)
+	as.send()
+	if assert.Equal(t, 1, len(sink.aggregates), "backfill is sent") {
+		a := sink.aggregates[0].(Aggregate)
+		assert.True(t, a.Backfill)
+		assert.Equal(t, int64(3), a.MoTotal)
+	}
+
+	f.To = time.Date(2017, 1, 10, 0, 0, 0, 0, time.UTC)
+	f.GroupBy = GroupByCampaign
+	res, err = as.GetAggregate(f)
+	assert.NoError(t, err, "GetAggregate by campaign")
+	if assert.Equal(t, 1, len(res), "one campaign") {
+		assert.Equal(t, int64(4), res[0].MoTotal)
+		assert.Equal(t, f.From.Unix(), res[0].ReportAt)
+	}
+
+	for _, query := range []string{
+		"INSERT INTO mid_test_campaigns_access VALUES " +
+			"('2017-01-02 09:00:00', '" + testCampaignUUID + "', 41001, '923004', 'b')",
+		"INSERT INTO mid_test_transactions VALUES " +
+			"('2017-01-02 10:00:00', '" + testCampaignUUID + "', 41001, '923004', 'paid', 1000, 0, 'b')",
+	} {
+		if _, err := testDB.Exec(query); err != nil {
+			t.Fatalf("db.Exec: %s, query: %s", err.Error(), query)
+		}
+	}
+	f.To = time.Date(2017, 1, 3, 0, 0, 0, 0, time.UTC)
+	f.GroupBy = GroupByDay
+	Svc.conf.AggregateTables.HitsVariant = "landing_variant"
+	res, err = as.GetAggregate(f)
+	assert.NoError(t, err, "GetAggregate without transactions variant")
+	assert.Equal(t, 1, len(res), "hits are not split alone")
+
+	Svc.conf.AggregateTables.TransactionsVariant = "landing_variant"
+	res, err = as.GetAggregate(f)
+	assert.NoError(t, err, "GetAggregate by variants")
+	sortAggregates(res)
+	if assert.Equal(t, 2, len(res), "campaign and its variant") {
+		assert.Equal(t, "", res[0].LandingVariant)
+		assert.Equal(t, int64(2), res[0].LpHits)
+		assert.Equal(t, int64(3), res[0].MoTotal)
+		assert.Equal(t, "b", res[1].LandingVariant)
+		assert.Equal(t, int64(1), res[1].LpHits)
+		assert.Equal(t, int64(1), res[1].MoTotal, "conversion of the variant")
+	}
+
+	revenue, err = as.GetRevenue(f)
+	assert.NoError(t, err, "GetRevenue by variants")
+	if assert.Equal(t, 2, len(revenue), "revenue of the campaign and its variant") {
+		for _, r := range revenue {
+			if r.LandingVariant == "b" {
+				assert.Equal(t, 1.0, r.ConversionRate)
+				assert.Equal(t, int64(1), r.Subscribers)
+			} else {
+				assert.Equal(t, 1.5, r.ConversionRate)
+				assert.Equal(t, int64(2), r.Subscribers)
+			}
+		}
+	}
+}
+
+func TestBackfillJobDays(t *testing.T) {
+	loc, _ := time.LoadLocation("Asia/Bangkok")
+	job := newBackfillJob(AggregateFilter{
+		From:     time.Date(2017, 1, 30, 0, 0, 0, 0, loc),
+		To:       time.Date(2017, 2, 2, 0, 0, 0, 0, loc),
+		Location: loc,
+	})
+	assert.Equal(t, 3, job.Days)
+
+	days := []string{}
+	for {
+		f, ok, err := job.nextDay()
+		assert.NoError(t, err)
+		if !ok {
+			break
+		}
+		assert.Equal(t, GroupByDay, f.GroupBy)
+		assert.Equal(t, loc, f.Location)
+		days = append(days, f.From.Format("2006-01-02"))
+		job.Next = f.To
+	}
+	assert.Equal(t, []string{"2017-01-30", "2017-01-31", "2017-02-01"}, days)
+
+	// job from the state file
+	stateJson, _ := json.Marshal(job)
+	var loaded BackfillJob
+	assert.NoError(t, json.Unmarshal(stateJson, &loaded))
+	loaded.Next = time.Date(2017, 2, 1, 0, 0, 0, 0, loc)
+	f, ok, err := loaded.nextDay()
+	assert.NoError(t, err)
+	assert.True(t, ok, "resumed")
+	assert.Equal(t, "2017-02-01", f.From.Format("2006-01-02"))
+}
@@ -3,8 +3,12 @@ package service
 import (
 	"database/sql"
 	"fmt"
+	"math/rand"
 	"strconv"
 	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 
 	"github.com/linkit360/go-utils/structs"
 )
@@ -13,21 +17,94 @@ const ACTIVE_STATUS = 1
 
 type SentContents struct {
 	sync.RWMutex
-	ByKey map[string]map[string]struct{}
+	rotation ContentRotationConfig
+	rand     *rand.Rand
+	journal  *sentContentsJournal // nil - not persisted
+	ByKey    map[string]map[string]struct{}
+}
+
+func initSentContents(appName string, conf ContentRotationConfig, persistConf SentContentsConfig) *SentContents {
+	if !rotationStrategyOk(conf.Strategy) {
+		log.WithField("strategy", conf.Strategy).Fatal("wrong content rotation strategy")
+	}
+	for serviceCode, rc := range conf.Services {
+		if rc.Strategy != "" && !rotationStrategyOk(rc.Strategy) {
+			log.WithFields(log.Fields{
+				"service":  serviceCode,
+				"strategy": rc.Strategy,
+			}).Fatal("wrong content rotation strategy")
+		}
+	}
+	s := &SentContents{
+		rotation: conf,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		journal:  initSentContentsJournal(appName, persistConf),
+	}
+	if s.journal != nil && persistConf.CheckInterval > 0 {
+		go s.checking(time.Duration(persistConf.CheckInterval) * time.Second)
+	}
+	return s
 }
 
+// ops which are not written yet are applied on the loaded table
 func (s *SentContents) Reload() (err error) {
+	if s.journal != nil {
+		s.journal.flushMu.Lock()
+		defer s.journal.flushMu.Unlock()
+	}
+	rotationTable := ""
+	if s.journal != nil {
+		rotationTable = s.journal.conf.RotationTable
+	}
+	byKey, err := loadSentContents(rotationTable)
+	if err != nil {
+		return
+	}
+
 	s.Lock()
 	defer s.Unlock()
+	if s.journal != nil {
+		applySentContentOps(byKey, s.journal.pendingOps())
+	}
+	s.ByKey = byKey
+	return nil
+}
+
+// start of unique days in UTC, older contents could be shown again
+func sentContentsSince() string {
+	return "((CURRENT_TIMESTAMP AT TIME ZONE 'UTC') - INTERVAL '" + strconv.Itoa(Svc.conf.UniqueDays) + " days')"
+}
 
+// rows of the rotation table are added to content_sent,
+// rows sent before the latest clear of the msisdn and the service are skipped,
+// empty rotation table - sent contents are not persisted
+// sent_at of both tables is in UTC
+func loadSentContents(rotationTable string) (byKey map[string]map[string]struct{}, err error) {
+	since := "sent_at > " + sentContentsSince()
 	query := fmt.Sprintf("SELECT "+
 		"msisdn, "+
 		"id_service, "+
 		"id_content "+
 		"FROM %scontent_sent "+
-		"WHERE sent_at > (CURRENT_TIMESTAMP - INTERVAL '"+
-		strconv.Itoa(Svc.conf.UniqueDays)+" days')",
+		"WHERE "+since,
 		Svc.dbConf.TablePrefix)
+	if rotationTable != "" {
+		rotation := Svc.dbConf.TablePrefix + rotationTable
+		query = fmt.Sprintf("SELECT "+
+			"s.msisdn, "+
+			"s.id_service, "+
+			"s.id_content "+
+			"FROM ("+
+			"SELECT msisdn, id_service, id_content, sent_at FROM %scontent_sent WHERE "+since+" "+
+			"UNION ALL "+
+			"SELECT msisdn, id_service, id_content, sent_at FROM %s WHERE id_content <> '' AND "+since+
+			") s "+
+			"LEFT JOIN ("+
+			"SELECT msisdn, id_service, max(sent_at) cleared_at FROM %s WHERE id_content = '' GROUP BY msisdn, id_service"+
+			") c ON c.msisdn = s.msisdn AND c.id_service = s.id_service "+
+			"WHERE c.cleared_at IS NULL OR s.sent_at > c.cleared_at",
+			Svc.dbConf.TablePrefix, rotation, rotation)
+	}
 
 	var rows *sql.Rows
 	rows, err = Svc.db.Query(query)
@@ -56,41 +133,50 @@ func (s *SentContents) Reload() (err error) {
 		return
 	}
 
-	s.ByKey = make(map[string]map[string]struct{})
+	byKey = make(map[string]map[string]struct{})
 	for _, sentContent := range records {
-		if _, ok := s.ByKey[sentContent.Key()]; !ok {
-			s.ByKey[sentContent.Key()] = make(map[string]struct{})
+		if _, ok := byKey[sentContent.Key()]; !ok {
+			byKey[sentContent.Key()] = make(map[string]struct{})
 		}
-		s.ByKey[sentContent.Key()][sentContent.ContentId] = struct{}{}
+		byKey[sentContent.Key()][sentContent.ContentId] = struct{}{}
 	}
-	return nil
+	return
 }
 
 // Get content ids that was seen by msisdn
 // Attention: filtered by service id also,
 // so if we would have had content id on one service and the same content id on another service as a content id
 // then it had used as different contens! And will shown
+// A copy is returned, use Next to pick and record the content at once
 func (s *SentContents) Get(msisdn, serviceCode string) (contentCodes map[string]struct{}) {
-	var ok bool
+	s.RLock()
+	defer s.RUnlock()
+
 	t := structs.ContentSentProperties{Msisdn: msisdn, ServiceCode: serviceCode}
-	if contentCodes, ok = s.ByKey[t.Key()]; ok {
-		return contentCodes
+	seen, ok := s.ByKey[t.Key()]
+	if !ok {
+		return nil
 	}
-	return nil
+	contentCodes = make(map[string]struct{}, len(seen))
+	for contentCode := range seen {
+		contentCodes[contentCode] = struct{}{}
+	}
+	return contentCodes
 }
 
 // When there is no content avialabe for the msisdn, reset the content counter
-// Breakes after reloading sent content table (on the restart of the application)
+// It is kept after reloading sent content table only if sent contents are persisted
 func (s *SentContents) Clear(msisdn, serviceCode string) {
 	s.Lock()
 	defer s.Unlock()
 
 	t := structs.ContentSentProperties{Msisdn: msisdn, ServiceCode: serviceCode}
 	delete(s.ByKey, t.Key())
+	s.journal.add(sentContentOp{Op: sentContentClear, Msisdn: msisdn, ServiceCode: serviceCode, At: time.Now().UTC()})
 }
 
 // After we have chosen the content to show,
-// we notice it in sent content table (another place)
+// we notice it in sent content table (another place, or in the rotation table if sent contents are persisted)
 // and also we need to update in-memory cache of used content id for this msisdn and service id
 func (s *SentContents) Push(msisdn, serviceCode string, contentCode string) {
 	s.Lock()
@@ -104,4 +190,5 @@ func (s *SentContents) Push(msisdn, serviceCode string, contentCode string) {
 		s.ByKey[t.Key()] = make(map[string]struct{})
 	}
 	s.ByKey[t.Key()][contentCode] = struct{}{}
+	s.journal.add(sentContentOp{Op: sentContentPush, Msisdn: msisdn, ServiceCode: serviceCode, ContentId: contentCode, At: time.Now().UTC()})
 }
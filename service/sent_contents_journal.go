@@ -0,0 +1,390 @@
+package service
+
+// pushes and clears of sent contents are written to the rotation table in batches,
+// content_sent belongs to the dispatcher and the aggregates and is only read:
+// a push is a row of the rotation table, a clear is a row without a content,
+// which hides the rows of both tables sent before it, rows older than unique days are deleted,
+// until then they are kept in the journal file, so they are not lost on a crash,
+// the journal is replayed on start and on every reload of the table,
+// memory and the table are checked to be the same by interval
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	m "github.com/linkit360/go-utils/metrics"
+	"github.com/linkit360/go-utils/structs"
+)
+
+const (
+	sentContentPush  = "push"
+	sentContentClear = "clear"
+)
+
+type SentContentsConfig struct {
+	Persist       bool   `yaml:"persist"`                                 // false - pushes and clears are kept in memory only
+	Journal       string `yaml:"journal" default:"sent_contents.journal"` // not yet written to the table
+	BatchSize     int    `yaml:"batch_size" default:"500"`
+	FlushInterval int    `yaml:"flush_interval" default:"1"`   // seconds
+	CheckInterval int    `yaml:"check_interval" default:"600"` // seconds, 0 - never
+	RotationTable string `yaml:"rotation_table" default:"content_rotation"`
+}
+
+type sentContentOp struct {
+	Op          string    `json:"op"`
+	Msisdn      string    `json:"msisdn"`
+	ServiceCode string    `json:"service_code"`
+	ContentId   string    `json:"content_id,omitempty"`
+	At          time.Time `json:"at"`
+}
+
+type SentContentsCheck struct {
+	At              time.Time `json:"at"`
+	Memory          int       `json:"memory"` // msisdn, service and content
+	DB              int       `json:"db"`
+	Pending         int       `json:"pending"`           // not yet written to the table
+	MissingInDB     int       `json:"missing_in_db"`     // sent contents which are in memory only
+	MissingInMemory int       `json:"missing_in_memory"` // in the table only
+}
+
+type sentContentsJournal struct {
+	sync.Mutex
+	flushMu      sync.Mutex // the table is not written while it is loaded
+	conf         SentContentsConfig
+	file         *os.File
+	pending      []sentContentOp
+	prunedAt     time.Time // rows of the rotation table older than unique days are deleted hourly
+	full         chan struct{}
+	pendingGauge prometheus.Gauge
+	inconsistent prometheus.Gauge
+	flushErrors  m.Gauge
+}
+
+func initSentContentsJournal(appName string, conf SentContentsConfig) *sentContentsJournal {
+	if !conf.Persist {
+		return nil
+	}
+	j := &sentContentsJournal{
+		conf:         conf,
+		full:         make(chan struct{}, 1),
+		pendingGauge: m.PrometheusGauge(appName, "sent_content", "pending", "sent contents are not written yet"),
+		inconsistent: m.PrometheusGauge(appName, "sent_content", "inconsistent", "sent contents differ in memory and in the table"),
+		flushErrors:  m.NewGauge(appName, "sent_content", "flush_errors", "sent contents write errors"),
+	}
+	if err := j.load(); err != nil {
+		log.WithFields(log.Fields{
+			"path":  conf.Journal,
+			"error": err.Error(),
+		}).Fatal("cannot load sent contents journal")
+	}
+	file, err := os.OpenFile(conf.Journal, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path":  conf.Journal,
+			"error": err.Error(),
+		}).Fatal("cannot open sent contents journal")
+	}
+	j.file = file
+	j.pendingGauge.Set(float64(len(j.pending)))
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			j.flushErrors.Update()
+		}
+	}()
+	go j.flushing()
+	return j
+}
+
+func (j *sentContentsJournal) load() error {
+	f, err := os.Open(j.conf.Journal)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("os.Open: %s", err.Error())
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var op sentContentOp
+		if err := json.Unmarshal(scanner.Bytes(), &op); err != nil {
+			log.WithField("error", err.Error()).Error("wrong sent contents journal line")
+			continue
+		}
+		j.pending = append(j.pending, op)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("scanner.Err: %s", err.Error())
+	}
+	log.WithField("pending", len(j.pending)).Info("sent contents journal loaded")
+	return nil
+}
+
+// the op is in the journal when it returns
+func (j *sentContentsJournal) add(op sentContentOp) {
+	if j == nil {
+		return
+	}
+	j.Lock()
+	defer j.Unlock()
+
+	line, _ := json.Marshal(op)
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		log.WithFields(log.Fields{
+			"msisdn": op.Msisdn,
+			"error":  err.Error(),
+		}).Error("cannot write sent contents journal")
+	}
+	j.pending = append(j.pending, op)
+	j.pendingGauge.Set(float64(len(j.pending)))
+	if len(j.pending) >= j.conf.BatchSize {
+		select {
+		case j.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (j *sentContentsJournal) pendingOps() []sentContentOp {
+	j.Lock()
+	defer j.Unlock()
+	return append([]sentContentOp(nil), j.pending...)
+}
+
+func (j *sentContentsJournal) flushing() {
+	tick := time.Tick(time.Duration(j.conf.FlushInterval) * time.Second)
+	for {
+		select {
+		case <-tick:
+		case <-j.full:
+		}
+		if err := j.flush(); err != nil {
+			j.flushErrors.Inc()
+			log.WithField("error", err.Error()).Error("cannot write sent contents")
+		}
+	}
+}
+
+// writes pending ops in batches, written ones are removed from the journal
+func (j *sentContentsJournal) flush() error {
+	if j == nil {
+		return nil
+	}
+	j.flushMu.Lock()
+	defer j.flushMu.Unlock()
+
+	if time.Since(j.prunedAt) >= time.Hour {
+		if err := pruneSentContents(j.conf.RotationTable); err != nil {
+			return err
+		}
+		j.prunedAt = time.Now()
+	}
+	for {
+		ops := j.pendingOps()
+		if len(ops) == 0 {
+			return nil
+		}
+		if len(ops) > j.conf.BatchSize {
+			ops = ops[:j.conf.BatchSize]
+		}
+		if err := writeSentContents(j.conf.RotationTable, ops); err != nil {
+			return err
+		}
+		if err := j.written(len(ops)); err != nil {
+			return err
+		}
+	}
+}
+
+// the journal is written again with the rest of the ops
+func (j *sentContentsJournal) written(count int) error {
+	j.Lock()
+	defer j.Unlock()
+
+	j.pending = j.pending[count:]
+	j.pendingGauge.Set(float64(len(j.pending)))
+
+	tmpPath := j.conf.Journal + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("os.Create: %s", err.Error())
+	}
+	w := bufio.NewWriter(f)
+	for _, op := range j.pending {
+		line, _ := json.Marshal(op)
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("bufio.Flush: %s", err.Error())
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("f.Close: %s", err.Error())
+	}
+	if err := os.Rename(tmpPath, j.conf.Journal); err != nil {
+		return fmt.Errorf("os.Rename: %s", err.Error())
+	}
+	j.file.Close()
+	if j.file, err = os.OpenFile(j.conf.Journal, os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+		return fmt.Errorf("os.OpenFile: %s", err.Error())
+	}
+	return nil
+}
+
+// in one transaction, the batch may be written twice if the process dies before the journal is written again
+func writeSentContents(rotationTable string, ops []sentContentOp) error {
+	query := fmt.Sprintf("INSERT INTO %s%s "+
+		"(msisdn, id_service, id_content, sent_at) "+
+		"VALUES ($1, $2, $3, ($4::timestamptz AT TIME ZONE 'UTC'))",
+		Svc.dbConf.TablePrefix, rotationTable)
+
+	tx, err := Svc.db.Begin()
+	if err != nil {
+		return fmt.Errorf("db.Begin: %s", err.Error())
+	}
+	for _, op := range ops {
+		contentId := op.ContentId
+		if op.Op == sentContentClear {
+			contentId = ""
+		}
+		if _, err = tx.Exec(query, op.Msisdn, op.ServiceCode, contentId, op.At); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("tx.Exec: %s, op: %s", err.Error(), op.Op)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit: %s", err.Error())
+	}
+	return nil
+}
+
+// a clear older than unique days hides only rows which are not loaded anyway
+func pruneSentContents(rotationTable string) error {
+	query := fmt.Sprintf("DELETE FROM %s%s "+
+		"WHERE sent_at <= "+sentContentsSince(),
+		Svc.dbConf.TablePrefix, rotationTable)
+	res, err := Svc.db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+	}
+	deleted, _ := res.RowsAffected()
+	log.WithField("deleted", deleted).Debug("sent contents pruned")
+	return nil
+}
+
+func applySentContentOps(byKey map[string]map[string]struct{}, ops []sentContentOp) {
+	for _, op := range ops {
+		t := structs.ContentSentProperties{Msisdn: op.Msisdn, ServiceCode: op.ServiceCode}
+		switch op.Op {
+		case sentContentPush:
+			if _, ok := byKey[t.Key()]; !ok {
+				byKey[t.Key()] = make(map[string]struct{})
+			}
+			byKey[t.Key()][op.ContentId] = struct{}{}
+		case sentContentClear:
+			delete(byKey, t.Key())
+		}
+	}
+}
+
+// pairs of a in b
+func sentContentsMissing(a, b map[string]map[string]struct{}) (count int) {
+	for key, contentIds := range a {
+		for contentId := range contentIds {
+			if _, ok := b[key][contentId]; !ok {
+				count++
+			}
+		}
+	}
+	return
+}
+
+func sentContentsCount(byKey map[string]map[string]struct{}) (count int) {
+	for _, contentIds := range byKey {
+		count += len(contentIds)
+	}
+	return
+}
+
+// the table with pending ops must be the same as memory,
+// contents which are older than unique days but still in memory are counted as missing in the table
+func (s *SentContents) Check() (SentContentsCheck, error) {
+	if s.journal == nil {
+		return SentContentsCheck{}, fmt.Errorf("sent contents are not persisted%s", "")
+	}
+	s.journal.flushMu.Lock()
+	defer s.journal.flushMu.Unlock()
+
+	db, err := loadSentContents(s.journal.conf.RotationTable)
+	if err != nil {
+		return SentContentsCheck{}, err
+	}
+	s.RLock()
+	pending := s.journal.pendingOps()
+	applySentContentOps(db, pending)
+	res := SentContentsCheck{
+		At:              time.Now().UTC(),
+		Memory:          sentContentsCount(s.ByKey),
+		DB:              sentContentsCount(db),
+		Pending:         len(pending),
+		MissingInDB:     sentContentsMissing(s.ByKey, db),
+		MissingInMemory: sentContentsMissing(db, s.ByKey),
+	}
+	s.RUnlock()
+
+	s.journal.inconsistent.Set(float64(res.MissingInDB + res.MissingInMemory))
+	if res.MissingInDB > 0 || res.MissingInMemory > 0 {
+		log.WithFields(log.Fields{
+			"missing_in_db":     res.MissingInDB,
+			"missing_in_memory": res.MissingInMemory,
+		}).Warn("sent contents are inconsistent")
+	}
+	return res, nil
+}
+
+func (s *SentContents) checking(interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, err := s.Check(); err != nil {
+			log.WithField("error", err.Error()).Error("cannot check sent contents")
+		}
+	}
+}
+
+// pending ops are written on exit
+func (s *SentContents) Close() {
+	if s == nil || s.journal == nil {
+		return
+	}
+	if err := s.journal.flush(); err != nil {
+		log.WithFields(log.Fields{
+			"pending": len(s.journal.pendingOps()),
+			"error":   err.Error(),
+		}).Error("cannot write sent contents, they are kept in the journal")
+	}
+	s.journal.Lock()
+	s.journal.file.Close()
+	s.journal.Unlock()
+}
+
+func AddSentContentsHandlers(e *gin.Engine) {
+	g := e.Group("api")
+	g.GET("/sent_contents/check", sentContentsCheckHandler)
+}
+
+func sentContentsCheckHandler(c *gin.Context) {
+	res, err := Svc.SentContents.Check()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, res)
+}
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSentContentsApply(t *testing.T) {
+	byKey := make(map[string]map[string]struct{})
+	at := time.Now().UTC()
+	applySentContentOps(byKey, []sentContentOp{
+		{Op: sentContentPush, Msisdn: "66000001", ServiceCode: "777", ContentId: "a", At: at},
+		{Op: sentContentPush, Msisdn: "66000001", ServiceCode: "777", ContentId: "b", At: at},
+		{Op: sentContentPush, Msisdn: "66000002", ServiceCode: "777", ContentId: "a", At: at},
+		{Op: sentContentClear, Msisdn: "66000002", ServiceCode: "777", At: at},
+		{Op: sentContentPush, Msisdn: "66000002", ServiceCode: "777", ContentId: "c", At: at},
+	})
+	assert.Equal(t, 3, sentContentsCount(byKey))
+
+	db := make(map[string]map[string]struct{})
+	applySentContentOps(db, []sentContentOp{
+		{Op: sentContentPush, Msisdn: "66000001", ServiceCode: "777", ContentId: "a", At: at},
+		{Op: sentContentPush, Msisdn: "66000003", ServiceCode: "777", ContentId: "a", At: at},
+	})
+	assert.Equal(t, 2, sentContentsMissing(byKey, db), "in memory only")
+	assert.Equal(t, 1, sentContentsMissing(db, byKey), "in the table only")
+}
+
+func TestSentContentsJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sent_contents")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := SentContentsConfig{
+		Persist:   true,
+		Journal:   filepath.Join(dir, "sent_contents.journal"),
+		BatchSize: 2,
+	}
+	j := &sentContentsJournal{
+		conf:         conf,
+		full:         make(chan struct{}, 1),
+		pendingGauge: prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_sent_content_pending"}),
+	}
+	j.file, err = os.OpenFile(conf.Journal, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+
+	at := time.Now().UTC()
+	j.add(sentContentOp{Op: sentContentPush, Msisdn: "66000001", ServiceCode: "777", ContentId: "a", At: at})
+	j.add(sentContentOp{Op: sentContentPush, Msisdn: "66000001", ServiceCode: "777", ContentId: "b", At: at})
+	j.add(sentContentOp{Op: sentContentClear, Msisdn: "66000001", ServiceCode: "777", At: at})
+	assert.Equal(t, 1, len(j.full), "batch is full")
+
+	assert.NoError(t, j.written(2))
+	j.add(sentContentOp{Op: sentContentPush, Msisdn: "66000002", ServiceCode: "777", ContentId: "c", At: at})
+	j.file.Close()
+
+	loaded := &sentContentsJournal{conf: conf}
+	assert.NoError(t, loaded.load())
+	if assert.Equal(t, 2, len(loaded.pending), "not written ops are kept after restart") {
+		assert.Equal(t, sentContentClear, loaded.pending[0].Op)
+		assert.Equal(t, "c", loaded.pending[1].ContentId)
+	}
+}
+
+// needs postgres, see TestReporterGetAggregate
+func TestSentContentsRotationTable(t *testing.T) {
+	dsn := os.Getenv("MID_TEST_DB")
+	if dsn == "" {
+		t.Skip("MID_TEST_DB is not set")
+	}
+	testDB, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("sql.Open: %s", err.Error())
+	}
+	defer testDB.Close()
+	testDB.SetMaxOpenConns(1)
+
+	db, tablePrefix, uniqueDays := Svc.db, Svc.dbConf.TablePrefix, Svc.conf.UniqueDays
+	defer func() {
+		Svc.db, Svc.dbConf.TablePrefix, Svc.conf.UniqueDays = db, tablePrefix, uniqueDays
+	}()
+	Svc.db = testDB
+	Svc.dbConf.TablePrefix = "mid_test_"
+	Svc.conf.UniqueDays = 10
+
+	for _, query := range []string{
+		"CREATE TEMP TABLE mid_test_content_sent (" +
+			"msisdn varchar, id_service varchar, id_content varchar, sent_at timestamp)",
+		"CREATE TEMP TABLE mid_test_content_rotation (" +
+			"msisdn varchar, id_service varchar, id_content varchar, sent_at timestamp)",
+		"INSERT INTO mid_test_content_sent VALUES " +
+			"('66000001', '777', 'a', (now() AT TIME ZONE 'UTC') - INTERVAL '2 hours'), " +
+			"('66000002', '777', 'b', (now() AT TIME ZONE 'UTC') - INTERVAL '2 hours')",
+	} {
+		if _, err := testDB.Exec(query); err != nil {
+			t.Fatalf("db.Exec: %s, query: %s", err.Error(), query)
+		}
+	}
+
+	now := time.Now().UTC()
+	assert.NoError(t, writeSentContents("content_rotation", []sentContentOp{
+		{Op: sentContentPush, Msisdn: "66000001", ServiceCode: "777", ContentId: "c", At: now.Add(-time.Hour)},
+		{Op: sentContentClear, Msisdn: "66000001", ServiceCode: "777", At: now.Add(-30 * time.Minute)},
+		{Op: sentContentPush, Msisdn: "66000001", ServiceCode: "777", ContentId: "d", At: now.Add(-10 * time.Minute)},
+		{Op: sentContentPush, Msisdn: "66000002", ServiceCode: "777", ContentId: "e", At: now.Add(-time.Hour)},
+	}))
+
+	byKey, err := loadSentContents("content_rotation")
+	assert.NoError(t, err)
+	expected := make(map[string]map[string]struct{})
+	applySentContentOps(expected, []sentContentOp{
+		{Op: sentContentPush, Msisdn: "66000001", ServiceCode: "777", ContentId: "d"},
+		{Op: sentContentPush, Msisdn: "66000002", ServiceCode: "777", ContentId: "b"},
+		{Op: sentContentPush, Msisdn: "66000002", ServiceCode: "777", ContentId: "e"},
+	})
+	assert.Equal(t, expected, byKey, "rows sent before the clear are skipped")
+
+	var count int
+	assert.NoError(t, testDB.QueryRow("SELECT count(*) FROM mid_test_content_sent").Scan(&count))
+	assert.Equal(t, 2, count, "content_sent is not written")
+
+	assert.NoError(t, writeSentContents("content_rotation", []sentContentOp{
+		{Op: sentContentPush, Msisdn: "66000003", ServiceCode: "777", ContentId: "f", At: now.AddDate(0, 0, -11)},
+	}))
+	assert.NoError(t, pruneSentContents("content_rotation"))
+	assert.NoError(t, testDB.QueryRow("SELECT count(*) FROM mid_test_content_rotation").Scan(&count))
+	assert.Equal(t, 4, count, "rows older than unique days are deleted")
+}
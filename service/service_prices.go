@@ -0,0 +1,221 @@
+package service
+
+// prices of services: per operator overrides (operator code 0 - all operators),
+// currency, vat and validity period; the price of the service itself is used if no row is valid
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type ServicePrices struct {
+	sync.RWMutex
+	ByServiceCode map[string][]ServicePrice
+}
+
+type ServicePrice struct {
+	Id           int64      `json:"id"`
+	ServiceCode  string     `json:"service_code"`
+	OperatorCode int64      `json:"operator_code"` // 0 - all operators
+	PriceCents   int        `json:"price_cents"`   // with vat
+	Currency     string     `json:"currency"`      // ISO 4217, config currency if empty
+	VATPercent   float64    `json:"vat_percent"`
+	ValidFrom    *time.Time `json:"valid_from,omitempty"` // nil - always
+	ValidTo      *time.Time `json:"valid_to,omitempty"`   // excluded, nil - forever
+}
+
+type EffectivePrice struct {
+	ServiceCode  string     `json:"service_code"`
+	OperatorCode int64      `json:"operator_code"`
+	PriceCents   int        `json:"price_cents"`
+	NetCents     int        `json:"net_cents"` // without vat
+	Currency     string     `json:"currency"`
+	VATPercent   float64    `json:"vat_percent"`
+	PriceId      int64      `json:"id_price,omitempty"` // 0 - price of the service
+	ValidFrom    *time.Time `json:"valid_from,omitempty"`
+	ValidTo      *time.Time `json:"valid_to,omitempty"`
+}
+
+func (sp ServicePrice) validAt(at time.Time) bool {
+	if sp.ValidFrom != nil && at.Before(*sp.ValidFrom) {
+		return false
+	}
+	if sp.ValidTo != nil && !at.Before(*sp.ValidTo) {
+		return false
+	}
+	return true
+}
+
+func (sp ServicePrice) check() error {
+	if sp.PriceCents <= 0 {
+		return fmt.Errorf("wrong price: %d", sp.PriceCents)
+	}
+	if sp.Currency != "" && len(sp.Currency) != 3 {
+		return fmt.Errorf("wrong currency: %s", sp.Currency)
+	}
+	if sp.VATPercent < 0 || sp.VATPercent >= 100 {
+		return fmt.Errorf("wrong vat: %v", sp.VATPercent)
+	}
+	if sp.ValidFrom != nil && sp.ValidTo != nil && !sp.ValidTo.After(*sp.ValidFrom) {
+		return fmt.Errorf("valid to %s is not after valid from %s",
+			sp.ValidTo.Format(time.RFC3339), sp.ValidFrom.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// operator price wins over the price for all operators, then the latest valid from
+func findServicePrice(prices []ServicePrice, operatorCode int64, at time.Time) (ServicePrice, bool) {
+	var found ServicePrice
+	ok := false
+	for _, sp := range prices {
+		if (sp.OperatorCode != 0 && sp.OperatorCode != operatorCode) || !sp.validAt(at) {
+			continue
+		}
+		if !ok || servicePriceBefore(found, sp) {
+			found, ok = sp, true
+		}
+	}
+	return found, ok
+}
+
+func servicePriceBefore(a, b ServicePrice) bool {
+	if (a.OperatorCode == 0) != (b.OperatorCode == 0) {
+		return a.OperatorCode == 0
+	}
+	if a.ValidFrom == nil || b.ValidFrom == nil {
+		return a.ValidFrom == nil && b.ValidFrom != nil
+	}
+	return a.ValidFrom.Before(*b.ValidFrom)
+}
+
+// rounded, prices are not negative
+func netCents(priceCents int, vatPercent float64) int {
+	return int(float64(priceCents)*100/(100+vatPercent) + 0.5)
+}
+
+func (sp ServicePrice) effective(operatorCode int64) EffectivePrice {
+	currency := sp.Currency
+	if currency == "" {
+		currency = Svc.conf.Currency
+	}
+	return EffectivePrice{
+		ServiceCode:  sp.ServiceCode,
+		OperatorCode: operatorCode,
+		PriceCents:   sp.PriceCents,
+		NetCents:     netCents(sp.PriceCents, sp.VATPercent),
+		Currency:     strings.ToUpper(currency),
+		VATPercent:   sp.VATPercent,
+		PriceId:      sp.Id,
+		ValidFrom:    sp.ValidFrom,
+		ValidTo:      sp.ValidTo,
+	}
+}
+
+// price of the service for the operator at the moment,
+// the price of the service as it was at the moment if there is no valid override
+func (ps *ServicePrices) PriceFor(serviceCode string, operatorCode int64, at time.Time) (EffectivePrice, error) {
+	if ps == nil {
+		return EffectivePrice{}, fmt.Errorf("service prices are disabled%s", "")
+	}
+	ps.RLock()
+	sp, ok := findServicePrice(ps.ByServiceCode[serviceCode], operatorCode, at)
+	ps.RUnlock()
+	if ok {
+		return sp.effective(operatorCode), nil
+	}
+
+	if Svc.Services == nil {
+		return EffectivePrice{}, fmt.Errorf("service %s: no price", serviceCode)
+	}
+	svc, err := Svc.Services.GetByCode(serviceCode)
+	if err != nil {
+		return EffectivePrice{}, fmt.Errorf("service %s: %s", serviceCode, err.Error())
+	}
+	if old, err := Svc.Services.ByIdAt(svc.Id, at); err == nil {
+		svc = old
+	}
+	return ServicePrice{ServiceCode: serviceCode, PriceCents: svc.PriceCents}.effective(operatorCode), nil
+}
+
+// wrong rows are skipped and reported, changes are kept in the history
+func (ps *ServicePrices) Reload() error {
+	query := fmt.Sprintf("SELECT "+
+		"id, "+
+		"service_code, "+
+		"operator_code, "+
+		"price_cents, "+
+		"currency, "+
+		"vat_percent, "+
+		"valid_from, "+
+		"valid_to "+
+		"FROM %sservice_prices",
+		Svc.dbConf.TablePrefix)
+	var err error
+	var rows *sql.Rows
+	rows, err = Svc.db.Query(query)
+	if err != nil {
+		err = fmt.Errorf("db.Query: %s, query: %s", err.Error(), query)
+		return err
+	}
+	defer rows.Close()
+
+	byServiceCode := make(map[string][]ServicePrice)
+	var wrong []string
+	for rows.Next() {
+		var sp ServicePrice
+		if err = rows.Scan(
+			&sp.Id,
+			&sp.ServiceCode,
+			&sp.OperatorCode,
+			&sp.PriceCents,
+			&sp.Currency,
+			&sp.VATPercent,
+			&sp.ValidFrom,
+			&sp.ValidTo,
+		); err != nil {
+			err = fmt.Errorf("rows.Scan: %s", err.Error())
+			return err
+		}
+		if err := sp.check(); err != nil {
+			log.WithFields(log.Fields{
+				"id":    sp.Id,
+				"error": err.Error(),
+			}).Error("wrong service price")
+			wrong = append(wrong, fmt.Sprintf("%d: %s", sp.Id, err.Error()))
+			continue
+		}
+		byServiceCode[sp.ServiceCode] = append(byServiceCode[sp.ServiceCode], sp)
+	}
+	if rows.Err() != nil {
+		err = fmt.Errorf("rows.Err: %s", rows.Err().Error())
+		return err
+	}
+
+	ps.Lock()
+	loaded := make(map[int64]struct{})
+	for _, prices := range byServiceCode {
+		for _, sp := range prices {
+			loaded[sp.Id] = struct{}{}
+			Svc.History.Record(HistoryServicePrice, strconv.FormatInt(sp.Id, 10), HistorySourceDB, sp)
+		}
+	}
+	for _, prices := range ps.ByServiceCode {
+		for _, sp := range prices {
+			if _, ok := loaded[sp.Id]; !ok {
+				Svc.History.RecordDeleted(HistoryServicePrice, strconv.FormatInt(sp.Id, 10), HistorySourceDB)
+			}
+		}
+	}
+	ps.ByServiceCode = byServiceCode
+	ps.Unlock()
+	log.WithField("count", len(byServiceCode)).Debug("service prices")
+	if len(wrong) > 0 {
+		return fmt.Errorf("wrong service prices: %s", strings.Join(wrong, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServicePriceFind(t *testing.T) {
+	jan := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	feb := time.Date(2017, 2, 1, 0, 0, 0, 0, time.UTC)
+	prices := []ServicePrice{
+		{Id: 1, PriceCents: 1000},
+		{Id: 2, PriceCents: 1500, ValidFrom: &jan},
+		{Id: 3, OperatorCode: 52001, PriceCents: 900, ValidTo: &feb},
+		{Id: 4, OperatorCode: 52002, PriceCents: 800},
+	}
+	id := func(operatorCode int64, at time.Time) int64 {
+		sp, ok := findServicePrice(prices, operatorCode, at)
+		if !ok {
+			return 0
+		}
+		return sp.Id
+	}
+	dec := time.Date(2016, 12, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, int64(1), id(52000, dec), "for all operators")
+	assert.Equal(t, int64(2), id(52000, jan), "the latest valid")
+	assert.Equal(t, int64(3), id(52001, jan), "operator price")
+	assert.Equal(t, int64(2), id(52001, feb), "operator price is not valid any more")
+	assert.Equal(t, int64(4), id(52002, feb))
+	_, ok := findServicePrice(nil, 52000, jan)
+	assert.False(t, ok, "no prices")
+}
+
+func TestServicePriceCheck(t *testing.T) {
+	jan := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, ServicePrice{PriceCents: 1000, Currency: "THB", VATPercent: 7}.check())
+	assert.Error(t, ServicePrice{}.check(), "no price")
+	assert.Error(t, ServicePrice{PriceCents: 1000, Currency: "baht"}.check(), "wrong currency")
+	assert.Error(t, ServicePrice{PriceCents: 1000, VATPercent: 100}.check(), "wrong vat")
+	assert.Error(t, ServicePrice{PriceCents: 1000, ValidFrom: &jan, ValidTo: &jan}.check(), "empty period")
+}
+
+func TestServicePriceEffective(t *testing.T) {
+	ep := ServicePrice{Id: 2, ServiceCode: "777", PriceCents: 1070, VATPercent: 7}.effective(52001)
+	assert.Equal(t, 1000, ep.NetCents, "without vat")
+	assert.Equal(t, "THB", ep.Currency, "config currency")
+	assert.Equal(t, int64(52001), ep.OperatorCode)
+
+	ep = ServicePrice{PriceCents: 199, Currency: "usd"}.effective(0)
+	assert.Equal(t, 199, ep.NetCents)
+	assert.Equal(t, "USD", ep.Currency)
+}
@@ -24,6 +24,8 @@ type Services interface {
 	GetByCode(string) (xmp_api_structs.Service, error)
 	GetById(string) (xmp_api_structs.Service, error)
 	GetAll() map[string]xmp_api_structs.Service
+	ByIdAt(string, time.Time) (xmp_api_structs.Service, error)
+	CanCharge(string, ChargeState, time.Time) (ChargeDecision, error)
 	GetJson() string
 	ShowLoaded()
 }
@@ -36,15 +38,24 @@ type ServicesConfig struct {
 type services struct {
 	sync.RWMutex
 	conf      ServicesConfig
+	loc       *time.Location
 	ByCode    map[string]xmp_api_structs.Service
 	ByUUID    map[string]xmp_api_structs.Service
 	loadError prometheus.Gauge
 	notFound  m.Gauge
 }
 
-func initServices(appName string, servConfig ServicesConfig) Services {
+func initServices(appName string, servConfig ServicesConfig, timeZone string) Services {
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"tz":    timeZone,
+			"error": err.Error(),
+		}).Fatal("wrong time zone")
+	}
 	svcs := &services{
 		conf:      servConfig,
+		loc:       loc,
 		loadError: m.PrometheusGauge(appName, "services_load", "error", "load services error"),
 		notFound:  m.NewGauge(appName, "service", "not_found", "service not found error"),
 	}
@@ -110,6 +121,7 @@ func (s *services) Update(acceptorService xmp_api_structs.Service) error {
 		log.WithFields(log.Fields{
 			"id": acceptorService.Id,
 		}).Debug("service deleted")
+		Svc.History.RecordDeleted(HistoryService, acceptorService.Id, s.historySource())
 		return nil
 	}
 
@@ -148,6 +160,7 @@ func (s *services) Update(acceptorService xmp_api_structs.Service) error {
 	}
 	s.ByUUID[acceptorService.Id] = acceptorService
 	s.ByCode[acceptorService.Code] = acceptorService
+	Svc.History.Record(HistoryService, acceptorService.Id, s.historySource(), acceptorService)
 	return nil
 }
 
@@ -349,11 +362,17 @@ func (s *services) loadFromCache() (err error) {
 		serviceContents[v.Id] = v
 	}
 
+	for id := range s.ByUUID {
+		if _, ok := serviceContents[id]; !ok {
+			Svc.History.RecordDeleted(HistoryService, id, s.historySource())
+		}
+	}
 	s.ByUUID = make(map[string]xmp_api_structs.Service, len(svcs))
 	s.ByCode = make(map[string]xmp_api_structs.Service, len(s.ByUUID))
 	for _, v := range serviceContents {
 		s.ByUUID[v.Id] = v
 		s.ByCode[v.Code] = v
+		Svc.History.Record(HistoryService, v.Id, s.historySource(), v)
 	}
 	return nil
 }
@@ -376,7 +395,19 @@ func (s *services) Reload() (err error) {
 	return nil
 }
 
+func (s *services) historySource() string {
+	if s.conf.FromControlPanel {
+		return HistorySourceControlPanel
+	}
+	return HistorySourceDB
+}
+
 func (s *services) Apply(svcs map[string]xmp_api_structs.Service) {
+	for id := range s.ByUUID {
+		if _, ok := svcs[id]; !ok {
+			Svc.History.RecordDeleted(HistoryService, id, s.historySource())
+		}
+	}
 	s.ByUUID = make(map[string]xmp_api_structs.Service, len(svcs))
 	s.ByCode = make(map[string]xmp_api_structs.Service, len(svcs))
 	s.loadError.Set(0)
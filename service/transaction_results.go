@@ -0,0 +1,131 @@
+package service
+
+// classification of transaction results,
+// shared by live reporter and aggregate api
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// transaction result -> names of adAggregate counters (as in json)
+// counters with "_sum" suffix get the price, others get the count of transactions
+// empty list of counters in config disables the result
+type TransactionResultsConfig map[string][]string
+
+var defaultTransactionResults = TransactionResultsConfig{
+	"paid":             {"mo", "mo_charge_success", "mo_charge_sum"},
+	"failed":           {"mo", "mo_charge_failed"},
+	"rejected":         {"mo", "mo_rejected"},
+	"retry_paid":       {"renewal", "renewal_charge_success", "renewal_charge_sum"},
+	"retry_failed":     {"renewal", "renewal_failed"},
+	"injection_paid":   {"injection", "injection_charge_success", "injection_charge_sum"},
+	"injection_failed": {"injection", "injection_failed"},
+	"expired_paid":     {"expired", "expired_charge_success", "expired_charge_sum"},
+	"expired_failed":   {"expired", "expired_failed"},
+}
+
+type transactionResults map[string][]string
+
+// defaults are overriden by the config
+func newTransactionResults(conf TransactionResultsConfig) (transactionResults, error) {
+	tr := make(transactionResults, len(defaultTransactionResults)+len(conf))
+	for result, counters := range defaultTransactionResults {
+		tr[result] = counters
+	}
+	for result, counters := range conf {
+		tr[strings.ToLower(result)] = counters
+	}
+
+	a := newAdAggregate()
+	for result, counters := range tr {
+		for _, name := range counters {
+			if a.counter(name) == nil {
+				return nil, fmt.Errorf("transaction result %s: unknown counter %s", result, name)
+			}
+		}
+	}
+	return tr, nil
+}
+
+// results are case insensitive as the keys of the config
+func (tr transactionResults) counters(result string) ([]string, bool) {
+	counters, ok := tr[strings.ToLower(strings.TrimSpace(result))]
+	return counters, ok
+}
+
+// lookup key of the result of the event, a charge after attempts is a renewal,
+// e.g. paid with attempts is retry_paid if there is such result
+func (tr transactionResults) key(result string, attempts int) string {
+	key := strings.ToLower(strings.TrimSpace(result))
+	if attempts > 0 && tr.mo(key) {
+		if _, ok := tr["retry_"+key]; ok {
+			return "retry_" + key
+		}
+	}
+	return key
+}
+
+// adds count (or sum) of transactions with the result to the aggregate
+// returns false if the result is unknown
+func (tr transactionResults) apply(a adAggregate, result string, count, sum int) bool {
+	counters, ok := tr.counters(result)
+	if !ok {
+		return false
+	}
+	for _, name := range counters {
+		if strings.HasSuffix(name, "_sum") {
+			a.counter(name).Add(sum)
+		} else {
+			a.counter(name).Add(count)
+		}
+	}
+	return true
+}
+
+// whether the price is added to a counter of the result
+func (tr transactionResults) summed(result string) bool {
+	counters, _ := tr.counters(result)
+	for _, name := range counters {
+		if strings.HasSuffix(name, "_sum") {
+			return true
+		}
+	}
+	return false
+}
+
+// whether the result is counted as a successful or a failed charge
+func (tr transactionResults) charge(result string) (success, failed bool) {
+	counters, _ := tr.counters(result)
+	for _, name := range counters {
+		if strings.HasSuffix(name, "_charge_success") {
+			success = true
+		}
+		if strings.HasSuffix(name, "_failed") {
+			failed = true
+		}
+	}
+	return
+}
+
+func (tr transactionResults) mo(result string) bool {
+	counters, _ := tr.counters(result)
+	for _, name := range counters {
+		if name == "mo" {
+			return true
+		}
+	}
+	return false
+}
+
+// results of the transactions table which are charged, with or without attempts
+func (tr transactionResults) chargedResults(attempts int) (results []string) {
+	for result := range tr {
+		if success, _ := tr.charge(tr.key(result, attempts)); success {
+			results = append(results, result)
+		}
+	}
+	sort.Strings(results)
+	return
+}
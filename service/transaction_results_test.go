@@ -0,0 +1,184 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var allCounters = []string{
+	"lp_hits",
+	"lp_msisdn_hits",
+	"mo",
+	"mo_charge_success",
+	"mo_charge_sum",
+	"mo_charge_failed",
+	"mo_rejected",
+	"outflow",
+	"renewal",
+	"renewal_charge_success",
+	"renewal_charge_sum",
+	"renewal_failed",
+	"injection",
+	"injection_charge_success",
+	"injection_charge_sum",
+	"injection_failed",
+	"expired",
+	"expired_charge_success",
+	"expired_charge_sum",
+	"expired_failed",
+	"pixels",
+	"unsubscribes",
+	"content_delivered",
+	"sms_sent",
+	"redirects",
+	"lp_hits_inactive",
+}
+
+// counters which must be changed after applying the result, others must stay zero
+func assertCounters(t *testing.T, a adAggregate, expected map[string]int64, msg string) {
+	for _, name := range allCounters {
+		assert.Equal(t, expected[name], a.counter(name).count, msg+": "+name)
+	}
+}
+
+func TestTransactionResultsDefault(t *testing.T) {
+	tr, err := newTransactionResults(nil)
+	assert.NoError(t, err, "default config")
+
+	cases := map[string]map[string]int64{
+		"paid":             {"mo": 3, "mo_charge_success": 3, "mo_charge_sum": 30},
+		"failed":           {"mo": 3, "mo_charge_failed": 3},
+		"rejected":         {"mo": 3, "mo_rejected": 3},
+		"retry_paid":       {"renewal": 3, "renewal_charge_success": 3, "renewal_charge_sum": 30},
+		"retry_failed":     {"renewal": 3, "renewal_failed": 3},
+		"injection_paid":   {"injection": 3, "injection_charge_success": 3, "injection_charge_sum": 30},
+		"injection_failed": {"injection": 3, "injection_failed": 3},
+		"expired_paid":     {"expired": 3, "expired_charge_success": 3, "expired_charge_sum": 30},
+		"expired_failed":   {"expired": 3, "expired_failed": 3},
+	}
+	assert.Equal(t, len(defaultTransactionResults), len(cases), "all default results are tested")
+
+	for result, expected := range cases {
+		a := newAdAggregate()
+		assert.True(t, tr.apply(a, result, 3, 30), "known result "+result)
+		assertCounters(t, a, expected, result)
+	}
+}
+
+func TestTransactionResultsAccumulate(t *testing.T) {
+	tr, _ := newTransactionResults(nil)
+
+	// live reporter applies one transaction at a time, aggregate api - grouped rows
+	a := newAdAggregate()
+	tr.apply(a, "paid", 1, 10)
+	tr.apply(a, "paid", 1, 10)
+	tr.apply(a, "failed", 1, 10)
+	tr.apply(a, "paid", 2, 20)
+	assertCounters(t, a, map[string]int64{
+		"mo":                5,
+		"mo_charge_success": 4,
+		"mo_charge_sum":     40,
+		"mo_charge_failed":  1,
+	}, "accumulate")
+}
+
+func TestTransactionResultsUnknown(t *testing.T) {
+	tr, _ := newTransactionResults(nil)
+
+	for _, result := range []string{"", "unknown", "retry", "paid_retry"} {
+		a := newAdAggregate()
+		assert.False(t, tr.apply(a, result, 1, 10), "unknown result "+result)
+		assertCounters(t, a, map[string]int64{}, result)
+	}
+}
+
+func TestTransactionResultsConfig(t *testing.T) {
+	tr, err := newTransactionResults(TransactionResultsConfig{
+		"Blacklisted":  {"mo", "mo_rejected"},
+		"expired_paid": {"mo", "mo_charge_success", "mo_charge_sum"},
+		"rejected":     {},
+	})
+	assert.NoError(t, err, "valid config")
+
+	a := newAdAggregate()
+	assert.True(t, tr.apply(a, "blacklisted", 1, 10), "new result")
+	assertCounters(t, a, map[string]int64{"mo": 1, "mo_rejected": 1}, "blacklisted")
+
+	a = newAdAggregate()
+	assert.True(t, tr.apply(a, "expired_paid", 1, 10), "overriden result")
+	assertCounters(t, a, map[string]int64{"mo": 1, "mo_charge_success": 1, "mo_charge_sum": 10}, "expired_paid")
+
+	a = newAdAggregate()
+	assert.True(t, tr.apply(a, "rejected", 1, 10), "disabled result")
+	assertCounters(t, a, map[string]int64{}, "rejected")
+
+	a = newAdAggregate()
+	assert.True(t, tr.apply(a, "paid", 1, 10), "default result is kept")
+	assertCounters(t, a, map[string]int64{"mo": 1, "mo_charge_success": 1, "mo_charge_sum": 10}, "paid")
+
+	_, err = newTransactionResults(TransactionResultsConfig{"paid": {"mo", "revenue"}})
+	assert.Error(t, err, "unknown counter")
+}
+
+func TestTransactionResultsKey(t *testing.T) {
+	tr, _ := newTransactionResults(TransactionResultsConfig{"Blacklisted": {"mo", "mo_rejected"}})
+
+	a := newAdAggregate()
+	assert.True(t, tr.apply(a, "PAID", 1, 10), "case insensitive")
+	assertCounters(t, a, map[string]int64{"mo": 1, "mo_charge_success": 1, "mo_charge_sum": 10}, "PAID")
+	assert.True(t, tr.mo("BlackListed"), "case insensitive config key")
+
+	assert.Equal(t, "paid", tr.key(" Paid ", 0))
+	assert.Equal(t, "retry_paid", tr.key("Paid", 2), "charge after attempts")
+	assert.Equal(t, "retry_failed", tr.key("failed", 1))
+	assert.Equal(t, "rejected", tr.key("rejected", 1), "no retry result")
+	assert.Equal(t, "injection_paid", tr.key("injection_paid", 3), "not mo")
+}
+
+func TestTransactionResultsCharge(t *testing.T) {
+	tr, _ := newTransactionResults(nil)
+
+	for _, result := range []string{"paid", "retry_paid", "injection_paid", "expired_paid"} {
+		success, failed := tr.charge(result)
+		assert.True(t, success, "charged "+result)
+		assert.False(t, failed, "charged "+result)
+	}
+	for _, result := range []string{"failed", "retry_failed", "injection_failed", "expired_failed"} {
+		success, failed := tr.charge(result)
+		assert.False(t, success, "failed "+result)
+		assert.True(t, failed, "failed "+result)
+	}
+	for _, result := range []string{"rejected", "unknown"} {
+		success, failed := tr.charge(result)
+		assert.False(t, success, "not charged "+result)
+		assert.False(t, failed, "not charged "+result)
+	}
+	assert.Equal(t,
+		[]string{"expired_paid", "injection_paid", "paid", "retry_paid"},
+		tr.chargedResults(0),
+		"charged results",
+	)
+
+	tr, _ = newTransactionResults(TransactionResultsConfig{"retry_paid": {"renewal"}})
+	assert.Equal(t, []string{"expired_paid", "injection_paid"}, tr.chargedResults(1), "charged after attempts")
+}
+
+func TestTransactionResultsMO(t *testing.T) {
+	tr, _ := newTransactionResults(nil)
+
+	for _, result := range []string{"paid", "failed", "rejected"} {
+		assert.True(t, tr.mo(result), "mo "+result)
+	}
+	for _, result := range []string{"retry_paid", "injection_paid", "unknown"} {
+		assert.False(t, tr.mo(result), "not mo "+result)
+	}
+}
+
+func TestAdAggregateCounters(t *testing.T) {
+	a := newAdAggregate()
+	for _, name := range allCounters {
+		assert.NotNil(t, a.counter(name), "counter "+name)
+	}
+	assert.Nil(t, a.counter("unknown"), "unknown counter")
+}